@@ -0,0 +1,200 @@
+package files
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+)
+
+// ACLRule gives roles permissions on the paths of a volume matching a glob.
+type ACLRule struct {
+	Path        string
+	Roles       []string
+	Permissions []Permission
+}
+
+func NewACLRule(config ACLConfig) (ACLRule, error) {
+	rule := ACLRule{Path: config.Path, Roles: config.Roles}
+	for _, segment := range splitPath(config.Path) {
+		if _, err := path.Match(segment, ""); err != nil {
+			return rule, fmt.Errorf("invalid path '%s': %v", config.Path, err)
+		}
+	}
+
+	for _, it := range config.Permissions {
+		switch permission := Permission(it); permission {
+		case PermissionRead, PermissionList, PermissionWrite, PermissionShare:
+			rule.Permissions = append(rule.Permissions, permission)
+		default:
+			return rule, fmt.Errorf("unknown permission '%s'", it)
+		}
+	}
+	return rule, nil
+}
+
+// Allows reports whether the rule lets any of roles use permission. Searching
+// is part of listing.
+func (r ACLRule) Allows(roles []string, permission Permission) bool {
+	if permission == PermissionSearch {
+		permission = PermissionList
+	}
+	if !slices.Contains(r.Permissions, permission) {
+		return false
+	}
+
+	for _, role := range roles {
+		if slices.Contains(r.Roles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(cleanSharePath(p), "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// matchGlob matches a path against pattern, where "**" matches any number of
+// segments, including none, and other segments are matched with path.Match.
+func matchGlob(pattern, name string) bool {
+	return matchSegments(splitPath(pattern), splitPath(name))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// aclRules returns the rules deciding access to p. The first path glob in the
+// volume that matches decides, through every rule written for that glob, so
+// different roles can be given different permissions on the same paths. Nil
+// is returned when no rule matches.
+func (v *Volume) aclRules(p string) []ACLRule {
+	var rules []ACLRule
+	for _, rule := range v.ACL {
+		if rules != nil {
+			if rule.Path == rules[0].Path {
+				rules = append(rules, rule)
+			}
+		} else if matchGlob(rule.Path, p) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// RolesAllow reports whether users with roles can use permission on p. Paths
+// without acl rules are open to everyone with one of the roles of the volume.
+func (v *Volume) RolesAllow(roles []string, p string, permission Permission) bool {
+	rules := v.aclRules(p)
+	if rules == nil {
+		return v.HasRole(roles)
+	}
+
+	for _, rule := range rules {
+		if rule.Allows(roles, permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// PublicAt reports whether the privacy of the volume lets anyone read p. Acl
+// rules take paths out of that, so restricted paths aren't readable by anyone
+// without the roles they name.
+func (v *Volume) PublicAt(p string) bool {
+	return (v.Privacy == "public" || v.Privacy == "unlisted") && v.aclRules(p) == nil
+}
+
+// Allows reports whether auth can use permission on p, the same way requests
+// for p are checked.
+func (v *Volume) Allows(auth Authorization, p string, permission Permission) bool {
+	if !permission.Full() && v.PublicAt(p) {
+		return true
+	}
+	return auth != nil && auth.CanAccess(v, p, permission)
+}
+
+// AllowsTree reports whether auth can use permission on p and everything
+// below it. Deleting, moving or copying a directory acts on all of it, so the
+// acl rules of paths further down have to allow it too.
+func (v *Volume) AllowsTree(auth Authorization, p string, permission Permission) (bool, error) {
+	return v.allowsTree(p, func(child string) bool {
+		return v.Allows(auth, child, permission)
+	})
+}
+
+// allowsTree reports whether allowed holds for p and everything below it.
+// Without acl rules every path is decided like p, so nothing is walked.
+func (v *Volume) allowsTree(p string, allowed func(string) bool) (bool, error) {
+	if !allowed(p) {
+		return false, nil
+	}
+	if len(v.ACL) == 0 {
+		return true, nil
+	}
+
+	result := true
+	err := v.WalkDir(p, func(child string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !allowed(child) {
+			result = false
+			return fs.SkipAll
+		}
+		return nil
+	})
+	return result, err
+}
+
+// Visible reports whether auth can see an entry when it is listed, searched
+// for or archived. Only volumes with acl rules hide anything.
+func (v *Volume) Visible(auth Authorization, p string, isDir bool) bool {
+	if len(v.ACL) == 0 {
+		return true
+	}
+
+	if isDir {
+		return v.Allows(auth, p, PermissionList)
+	}
+	return v.Allows(auth, p, PermissionRead)
+}
+
+// FilterVisible drops the entries auth can't see.
+func (v *Volume) FilterVisible(auth Authorization, entries []*VolumeEntry) []*VolumeEntry {
+	if len(v.ACL) == 0 {
+		return entries
+	}
+
+	visible := []*VolumeEntry{}
+	for _, entry := range entries {
+		if v.Visible(auth, entry.Path, entry.IsDir) {
+			visible = append(visible, entry)
+		}
+	}
+	return visible
+}
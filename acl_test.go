@@ -0,0 +1,267 @@
+package files
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestMatchGlob(t *testing.T) {
+	cases := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"photos", "photos", true},
+		{"photos", "photos-private", false},
+		{"photos", "photos/a.jpg", false},
+		{"photos/*", "photos/a.jpg", true},
+		{"photos/*", "photos", false},
+		{"photos/*", "photos/trip/a.jpg", false},
+		{"photos/*", "photos-private/a.jpg", false},
+		{"*.txt", "a.txt", true},
+		{"*.txt", "docs/a.txt", false},
+
+		{"photos/**", "photos", true},
+		{"photos/**", "photos/a.jpg", true},
+		{"photos/**", "photos/trip/2024/a.jpg", true},
+		{"photos/**", "photos-private", false},
+		{"photos/**", "photos-private/a.jpg", false},
+		{"photos/**", "other/photos/a.jpg", false},
+
+		{"**/secret", "secret", true},
+		{"**/secret", "a/b/secret", true},
+		{"**/secret", "a/secret/b", false},
+		{"**/secret", "a/not-secret", false},
+		{"**/*.key", "b.key", true},
+		{"**/*.key", "a/b/c.key", true},
+		{"**/*.key", "a/b.key/c", false},
+
+		{"a/**/z", "a/z", true},
+		{"a/**/z", "a/b/c/z", true},
+		{"a/**/z", "a/b/c/z/d", false},
+		{"a/**/z", "b/a/z", false},
+		{"a/**/z", "a/b/zz", false},
+		{"**/secret/**", "secret", true},
+		{"**/secret/**", "projects/secret/plans/a.txt", true},
+		{"**/secret/**", "projects/secrets/a.txt", false},
+
+		{"**", "", true},
+		{"**", "a/b/c", true},
+		{"", "", true},
+		{"", "a", false},
+
+		{"photos/*", "/photos/a.jpg", true},
+		{"photos/*", "photos/./a.jpg", true},
+		{"/photos/*/", "photos/a.jpg", true},
+		{"photos/*", "photos/../secret", false},
+		{"secret/**", "photos/../secret/a", true},
+	}
+
+	for _, c := range cases {
+		if got := matchGlob(c.pattern, c.name); got != c.match {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", c.pattern, c.name, got, c.match)
+		}
+	}
+}
+
+func newTestACLVolume(t *testing.T) *Volume {
+	t.Helper()
+
+	configs := []ACLConfig{
+		{Path: "public/**", Roles: []string{"guest", "staff"}, Permissions: []string{"read", "list"}},
+		{Path: "projects/secret/**", Roles: []string{"admin"}, Permissions: []string{"read", "list", "write"}},
+		{Path: "projects/**", Roles: []string{"staff"}, Permissions: []string{"read", "list", "write", "share"}},
+		{Path: "projects/**", Roles: []string{"guest"}, Permissions: []string{"read"}},
+		// the first glob matching decides through all of its rules, wherever
+		// they are
+		{Path: "projects/secret/**", Roles: []string{"staff"}, Permissions: []string{"list"}},
+	}
+
+	volume := &Volume{
+		Name:  "v",
+		Roles: map[string]struct{}{"staff": {}, "guest": {}},
+	}
+	for _, config := range configs {
+		rule, err := NewACLRule(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		volume.ACL = append(volume.ACL, rule)
+	}
+	return volume
+}
+
+func TestNewACLRule(t *testing.T) {
+	for _, config := range []ACLConfig{
+		{Path: "photos/[", Roles: []string{"staff"}, Permissions: []string{"read"}},
+		{Path: "photos/**", Roles: []string{"staff"}, Permissions: []string{"search"}},
+		{Path: "photos/**", Roles: []string{"staff"}, Permissions: []string{"delete"}},
+	} {
+		if _, err := NewACLRule(config); err == nil {
+			t.Errorf("rule %+v was accepted", config)
+		}
+	}
+}
+
+func TestVolumeRolesAllow(t *testing.T) {
+	volume := newTestACLVolume(t)
+
+	cases := []struct {
+		roles      []string
+		path       string
+		permission Permission
+		allow      bool
+	}{
+		{[]string{"staff"}, "projects/a.txt", PermissionWrite, true},
+		{[]string{"staff"}, "projects", PermissionList, true},
+		{[]string{"guest"}, "projects/a.txt", PermissionRead, true},
+		{[]string{"guest"}, "projects/a.txt", PermissionWrite, false},
+		{[]string{"guest"}, "projects", PermissionList, false},
+
+		// the secret glob comes first, so the broader projects rules don't
+		// apply below it
+		{[]string{"staff"}, "projects/secret/plan.txt", PermissionWrite, false},
+		{[]string{"staff"}, "projects/secret/plan.txt", PermissionRead, false},
+		{[]string{"staff"}, "projects/secret", PermissionList, true},
+		{[]string{"guest"}, "projects/secret/plan.txt", PermissionRead, false},
+		{[]string{"admin"}, "projects/secret/plan.txt", PermissionWrite, true},
+		{[]string{"guest", "admin"}, "projects/secret/plan.txt", PermissionRead, true},
+
+		{[]string{"guest"}, "public/a.txt", PermissionRead, true},
+		{[]string{"guest"}, "public", PermissionSearch, true},
+		{[]string{"guest"}, "public/a.txt", PermissionWrite, false},
+		{[]string{"staff"}, "public/a.txt", PermissionShare, false},
+		{[]string{"staff"}, "projects/a.txt", PermissionShare, true},
+
+		// paths without rules are open to the roles of the volume
+		{[]string{"guest"}, "other.txt", PermissionWrite, true},
+		{[]string{"admin"}, "other.txt", PermissionRead, false},
+		{nil, "other.txt", PermissionRead, false},
+		{[]string{"staff"}, "projects-old/a.txt", PermissionWrite, true},
+		{[]string{"guest"}, "publicity.txt", PermissionWrite, true},
+	}
+
+	for _, c := range cases {
+		if got := volume.RolesAllow(c.roles, c.path, c.permission); got != c.allow {
+			t.Errorf("%v can %s %q = %v, want %v", c.roles, c.permission, c.path, got, c.allow)
+		}
+	}
+}
+
+func TestVolumeAllowsPublic(t *testing.T) {
+	volume := newTestACLVolume(t)
+	volume.Privacy = "public"
+
+	cases := []struct {
+		path       string
+		permission Permission
+		allow      bool
+	}{
+		{"other.txt", PermissionRead, true},
+		{"docs", PermissionList, true},
+		{"other.txt", PermissionWrite, false},
+		{"other.txt", PermissionShare, false},
+		// acl rules take paths out of the public part of the volume
+		{"public/a.txt", PermissionRead, false},
+		{"projects/a.txt", PermissionRead, false},
+	}
+
+	for _, c := range cases {
+		if got := volume.Allows(nil, c.path, c.permission); got != c.allow {
+			t.Errorf("anyone can %s %q = %v, want %v", c.permission, c.path, got, c.allow)
+		}
+	}
+}
+
+func TestVolumeFilterVisible(t *testing.T) {
+	entries := []*VolumeEntry{
+		{Path: "other.txt"},
+		{Path: "public", IsDir: true},
+		{Path: "public/a.txt"},
+		{Path: "projects", IsDir: true},
+		{Path: "projects/a.txt"},
+		{Path: "projects/secret", IsDir: true},
+		{Path: "projects/secret/plan.txt"},
+	}
+	paths := func(entries []*VolumeEntry) []string {
+		result := []string{}
+		for _, entry := range entries {
+			result = append(result, entry.Path)
+		}
+		return result
+	}
+
+	volume := newTestACLVolume(t)
+	cases := []struct {
+		name string
+		auth Authorization
+		want []string
+	}{
+		{"staff", NewUserAuthorization("discord:2", []string{"staff"}, false), []string{"other.txt", "public", "public/a.txt", "projects", "projects/a.txt", "projects/secret"}},
+		{"guest", NewUserAuthorization("discord:3", []string{"guest"}, false), []string{"other.txt", "public", "public/a.txt", "projects/a.txt"}},
+		{"admin", NewUserAuthorization("discord:1", nil, true), paths(entries)},
+		{"nobody", nil, []string{}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := paths(volume.FilterVisible(c.auth, entries)); !slices.Equal(got, c.want) {
+				t.Errorf("visible = %v, want %v", got, c.want)
+			}
+		})
+	}
+
+	// without acl rules nothing is hidden, whoever asks
+	open := &Volume{Name: "open"}
+	if got := paths(open.FilterVisible(nil, entries)); !slices.Equal(got, paths(entries)) {
+		t.Errorf("visible without acl = %v, want everything", got)
+	}
+}
+
+func TestVolumeAllowsTree(t *testing.T) {
+	root := t.TempDir()
+	for _, p := range []string{"projects/a.txt", "projects/secret/plan.txt", "projects/docs/b.txt", "public/c.txt"} {
+		err := os.MkdirAll(filepath.Join(root, filepath.Dir(p)), 0755)
+		if err == nil {
+			err = os.WriteFile(filepath.Join(root, p), nil, 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	volume := newTestACLVolume(t)
+	volume.Backend = NewLocalBackend(root)
+	staff := NewUserAuthorization("discord:2", []string{"staff"}, false)
+	admin := NewUserAuthorization("discord:1", nil, true)
+
+	cases := []struct {
+		name       string
+		auth       Authorization
+		path       string
+		permission Permission
+		allow      bool
+	}{
+		{"staff writes below projects", staff, "projects/docs", PermissionWrite, true},
+		{"staff writes projects with a secret inside", staff, "projects", PermissionWrite, false},
+		{"staff reads projects with a secret inside", staff, "projects", PermissionRead, false},
+		{"staff lists projects with a secret inside", staff, "projects", PermissionList, true},
+		{"admin writes projects", admin, "projects", PermissionWrite, true},
+		{"staff writes the root", staff, "", PermissionWrite, false},
+		{"staff reads public", staff, "public", PermissionRead, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := volume.AllowsTree(c.auth, c.path, c.permission)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.allow {
+				t.Errorf("AllowsTree(%q, %s) = %v, want %v", c.path, c.permission, got, c.allow)
+			}
+		})
+	}
+}
@@ -0,0 +1,424 @@
+package files
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/alioygur/gores"
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+// The API mirrors the pages under /api/v1, answering in JSON only. It is
+// authenticated the same way, through the Authorization header.
+
+// apiErrorResponse writes err as a JSON error body.
+func apiErrorResponse(w http.ResponseWriter, err error) {
+	statusErr := NewStatusError(http.StatusInternalServerError, "something went wrong")
+
+	var it *StatusError
+	if errors.As(err, &it) {
+		statusErr = it
+	} else if errors.Is(err, gorm.ErrRecordNotFound) || errors.Is(err, fs.ErrNotExist) || errors.Is(err, ErrNoAccess) {
+		statusErr = NewStatusError(http.StatusNotFound, "not found")
+	} else if errors.Is(err, ErrUnauthorized) {
+		statusErr = NewStatusError(http.StatusUnauthorized, "unauthorized")
+	} else if errors.Is(err, ErrShareCodeExpired) || errors.Is(err, ErrShareCodeExhausted) {
+		statusErr = NewStatusError(http.StatusGone, err.Error())
+	} else if errors.Is(err, ErrShareCodeLocked) {
+		statusErr = NewStatusError(http.StatusUnauthorized, err.Error())
+	} else if errors.Is(err, ErrFileExists) {
+		statusErr = NewStatusError(http.StatusConflict, err.Error())
+	} else if errors.Is(err, fs.ErrInvalid) {
+		statusErr = NewStatusError(http.StatusBadRequest, "invalid path")
+	}
+
+	gores.JSON(w, statusErr.Status, map[string]interface{}{
+		"error": statusErr,
+	})
+}
+
+func (h *HTTPService) apiRouter() http.Handler {
+	rtr := chi.NewRouter()
+	rtr.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		apiErrorResponse(w, NewStatusError(http.StatusNotFound, "not found"))
+	})
+	rtr.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		apiErrorResponse(w, NewStatusError(http.StatusMethodNotAllowed, "method not allowed"))
+	})
+
+	rtr.Get("/openapi.json", h.routeGetAPIOpenAPI)
+
+	rtr.Get("/volumes", h.routeGetAPIVolumes)
+	rtr.Get("/volumes/{volumeName}/entries/*", h.routeGetAPIEntries)
+	rtr.Get("/volumes/{volumeName}/stat/*", h.routeGetAPIStat)
+	rtr.Get("/volumes/{volumeName}/hash/*", h.routeGetAPIHash)
+	rtr.Get("/volumes/{volumeName}/search/*", h.routeGetAPISearch)
+	rtr.Post("/volumes/{volumeName}/upload/*", h.routePostAPIUpload)
+	rtr.Post("/volumes/{volumeName}/shares/*", h.routePostAPIShare)
+
+	rtr.Get("/shares", h.routeGetAPIShares)
+	rtr.Delete("/shares/{shareId}", h.routeDeleteAPIShare)
+
+	return rtr
+}
+
+// apiVolume resolves the volume and path of an API request, writing an error
+// and returning nil when the request can't continue.
+func (h *HTTPService) apiVolume(w http.ResponseWriter, r *http.Request, permission Permission) (*Volume, Authorization, string) {
+	path, err := url.PathUnescape(chi.URLParam(r, "*"))
+	if err != nil {
+		apiErrorResponse(w, NewStatusError(http.StatusBadRequest, "invalid path"))
+		return nil, nil, ""
+	}
+
+	if isInternalPath(path) {
+		apiErrorResponse(w, ErrNoAccess)
+		return nil, nil, ""
+	}
+
+	volume, auth, err := h.authStore.ResolveVolume(r, chi.URLParam(r, "volumeName"), path, permission)
+	if err != nil {
+		apiErrorResponse(w, err)
+		return nil, nil, ""
+	}
+
+	// share codes count views through the API just like pages
+	if it, ok := auth.(*ShareCodeAuthorization); ok {
+		err = RecordShareCodeAccess(it.shareCode, r, path, false)
+		if err != nil {
+			apiErrorResponse(w, err)
+			return nil, nil, ""
+		}
+	}
+
+	return volume, auth, path
+}
+
+func (h *HTTPService) routeGetAPIOpenAPI(w http.ResponseWriter, r *http.Request) {
+	data, err := templates.ReadFile("static/openapi.json")
+	if err != nil {
+		apiErrorResponse(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+type apiVolume struct {
+	Name     string   `json:"name"`
+	Privacy  string   `json:"privacy"`
+	Features []string `json:"features"`
+}
+
+func (h *HTTPService) routeGetAPIVolumes(w http.ResponseWriter, r *http.Request) {
+	auth := h.authStore.Check(r)
+
+	volumes := []apiVolume{}
+	for _, volume := range h.fileStore.Volumes {
+		if volume.Privacy != "public" && (auth == nil || !auth.CanAccess(volume, "", PermissionRead)) {
+			continue
+		}
+
+		features := []string{}
+		for feature := range volume.Features {
+			features = append(features, feature)
+		}
+		sort.Strings(features)
+
+		volumes = append(volumes, apiVolume{
+			Name:     volume.Name,
+			Privacy:  volume.Privacy,
+			Features: features,
+		})
+	}
+
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].Name < volumes[j].Name
+	})
+
+	gores.JSON(w, http.StatusOK, map[string]interface{}{
+		"volumes": volumes,
+	})
+}
+
+func (h *HTTPService) routeGetAPIEntries(w http.ResponseWriter, r *http.Request) {
+	volume, auth, path := h.apiVolume(w, r, PermissionList)
+	if volume == nil {
+		return
+	}
+
+	// unlisted volumes can only be listed by someone with access, like pages
+	if volume.Privacy == "unlisted" && (auth == nil || !auth.CanAccess(volume, path, PermissionList)) {
+		apiErrorResponse(w, ErrNoAccess)
+		return
+	}
+
+	entries, err := volume.Entries(path)
+	if err != nil {
+		apiErrorResponse(w, err)
+		return
+	}
+	entries = volume.FilterVisible(auth, entries)
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].IsDir != entries[j].IsDir {
+			return entries[i].IsDir
+		}
+		return entries[i].Name < entries[j].Name
+	})
+
+	gores.JSON(w, http.StatusOK, map[string]interface{}{
+		"entries": entries,
+	})
+}
+
+func (h *HTTPService) routeGetAPIStat(w http.ResponseWriter, r *http.Request) {
+	volume, _, path := h.apiVolume(w, r, PermissionRead)
+	if volume == nil {
+		return
+	}
+
+	entry, err := volume.Entry(path)
+	if err != nil {
+		apiErrorResponse(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, entry)
+}
+
+func (h *HTTPService) routeGetAPIHash(w http.ResponseWriter, r *http.Request) {
+	volume, auth, path := h.apiVolume(w, r, PermissionRead)
+	if volume == nil {
+		return
+	}
+
+	// hashing reads the whole file without it counting as a download
+	if it, ok := auth.(*ShareCodeAuthorization); ok && it.shareCode.LimitsDownloads() {
+		apiErrorResponse(w, NewStatusError(http.StatusForbidden, "hashes aren't available for shares with a download limit"))
+		return
+	}
+
+	algorithm := r.URL.Query().Get("algorithm")
+	if algorithm == "" {
+		algorithm = "sha256"
+	} else if algorithm != "sha256" {
+		apiErrorResponse(w, NewStatusError(http.StatusBadRequest, "unknown hash algorithm"))
+		return
+	}
+
+	info, err := volume.Stat(path)
+	if err != nil {
+		apiErrorResponse(w, err)
+		return
+	} else if info.IsDir() {
+		apiErrorResponse(w, NewStatusError(http.StatusBadRequest, "cannot hash directory"))
+		return
+	}
+
+	hash, err := generateHash(volume, path)
+	if err != nil {
+		apiErrorResponse(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, map[string]string{
+		"algorithm": algorithm,
+		"hash":      hash,
+	})
+}
+
+func (h *HTTPService) routeGetAPISearch(w http.ResponseWriter, r *http.Request) {
+	volume, auth, path := h.apiVolume(w, r, PermissionSearch)
+	if volume == nil {
+		return
+	}
+
+	if !volume.HasFeature("search") {
+		apiErrorResponse(w, NewStatusError(http.StatusNotFound, "search is not available for this volume"))
+		return
+	}
+
+	query := strings.ToLower(r.URL.Query().Get("q"))
+	if query == "" {
+		apiErrorResponse(w, NewStatusError(http.StatusBadRequest, "missing query"))
+		return
+	}
+
+	results, err := volume.Search(path, query, r.URL.Query().Has("fuzzy"), 100, auth)
+	if err != nil {
+		RecordAudit(r, auth, AuditEvent{Action: "search", Volume: volume.Name, Path: path, Result: AuditFailure, Detail: query})
+		apiErrorResponse(w, err)
+		return
+	}
+
+	RecordAudit(r, auth, AuditEvent{Action: "search", Volume: volume.Name, Path: path, Detail: query})
+
+	gores.JSON(w, http.StatusOK, map[string]interface{}{
+		"results": results,
+	})
+}
+
+// routePostAPIUpload uploads the "file" of a multipart body into the
+// directory at the path of the request.
+func (h *HTTPService) routePostAPIUpload(w http.ResponseWriter, r *http.Request) {
+	volume, auth, path := h.apiVolume(w, r, PermissionWrite)
+	if volume == nil {
+		return
+	}
+
+	if !volume.HasFeature("upload") {
+		apiErrorResponse(w, NewStatusError(http.StatusNotFound, "upload is not available for this volume"))
+		return
+	}
+
+	err := r.ParseMultipartForm(256 << 20)
+	if err != nil {
+		apiErrorResponse(w, NewStatusError(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	file, handler, err := r.FormFile("file")
+	if err != nil {
+		apiErrorResponse(w, NewStatusError(http.StatusBadRequest, err.Error()))
+		return
+	}
+	defer file.Close()
+
+	info, err := volume.Stat(path)
+	if err != nil && !os.IsNotExist(err) {
+		apiErrorResponse(w, err)
+		return
+	} else if err != nil || !info.IsDir() {
+		apiErrorResponse(w, NewStatusError(http.StatusBadRequest, "path is not a directory"))
+		return
+	}
+
+	target, size, err := volume.WriteFile(filepath.Join(path, handler.Filename), file, volume.ConflictPolicy)
+	if err != nil {
+		RecordAudit(r, auth, AuditEvent{
+			Action: "upload",
+			Volume: volume.Name,
+			Path:   filepath.Join(path, handler.Filename),
+			Result: AuditFailure,
+			Detail: err.Error(),
+		})
+		apiErrorResponse(w, err)
+		return
+	}
+	RecordAudit(r, auth, AuditEvent{Action: "upload", Volume: volume.Name, Path: target})
+
+	entry, err := volume.Entry(target)
+	if err != nil {
+		apiErrorResponse(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusCreated, map[string]interface{}{
+		"entry": entry,
+		"size":  size,
+		"url":   fmt.Sprintf("%s/volume/%s/browse/%s", h.config.HTTP.BaseURL(), volume.Name, target),
+	})
+}
+
+func (h *HTTPService) routePostAPIShare(w http.ResponseWriter, r *http.Request) {
+	volume, auth, path := h.apiVolume(w, r, PermissionShare)
+	if volume == nil {
+		return
+	}
+
+	req, err := parseShareCodeRequest(r)
+	if err != nil {
+		apiErrorResponse(w, NewStatusError(http.StatusBadRequest, "invalid request body"))
+		return
+	}
+
+	shareCode, err := h.createShareCode(volume, auth, path, req)
+	if err != nil {
+		RecordAudit(r, auth, AuditEvent{Action: "share", Volume: volume.Name, Path: path, Result: AuditFailure, Detail: err.Error()})
+		apiErrorResponse(w, err)
+		return
+	}
+	RecordAudit(r, auth, AuditEvent{Action: "share", Volume: volume.Name, Path: path, Detail: shareCode.Code})
+
+	view, err := h.newShareCodeView(shareCode)
+	if err != nil {
+		apiErrorResponse(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusCreated, view)
+}
+
+// apiIdentity authenticates a request for something that belongs to whoever
+// makes it, like share codes.
+func (h *HTTPService) apiIdentity(w http.ResponseWriter, r *http.Request) Authorization {
+	auth := h.authStore.Check(r)
+	if auth == nil || auth.Identity() == "" {
+		apiErrorResponse(w, ErrUnauthorized)
+		return nil
+	}
+	return auth
+}
+
+func (h *HTTPService) routeGetAPIShares(w http.ResponseWriter, r *http.Request) {
+	auth := h.apiIdentity(w, r)
+	if auth == nil {
+		return
+	}
+
+	owner := auth.Identity()
+	if auth.IsAdmin() && !r.URL.Query().Has("mine") {
+		owner = ""
+	}
+
+	shareCodes, err := ListShareCodes(owner, r.URL.Query().Get("volume"))
+	if err != nil {
+		apiErrorResponse(w, err)
+		return
+	}
+
+	views := []*shareCodeView{}
+	for i := range shareCodes {
+		view, err := h.newShareCodeView(&shareCodes[i])
+		if err != nil {
+			apiErrorResponse(w, err)
+			return
+		}
+		views = append(views, view)
+	}
+
+	gores.JSON(w, http.StatusOK, map[string]interface{}{
+		"share_codes": views,
+	})
+}
+
+func (h *HTTPService) routeDeleteAPIShare(w http.ResponseWriter, r *http.Request) {
+	auth := h.apiIdentity(w, r)
+	if auth == nil {
+		return
+	}
+
+	shareCode, err := GetManagedShareCode(auth, chi.URLParam(r, "shareId"))
+	if err != nil {
+		apiErrorResponse(w, err)
+		return
+	}
+
+	err = RevokeShareCode(shareCode)
+	if err != nil {
+		apiErrorResponse(w, err)
+		return
+	}
+
+	gores.NoContent(w)
+}
@@ -0,0 +1,600 @@
+package files
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alioygur/gores"
+	"github.com/go-chi/chi/v5"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// apiKeyPrefix starts every key, it makes keys easy to spot when they end up
+// somewhere they shouldn't.
+const apiKeyPrefix = "fk_"
+
+// apiKeyVisibleLength is how much of a key is kept as is, enough to tell keys
+// apart without being able to use them.
+const apiKeyVisibleLength = len(apiKeyPrefix) + 8
+
+// lastUsedInterval limits how often the last use of a key or token is
+// written, so busy clients don't write on every request.
+const lastUsedInterval = time.Minute
+
+var (
+	ErrAPIKeyExpired  = errors.New("api key has expired")
+	ErrAPIKeyUnscoped = errors.New("an api key needs at least one volume or lease")
+)
+
+// APIKeyAllVolumes in the volumes of a key lets it use every volume.
+const APIKeyAllVolumes = "*"
+
+// APIKeyConfig decides what a key can access. Volumes listed in Volumes can
+// be used without limits, Leases grant narrower permissions. A key with
+// neither can't access anything.
+type APIKeyConfig struct {
+	Volumes []string      `json:"volumes"`
+	Leases  []APIKeyLease `json:"leases"`
+}
+
+func (c *APIKeyConfig) Empty() bool {
+	return len(c.Volumes) == 0 && len(c.Leases) == 0
+}
+
+// APIKeyLease grants a key permissions on one volume. Permissions holds any of
+// "read", "write", "search" and "list", Paths limits the lease to those paths
+// and everything below them.
+type APIKeyLease struct {
+	VolumeName  string   `json:"volume"`
+	Permissions []string `json:"permissions"`
+	Paths       []string `json:"paths,omitempty"`
+}
+
+// ParseAPIKeyLease parses a lease written as volume:permissions[:paths], with
+// permissions and paths separated by commas, like "media:read,list:movies".
+func ParseAPIKeyLease(s string) (APIKeyLease, error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return APIKeyLease{}, fmt.Errorf("invalid lease '%s', expected volume:permissions[:paths]", s)
+	}
+
+	lease := APIKeyLease{VolumeName: parts[0]}
+	for _, it := range strings.Split(parts[1], ",") {
+		switch Permission(it) {
+		case PermissionRead, PermissionWrite, PermissionSearch, PermissionList:
+			lease.Permissions = append(lease.Permissions, it)
+		default:
+			return APIKeyLease{}, fmt.Errorf("unknown permission '%s'", it)
+		}
+	}
+
+	if len(parts) == 3 && parts[2] != "" {
+		lease.Paths = strings.Split(parts[2], ",")
+	}
+	return lease, nil
+}
+
+func (l *APIKeyLease) String() string {
+	s := fmt.Sprintf("%s:%s", l.VolumeName, strings.Join(l.Permissions, ","))
+	if len(l.Paths) > 0 {
+		s += ":" + strings.Join(l.Paths, ",")
+	}
+	return s
+}
+
+func (l *APIKeyLease) has(permission Permission) bool {
+	for _, it := range l.Permissions {
+		if Permission(it) == permission {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *APIKeyLease) Volume() string { return l.VolumeName }
+func (l *APIKeyLease) Read() bool     { return l.has(PermissionRead) }
+func (l *APIKeyLease) Write() bool    { return l.has(PermissionWrite) }
+func (l *APIKeyLease) Search() bool   { return l.has(PermissionSearch) }
+func (l *APIKeyLease) List() bool     { return l.has(PermissionList) }
+
+func (l *APIKeyLease) Covers(path string) bool {
+	if len(l.Paths) == 0 {
+		return true
+	}
+
+	for _, it := range l.Paths {
+		if isWithin(path, it) {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKey is a key for scripts and other clients that can't log in. Only a
+// hash of the key is stored, it is shown once when it is created or rotated.
+type APIKey struct {
+	Id      uint                             `json:"id" gorm:"primaryKey"`
+	Hash    string                           `json:"-" gorm:"uniqueIndex"`
+	Prefix  string                           `json:"prefix"`
+	Label   string                           `json:"label"`
+	Creator string                           `json:"creator"`
+	Config  datatypes.JSONType[APIKeyConfig] `json:"config"`
+
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+}
+
+func (k *APIKey) Expired() bool {
+	return k.ExpiresAt != nil && time.Now().After(*k.ExpiresAt)
+}
+
+// Leases describes what the key can access, one entry per volume or lease.
+func (k *APIKey) Leases() []string {
+	config := k.Config.Data()
+	if config.Empty() {
+		return []string{"no access"}
+	}
+
+	result := []string{}
+	for _, volume := range config.Volumes {
+		if volume == APIKeyAllVolumes {
+			volume = "all volumes"
+		}
+		result = append(result, volume)
+	}
+	for i := range config.Leases {
+		result = append(result, config.Leases[i].String())
+	}
+	return result
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateAPIKey() (string, error) {
+	data := make([]byte, 24)
+	_, err := rand.Read(data)
+	if err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// setKey replaces the secret of k with a new one, which is returned.
+func (k *APIKey) setKey() (string, error) {
+	key, err := generateAPIKey()
+	if err != nil {
+		return "", err
+	}
+
+	k.Hash = hashAPIKey(key)
+	k.Prefix = key[:apiKeyVisibleLength]
+	return key, nil
+}
+
+// migrateLegacyAPIKeys moves keys from when they were stored as they are into
+// the hashed table that replaces them. Things owned by those keys are handed
+// over to the identity they have now.
+func migrateLegacyAPIKeys() error {
+	if !db.Migrator().HasTable("api_keys") || db.Migrator().HasColumn("api_keys", "hash") {
+		return nil
+	}
+
+	var legacy []struct {
+		Key    string
+		Config string
+	}
+	err := db.Table("api_keys").Select("key", "config").Scan(&legacy).Error
+	if err != nil {
+		return err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Migrator().DropTable("api_keys")
+		if err != nil {
+			return err
+		}
+
+		err = tx.AutoMigrate(&APIKey{})
+		if err != nil {
+			return err
+		}
+
+		for _, it := range legacy {
+			var config APIKeyConfig
+			if it.Config != "" {
+				err = json.Unmarshal([]byte(it.Config), &config)
+				if err != nil {
+					return err
+				}
+			}
+
+			key := &APIKey{
+				Hash:   hashAPIKey(it.Key),
+				Prefix: it.Key[:min(len(it.Key), 4)],
+				Label:  "migrated",
+				Config: datatypes.NewJSONType(config),
+			}
+			err = tx.Create(key).Error
+			if err != nil {
+				return err
+			}
+
+			oldIdentity := "apikey:" + key.Hash[:16]
+			newIdentity := (&APIKeyAuthorization{key: key}).Identity()
+			for _, column := range []struct{ table, name string }{
+				{"share_codes", "owner"},
+				{"tus_uploads", "owner"},
+				{"trash_items", "deleted_by"},
+			} {
+				if !tx.Migrator().HasTable(column.table) {
+					continue
+				}
+				err = tx.Table(column.table).Where(column.name+" = ?", oldIdentity).Update(column.name, newIdentity).Error
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("migrated %d legacy api keys", len(legacy))
+	return nil
+}
+
+// migrateUnscopedAPIKeys gives keys from when a key without volumes or leases
+// could use every volume the explicit grant that now means the same.
+func migrateUnscopedAPIKeys() error {
+	var keys []APIKey
+	err := db.Find(&keys).Error
+	if err != nil {
+		return err
+	}
+
+	migrated := 0
+	for i := range keys {
+		config := keys[i].Config.Data()
+		if !config.Empty() {
+			continue
+		}
+
+		config.Volumes = []string{APIKeyAllVolumes}
+		err = db.Model(&keys[i]).Update("config", datatypes.NewJSONType(config)).Error
+		if err != nil {
+			return err
+		}
+		migrated++
+	}
+
+	if migrated > 0 {
+		log.Printf("gave %d unscoped api keys access to all volumes", migrated)
+	}
+	return nil
+}
+
+// GetAPIKey looks up the key a client presented, recording that it was used.
+func GetAPIKey(key string) (*APIKey, error) {
+	var apikey APIKey
+	if err := db.Take(&apikey, "hash = ?", hashAPIKey(key)).Error; err != nil {
+		return nil, err
+	}
+
+	if apikey.Expired() {
+		return nil, ErrAPIKeyExpired
+	}
+
+	now := time.Now().UTC()
+	if apikey.LastUsedAt == nil || now.Sub(*apikey.LastUsedAt) > lastUsedInterval {
+		apikey.LastUsedAt = &now
+		err := db.Model(&apikey).UpdateColumn("last_used_at", now).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &apikey, nil
+}
+
+type APIKeyOptions struct {
+	Label   string
+	Creator string
+	Config  APIKeyConfig
+	// TTL is how long the key works for, zero keeps it working until it is
+	// revoked.
+	TTL time.Duration
+}
+
+// CreateAPIKey makes a new key, returning it along with the only copy of the
+// key itself.
+func CreateAPIKey(opts APIKeyOptions) (*APIKey, string, error) {
+	if opts.Config.Empty() {
+		return nil, "", ErrAPIKeyUnscoped
+	}
+
+	apikey := &APIKey{
+		Label:   opts.Label,
+		Creator: opts.Creator,
+		Config:  datatypes.NewJSONType(opts.Config),
+	}
+	if opts.TTL > 0 {
+		expiresAt := time.Now().UTC().Add(opts.TTL)
+		apikey.ExpiresAt = &expiresAt
+	}
+
+	key, err := apikey.setKey()
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = db.Create(apikey).Error
+	if err != nil {
+		return nil, "", err
+	}
+	return apikey, key, nil
+}
+
+func ListAPIKeys() ([]APIKey, error) {
+	var keys []APIKey
+	err := db.Order("id DESC").Find(&keys).Error
+	return keys, err
+}
+
+func GetAPIKeyById(id string) (*APIKey, error) {
+	var apikey APIKey
+	if err := db.Take(&apikey, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &apikey, nil
+}
+
+// RotateAPIKey gives a key a new secret, the old one stops working straight
+// away. Everything else about the key stays the same.
+func RotateAPIKey(apikey *APIKey) (string, error) {
+	key, err := apikey.setKey()
+	if err != nil {
+		return "", err
+	}
+
+	err = db.Model(apikey).Select("hash", "prefix").Updates(apikey).Error
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+func RevokeAPIKey(apikey *APIKey) error {
+	return db.Delete(apikey).Error
+}
+
+// adminAuth checks a request comes from an admin, writing an error and
+// returning nil when it doesn't.
+func (h *HTTPService) adminAuth(w http.ResponseWriter, r *http.Request) Authorization {
+	auth := h.authStore.Check(r)
+	if auth == nil {
+		gores.Error(w, http.StatusUnauthorized, "unauthorized")
+		return nil
+	}
+
+	if !auth.IsAdmin() {
+		gores.Error(w, http.StatusForbidden, "forbidden")
+		return nil
+	}
+	return auth
+}
+
+// apiKeysPage renders the list of keys, along with a key that was just made
+// since it can't be looked up again.
+func (h *HTTPService) apiKeysPage(w http.ResponseWriter, r *http.Request, newKey string) {
+	keys, err := ListAPIKeys()
+	if err != nil {
+		ErrorResponse(w, err)
+		return
+	}
+
+	volumes := []string{}
+	for name := range h.fileStore.Volumes {
+		volumes = append(volumes, name)
+	}
+	sort.Strings(volumes)
+
+	h.template(w, r, "static/apikeys.html", map[string]interface{}{
+		"Keys":    keys,
+		"NewKey":  newKey,
+		"Volumes": volumes,
+	})
+}
+
+func (h *HTTPService) routeGetAPIKeys(w http.ResponseWriter, r *http.Request) {
+	if h.adminAuth(w, r) == nil {
+		return
+	}
+
+	if wantsJSON(r) {
+		keys, err := ListAPIKeys()
+		if err != nil {
+			ErrorResponse(w, err)
+			return
+		}
+
+		gores.JSON(w, http.StatusOK, map[string]interface{}{
+			"api_keys": keys,
+		})
+		return
+	}
+
+	h.apiKeysPage(w, r, "")
+}
+
+// apiKeyRequest is the body accepted when creating a key. JSON requests give
+// the whole config, forms grant a single lease.
+type apiKeyRequest struct {
+	Label  string       `json:"label"`
+	TTL    string       `json:"ttl"`
+	Config APIKeyConfig `json:"config"`
+}
+
+func parseAPIKeyRequest(r *http.Request) (*apiKeyRequest, error) {
+	var req apiKeyRequest
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			return nil, err
+		}
+		return &req, nil
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		return nil, err
+	}
+
+	req.Label = r.Form.Get("label")
+	req.TTL = r.Form.Get("ttl")
+
+	// without a volume there is no lease, which gets the key turned down
+	if volume := r.Form.Get("volume"); volume != "" {
+		lease := APIKeyLease{VolumeName: volume, Permissions: r.Form["permission"]}
+		for _, it := range strings.Split(r.Form.Get("paths"), ",") {
+			if it = strings.TrimSpace(it); it != "" {
+				lease.Paths = append(lease.Paths, it)
+			}
+		}
+		req.Config.Leases = []APIKeyLease{lease}
+	}
+	return &req, nil
+}
+
+func (h *HTTPService) routePostAPIKeys(w http.ResponseWriter, r *http.Request) {
+	auth := h.adminAuth(w, r)
+	if auth == nil {
+		return
+	}
+
+	req, err := parseAPIKeyRequest(r)
+	if err != nil {
+		gores.Error(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	var ttl time.Duration
+	if req.TTL != "" && req.TTL != "never" {
+		ttl, err = ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			gores.Error(w, http.StatusBadRequest, fmt.Sprintf("invalid lifetime '%s'", req.TTL))
+			return
+		}
+	}
+
+	if req.Config.Empty() {
+		gores.Error(w, http.StatusBadRequest, ErrAPIKeyUnscoped.Error())
+		return
+	}
+
+	for _, volume := range req.Config.Volumes {
+		if volume != APIKeyAllVolumes && h.fileStore.GetVolume(volume) == nil {
+			gores.Error(w, http.StatusBadRequest, fmt.Sprintf("unknown volume '%s'", volume))
+			return
+		}
+	}
+	for _, lease := range req.Config.Leases {
+		if h.fileStore.GetVolume(lease.VolumeName) == nil {
+			gores.Error(w, http.StatusBadRequest, fmt.Sprintf("unknown volume '%s'", lease.VolumeName))
+			return
+		} else if len(lease.Permissions) == 0 {
+			gores.Error(w, http.StatusBadRequest, "a lease needs at least one permission")
+			return
+		}
+	}
+
+	apikey, key, err := CreateAPIKey(APIKeyOptions{
+		Label:   req.Label,
+		Creator: auth.Identity(),
+		Config:  req.Config,
+		TTL:     ttl,
+	})
+	if err != nil {
+		gores.Error(w, http.StatusInternalServerError, "failed to create api key")
+		return
+	}
+
+	if wantsJSON(r) {
+		gores.JSON(w, http.StatusCreated, map[string]interface{}{
+			"key":     key,
+			"api_key": apikey,
+		})
+		return
+	}
+
+	h.apiKeysPage(w, r, key)
+}
+
+func (h *HTTPService) routePostAPIKeyRotate(w http.ResponseWriter, r *http.Request) {
+	if h.adminAuth(w, r) == nil {
+		return
+	}
+
+	apikey, err := GetAPIKeyById(chi.URLParam(r, "keyId"))
+	if err != nil {
+		ErrorResponse(w, err)
+		return
+	}
+
+	key, err := RotateAPIKey(apikey)
+	if err != nil {
+		gores.Error(w, http.StatusInternalServerError, "failed to rotate api key")
+		return
+	}
+
+	if wantsJSON(r) {
+		gores.JSON(w, http.StatusOK, map[string]interface{}{
+			"key":     key,
+			"api_key": apikey,
+		})
+		return
+	}
+
+	h.apiKeysPage(w, r, key)
+}
+
+func (h *HTTPService) routeDeleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	if h.adminAuth(w, r) == nil {
+		return
+	}
+
+	apikey, err := GetAPIKeyById(chi.URLParam(r, "keyId"))
+	if err != nil {
+		ErrorResponse(w, err)
+		return
+	}
+
+	err = RevokeAPIKey(apikey)
+	if err != nil {
+		ErrorResponse(w, err)
+		return
+	}
+
+	if wantsJSON(r) {
+		gores.NoContent(w)
+		return
+	}
+
+	// htmx swaps the row out for this empty response
+	gores.HTML(w, http.StatusOK, "")
+}
@@ -0,0 +1,274 @@
+package files
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/alioygur/gores"
+	"gorm.io/gorm"
+)
+
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+	AuditDenied  = "denied"
+)
+
+const auditPageSize = 100
+
+// AuditEvent records something done to a volume, or an attempt to log in, by
+// whoever did it.
+type AuditEvent struct {
+	Id        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+	Actor     string    `gorm:"index" json:"actor"`
+	Action    string    `gorm:"index" json:"action"`
+	Volume    string    `json:"volume,omitempty"`
+	Path      string    `json:"path,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	IP        string    `json:"ip"`
+	Result    string    `json:"result"`
+}
+
+// auditActor names whoever a request is authorized as, share codes by their
+// code since they don't belong to an identity.
+func auditActor(auth Authorization) string {
+	if auth == nil {
+		return "anonymous"
+	}
+	if it, ok := auth.(*ShareCodeAuthorization); ok {
+		return "share:" + it.shareCode.Code
+	}
+	if identity := auth.Identity(); identity != "" {
+		return identity
+	}
+	return "anonymous"
+}
+
+// RecordAudit writes event for a request made with auth. Events that already
+// name their actor keep it, like logins that haven't authorized anyone yet.
+// Failing to record is logged rather than failing the request.
+func RecordAudit(r *http.Request, auth Authorization, event AuditEvent) {
+	if event.Actor == "" {
+		event.Actor = auditActor(auth)
+	}
+	if event.Result == "" {
+		event.Result = AuditSuccess
+	}
+	if event.Volume != "" {
+		event.Path = cleanSharePath(event.Path)
+	}
+	event.IP = requestIP(r)
+
+	err := db.Create(&event).Error
+	if err != nil {
+		log.Printf("failed to record audit event %v by %v: %v", event.Action, event.Actor, err)
+	}
+}
+
+// AuditFilter narrows down audit events, empty fields match everything. Path
+// matches the path and everything below it.
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Volume string
+	Path   string
+	Result string
+	Since  time.Time
+	Until  time.Time
+}
+
+func parseAuditFilter(r *http.Request) (AuditFilter, error) {
+	query := r.URL.Query()
+	filter := AuditFilter{
+		Actor:  query.Get("actor"),
+		Action: query.Get("action"),
+		Volume: query.Get("volume"),
+		Path:   cleanSharePath(query.Get("path")),
+		Result: query.Get("result"),
+	}
+
+	for name, target := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		raw := query.Get(name)
+		if raw == "" {
+			continue
+		}
+
+		var err error
+		*target, err = time.Parse("2006-01-02", raw)
+		if err != nil {
+			return filter, NewStatusError(http.StatusBadRequest, "invalid "+name+" date")
+		}
+	}
+	if !filter.Until.IsZero() {
+		// until includes the whole day
+		filter.Until = filter.Until.Add(24 * time.Hour)
+	}
+	return filter, nil
+}
+
+func (f AuditFilter) query() *gorm.DB {
+	query := db.Model(&AuditEvent{})
+	if f.Actor != "" {
+		query = query.Where("actor = ?", f.Actor)
+	}
+	if f.Action != "" {
+		query = query.Where("action = ?", f.Action)
+	}
+	if f.Volume != "" {
+		query = query.Where("volume = ?", f.Volume)
+	}
+	if f.Path != "" && f.Path != "/" {
+		prefix := f.Path + "/"
+		query = query.Where("path = ? OR substr(path, 1, ?) = ?", f.Path, len(prefix), prefix)
+	}
+	if f.Result != "" {
+		query = query.Where("result = ?", f.Result)
+	}
+	if !f.Since.IsZero() {
+		query = query.Where("created_at >= ?", f.Since.UTC())
+	}
+	if !f.Until.IsZero() {
+		query = query.Where("created_at < ?", f.Until.UTC())
+	}
+	return query
+}
+
+// ListAuditEvents returns the newest events matching filter, up to limit of
+// them, older than the event with id before when it isn't zero.
+func ListAuditEvents(filter AuditFilter, before uint, limit int) ([]AuditEvent, error) {
+	query := filter.query()
+	if before != 0 {
+		query = query.Where("id < ?", before)
+	}
+
+	var events []AuditEvent
+	err := query.Order("id DESC").Limit(limit).Find(&events).Error
+	return events, err
+}
+
+// PurgeAuditEvents deletes events recorded before cutoff.
+func PurgeAuditEvents(cutoff time.Time) (int64, error) {
+	result := db.Where("created_at < ?", cutoff.UTC()).Delete(&AuditEvent{})
+	return result.RowsAffected, result.Error
+}
+
+// AuditPurger periodically deletes events older than the audit retention.
+type AuditPurger struct {
+	retention time.Duration
+	interval  time.Duration
+}
+
+func NewAuditPurger(retention, interval time.Duration) *AuditPurger {
+	return &AuditPurger{retention: retention, interval: interval}
+}
+
+func (p *AuditPurger) Serve(ctx context.Context) error {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		count, err := PurgeAuditEvents(time.Now().Add(-p.retention))
+		if err != nil {
+			log.Printf("failed to purge audit events: %v", err)
+		} else if count > 0 {
+			log.Printf("purged %d audit events", count)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *HTTPService) routeGetAudit(w http.ResponseWriter, r *http.Request) {
+	if h.adminAuth(w, r) == nil {
+		return
+	}
+
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		statusErrorResponse(w, err)
+		return
+	}
+
+	var before uint64
+	if raw := r.URL.Query().Get("before"); raw != "" {
+		before, err = strconv.ParseUint(raw, 10, 32)
+		if err != nil {
+			gores.Error(w, http.StatusBadRequest, "invalid before")
+			return
+		}
+	}
+
+	events, err := ListAuditEvents(filter, uint(before), auditPageSize)
+	if err != nil {
+		ErrorResponse(w, err)
+		return
+	}
+
+	if wantsJSON(r) {
+		gores.JSON(w, http.StatusOK, map[string]interface{}{
+			"events": events,
+		})
+		return
+	}
+
+	// the next page keeps the filters and continues after the last event
+	var next string
+	if len(events) == auditPageSize {
+		query := r.URL.Query()
+		query.Set("before", strconv.FormatUint(uint64(events[len(events)-1].Id), 10))
+		next = "/audit?" + query.Encode()
+	}
+
+	exportQuery := r.URL.Query()
+	exportQuery.Del("before")
+
+	h.template(w, r, "static/audit.html", map[string]interface{}{
+		"Events":  events,
+		"Filter":  r.URL.Query(),
+		"Results": []string{AuditSuccess, AuditFailure, AuditDenied},
+		"Next":    next,
+		"Export":  "/audit/export?" + exportQuery.Encode(),
+	})
+}
+
+// routeGetAuditExport writes every event matching the filters as JSON lines,
+// oldest first.
+func (h *HTTPService) routeGetAuditExport(w http.ResponseWriter, r *http.Request) {
+	if h.adminAuth(w, r) == nil {
+		return
+	}
+
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		statusErrorResponse(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"audit.jsonl\"")
+
+	encoder := json.NewEncoder(w)
+	var events []AuditEvent
+	err = filter.query().FindInBatches(&events, 500, func(tx *gorm.DB, batch int) error {
+		for i := range events {
+			err := encoder.Encode(&events[i])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+	if err != nil {
+		// the status is already sent, all that's left is cutting the export short
+		log.Printf("failed to export audit events: %v", err)
+	}
+}
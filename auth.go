@@ -2,53 +2,119 @@ package files
 
 import (
 	"encoding/base64"
-	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/alioygur/gores"
 	goalone "github.com/bwmarrin/go-alone"
 	"github.com/go-chi/chi/v5"
 	"github.com/gorilla/sessions"
+	"gorm.io/gorm"
 )
 
+// Permission is something a request wants to do on a volume.
+type Permission string
+
+const (
+	PermissionRead   Permission = "read"
+	PermissionList   Permission = "list"
+	PermissionSearch Permission = "search"
+	PermissionWrite  Permission = "write"
+	// PermissionShare is needed to create share codes, leases grant it along
+	// with reading since a share code hands out reading.
+	PermissionShare Permission = "share"
+)
+
+// Full reports whether p goes beyond looking at a volume, which is never
+// granted anonymously or through share codes.
+func (p Permission) Full() bool {
+	return p != PermissionRead && p != PermissionList
+}
+
+// VolumeLease is a set of permissions on a volume, optionally limited to some
+// paths within it.
 type VolumeLease interface {
-	Volume() Volume
+	Volume() string
 	Read() bool
 	Write() bool
 	Search() bool
 	List() bool
+	// Covers reports whether path falls under the lease.
+	Covers(path string) bool
+}
+
+// leaseAllows reports whether lease lets permission be used on path within
+// volume.
+func leaseAllows(lease VolumeLease, volume *Volume, path string, permission Permission) bool {
+	if lease.Volume() != volume.Name || !lease.Covers(path) {
+		return false
+	}
+
+	switch permission {
+	case PermissionRead, PermissionShare:
+		return lease.Read()
+	case PermissionList:
+		return lease.List()
+	case PermissionSearch:
+		return lease.Search()
+	case PermissionWrite:
+		return lease.Write()
+	}
+	return false
 }
 
+// Login providers, user ids are qualified by them like "discord:1234".
+const (
+	ProviderDiscord = "discord"
+	ProviderOIDC    = "oidc"
+	ProviderLocal   = "local"
+)
+
 type Authorization interface {
-	DiscordUserId() string
-	CanAccess(volume *Volume, path string, full bool) bool
+	// UserId is the provider qualified id of a logged in user, empty when
+	// the request is authorized by anything else.
+	UserId() string
+	// Identity names who is making the request, things like share codes are
+	// owned by it. Empty when the caller has no identity of its own.
+	Identity() string
+	IsAdmin() bool
+	CanAccess(volume *Volume, path string, permission Permission) bool
 }
 
 type UserAuthorization struct {
 	id      string
 	isAdmin bool
+	// roles are the names of the roles the user had when authenticated.
+	roles []string
 }
 
-func NewUserAuthorization(userId string, isAdmin bool) *UserAuthorization {
-	return &UserAuthorization{id: userId, isAdmin: isAdmin}
+func NewUserAuthorization(userId string, roles []string, isAdmin bool) *UserAuthorization {
+	return &UserAuthorization{id: userId, isAdmin: isAdmin, roles: roles}
 }
 
-func (u *UserAuthorization) DiscordUserId() string {
+func (u *UserAuthorization) UserId() string {
 	return u.id
 }
 
-func (u *UserAuthorization) CanAccess(volume *Volume, path string, full bool) bool {
-	if u.isAdmin {
-		return true
-	}
+func (u *UserAuthorization) Identity() string {
+	return u.id
+}
 
-	if volume.HasUserId(u.id) {
+func (u *UserAuthorization) IsAdmin() bool {
+	return u.isAdmin
+}
+
+func (u *UserAuthorization) CanAccess(volume *Volume, path string, permission Permission) bool {
+	if u.isAdmin {
 		return true
 	}
 
-	return false
+	return volume.RolesAllow(u.roles, path, permission)
 }
 
 type APIKeyAuthorization struct {
@@ -59,18 +125,29 @@ func NewAPIKeyAuthorization(key *APIKey) *APIKeyAuthorization {
 	return &APIKeyAuthorization{key: key}
 }
 
-func (u *APIKeyAuthorization) DiscordUserId() string {
+func (u *APIKeyAuthorization) UserId() string {
 	return ""
 }
 
-func (u *APIKeyAuthorization) CanAccess(volume *Volume, path string, full bool) bool {
+// Identity names the key by its id so it survives the key being rotated.
+func (u *APIKeyAuthorization) Identity() string {
+	return "apikey:" + strconv.FormatUint(uint64(u.key.Id), 10)
+}
+
+func (u *APIKeyAuthorization) IsAdmin() bool {
+	return false
+}
+
+func (u *APIKeyAuthorization) CanAccess(volume *Volume, path string, permission Permission) bool {
 	config := u.key.Config.Data()
-	if config.Volumes == nil || len(config.Volumes) == 0 {
-		return true
+	for _, vol := range config.Volumes {
+		if vol == volume.Name || vol == APIKeyAllVolumes {
+			return true
+		}
 	}
 
-	for _, vol := range config.Volumes {
-		if vol == volume.Name {
+	for i := range config.Leases {
+		if leaseAllows(&config.Leases[i], volume, path, permission) {
 			return true
 		}
 	}
@@ -86,34 +163,155 @@ func NewShareCodeAuthorization(shareCode *ShareCode) *ShareCodeAuthorization {
 	return &ShareCodeAuthorization{shareCode: shareCode}
 }
 
-func (u *ShareCodeAuthorization) DiscordUserId() string {
+func (u *ShareCodeAuthorization) UserId() string {
 	return ""
 }
 
-func (u *ShareCodeAuthorization) CanAccess(volume *Volume, path string, full bool) bool {
-	if !full && u.shareCode.Volume == volume.Name && strings.HasPrefix(path, u.shareCode.Path) {
-		return true
-	}
+func (u *ShareCodeAuthorization) Identity() string {
+	return ""
+}
 
+func (u *ShareCodeAuthorization) IsAdmin() bool {
 	return false
 }
 
+func (u *ShareCodeAuthorization) CanAccess(volume *Volume, path string, permission Permission) bool {
+	// file requests are write only, uploads check them separately
+	if permission.Full() || u.shareCode.Volume != volume.Name || u.shareCode.Kind == ShareKindUpload {
+		return false
+	}
+
+	return u.shareCode.Covers(path)
+}
+
+// keyring signs with the first of several keys and verifies against all of
+// them, so a new key can be put in front while the old ones keep verifying.
+type keyring struct {
+	swords []*goalone.Sword
+}
+
+func newKeyring(secrets []string) *keyring {
+	swords := make([]*goalone.Sword, len(secrets))
+	for i, secret := range secrets {
+		swords[i] = goalone.New([]byte(secret))
+	}
+	return &keyring{swords: swords}
+}
+
+func (k *keyring) Sign(data []byte) []byte {
+	return k.swords[0].Sign(data)
+}
+
+func (k *keyring) Unsign(token []byte) ([]byte, error) {
+	var err error
+	for _, sword := range k.swords {
+		var data []byte
+		data, err = sword.Unsign(token)
+		if err == nil {
+			return data, nil
+		}
+	}
+	return nil, err
+}
+
 type AuthStore struct {
-	signer       *goalone.Sword
+	signer       *keyring
 	fileStore    *FileStore
 	sessionStore *sessions.CookieStore
+	guildRoles   *GuildRoles
+	backoff      *Backoff
 	config       *Config
 }
 
 func NewAuthStore(fileStore *FileStore, config *Config) *AuthStore {
+	secrets, _ := config.HTTP.SigningSecrets()
+
+	// cookies are only authenticated, so each secret is a hash key without a
+	// block key, gorilla encodes with the first pair and decodes with any
+	keyPairs := make([][]byte, 0, len(secrets)*2)
+	for _, secret := range secrets {
+		keyPairs = append(keyPairs, []byte(secret), nil)
+	}
+
+	sessionStore := sessions.NewCookieStore(keyPairs...)
+	options, err := config.HTTP.SessionOptions()
+	if err != nil {
+		panic(err)
+	}
+	sessionStore.Options = options
+	// also makes the signed cookies expire, not just the browser's copy
+	sessionStore.MaxAge(options.MaxAge)
+
+	guildRoles, err := NewGuildRoles(config)
+	if err != nil {
+		panic(err)
+	}
+
 	return &AuthStore{
-		signer:       goalone.New([]byte(config.HTTP.Secret)),
+		signer:       newKeyring(secrets),
 		fileStore:    fileStore,
-		sessionStore: sessions.NewCookieStore([]byte(config.HTTP.Secret)),
+		sessionStore: sessionStore,
+		guildRoles:   guildRoles,
+		backoff:      NewBackoff(),
 		config:       config,
 	}
 }
 
+// Failed slows down whoever made r, after they presented a share code or
+// credentials that didn't check out.
+func (a *AuthStore) Failed(r *http.Request) {
+	a.backoff.Fail(requestIP(r))
+}
+
+// GetShareCode is GetShareCode for a share code presented by r, codes that
+// don't exist count as a failure of whoever presented them.
+func (a *AuthStore) GetShareCode(r *http.Request, code string) (*ShareCode, error) {
+	shareCode, err := GetShareCode(code)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		a.Failed(r)
+	}
+	return shareCode, err
+}
+
+// userAuthorization authorizes a user by their provider qualified id, along
+// with the roles the provider gives them. Users of a provider that is no
+// longer configured aren't authorized.
+func (a *AuthStore) userAuthorization(userId string) Authorization {
+	var roles []string
+	provider, id, _ := strings.Cut(userId, ":")
+	switch provider {
+	case ProviderDiscord:
+		roles = a.config.DiscordUserRoles(id, a.guildRoles.MemberRoles(id))
+	case ProviderOIDC:
+		if a.config.OIDC == nil {
+			return nil
+		}
+		roles = a.config.OIDC.UserRoles(GetOIDCUserClaims(id))
+	case ProviderLocal:
+		if _, err := GetLocalUser(id); err != nil {
+			return nil
+		}
+		roles = a.config.LocalUserRoles(id)
+	default:
+		return nil
+	}
+	return NewUserAuthorization(userId, roles, a.config.IsAdmin(roles))
+}
+
+// SessionUserId returns the provider qualified id of the user logged in with
+// session, or an empty string.
+func SessionUserId(session *sessions.Session) string {
+	if userId, ok := session.Values["user-id"].(string); ok && userId != "" {
+		return userId
+	}
+
+	// sessions from before other providers only hold a discord id
+	if discordUserId, ok := session.Values["discord-user-id"].(string); ok && discordUserId != "" && discordUserId != "0" {
+		return ProviderDiscord + ":" + discordUserId
+	}
+	return ""
+}
+
 func (a *AuthStore) GetSession(r *http.Request) *sessions.Session {
 	session, err := a.sessionStore.Get(r, "session")
 	if err != nil {
@@ -123,101 +321,201 @@ func (a *AuthStore) GetSession(r *http.Request) *sessions.Session {
 }
 
 func (a *AuthStore) Check(r *http.Request) Authorization {
+	auth, _ := a.authenticate(r)
+	return auth
+}
+
+// authenticate resolves the authorization for a request, returning an error
+// describing why credentials that were presented got rejected.
+func (a *AuthStore) authenticate(r *http.Request) (Authorization, error) {
 	authParts := strings.Split(r.Header.Get("Authorization"), " ")
 
 	if len(authParts) > 1 && strings.ToLower(authParts[0]) == "token" {
 		userId := a.ValidateUserToken(authParts[1])
 		if userId != "" {
-			return NewUserAuthorization(userId, a.config.IsAdmin(userId))
+			if auth := a.userAuthorization(userId); auth != nil {
+				return auth, nil
+			}
+		} else {
+			a.Failed(r)
 		}
-		return nil
+		return nil, errors.New("invalid token")
 	} else if len(authParts) > 1 && strings.ToLower(authParts[0]) == "apikey" {
 		key, err := GetAPIKey(authParts[1])
-		if err == nil {
-			return NewAPIKeyAuthorization(key)
+		if err != nil {
+			a.Failed(r)
+			return nil, err
 		}
-		return nil
+		return NewAPIKeyAuthorization(key), nil
 	} else if r.URL.Query().Get("sc") != "" {
-		shareCodeRaw := r.URL.Query().Get("sc")
-		if shareCodeRaw != "" {
-			it, err := GetShareCode(shareCodeRaw)
-			if err != nil {
-				return nil
-			}
-
-			return NewShareCodeAuthorization(it)
+		it, err := a.GetShareCode(r, r.URL.Query().Get("sc"))
+		if err != nil {
+			return nil, err
 		}
-		return nil
-	} else {
-		session := a.GetSession(r)
-		if session == nil {
-			return nil
+		if it.HasPassword() && !a.ShareCodeUnlocked(r, it) {
+			return nil, ErrShareCodeLocked
 		}
+		return NewShareCodeAuthorization(it), nil
+	} else {
+		return a.CheckSession(r), nil
+	}
+}
 
-		var discordUserId string = "0"
-		raw, ok := session.Values["discord-user-id"]
-		if raw != nil && ok {
-			discordUserId = raw.(string)
-		}
+// CheckSession authenticates a request by its session alone, for things that
+// credentials handed to other clients must not be able to do.
+func (a *AuthStore) CheckSession(r *http.Request) Authorization {
+	session := a.GetSession(r)
+	if session == nil {
+		return nil
+	}
 
-		if discordUserId == "" || discordUserId == "0" {
-			return nil
-		}
+	userId := SessionUserId(session)
+	if userId == "" {
+		return nil
+	}
+
+	return a.userAuthorization(userId)
+}
 
-		return NewUserAuthorization(discordUserId, a.config.IsAdmin(discordUserId))
+// CheckBasic authenticates a request using HTTP Basic credentials, for
+// clients like WebDAV that can't send anything else. The password is either
+// a user token or an API key, the username is ignored.
+func (a *AuthStore) CheckBasic(r *http.Request) Authorization {
+	_, password, ok := r.BasicAuth()
+	if !ok || password == "" {
+		return nil
+	}
+
+	userId := a.ValidateUserToken(password)
+	if userId != "" {
+		return a.userAuthorization(userId)
 	}
+
+	key, err := GetAPIKey(password)
+	if err != nil {
+		a.Failed(r)
+		return nil
+	}
+	return NewAPIKeyAuthorization(key)
 }
 
 type AuthReq = string
 
-func (a *AuthStore) GetVolume(w http.ResponseWriter, r *http.Request, needAuth bool) (*Volume, Authorization) {
-	auth := a.Check(r)
-	volume, ok := a.fileStore.Volumes[chi.URLParam(r, "volumeName")]
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrNoAccess     = errors.New("not found")
+)
 
-	if !needAuth && (volume.Privacy == "public" || volume.Privacy == "unlisted") {
-		return volume, auth
+// ResolveVolume finds the volume a request is for and checks the request may
+// use permission on path within it. Volumes that are missing are reported the
+// same as ones that can't be accessed.
+func (a *AuthStore) ResolveVolume(r *http.Request, volumeName, path string, permission Permission) (*Volume, Authorization, error) {
+	auth, authErr := a.authenticate(r)
+	volume, ok := a.fileStore.Volumes[volumeName]
+
+	if ok && !permission.Full() && volume.PublicAt(path) {
+		return volume, auth, nil
+	}
+
+	if errors.Is(authErr, ErrShareCodeExpired) || errors.Is(authErr, ErrShareCodeExhausted) || errors.Is(authErr, ErrShareCodeLocked) {
+		return nil, nil, authErr
 	}
 
 	if auth == nil {
-		gores.Error(w, http.StatusUnauthorized, "unauthorized")
-		return nil, nil
+		return nil, nil, ErrUnauthorized
 	}
 
+	if !ok || !auth.CanAccess(volume, path, permission) {
+		return nil, nil, ErrNoAccess
+	}
+
+	return volume, auth, nil
+}
+
+func (a *AuthStore) GetVolume(w http.ResponseWriter, r *http.Request, permission Permission) (*Volume, Authorization) {
 	// TODO: this being implicit is so fucking aids, just pass it in
 	path, err := url.PathUnescape(chi.URLParam(r, "*"))
 	if err != nil {
 		panic(err)
 	}
 
-	if !ok || !auth.CanAccess(volume, path, needAuth) {
+	return a.GetVolumeAt(w, r, path, permission)
+}
+
+// GetVolumeAt is GetVolume for routes that don't have the path they work on
+// in their URL.
+func (a *AuthStore) GetVolumeAt(w http.ResponseWriter, r *http.Request, path string, permission Permission) (*Volume, Authorization) {
+	volume, auth, err := a.ResolveVolume(r, chi.URLParam(r, "volumeName"), path, permission)
+	if err == nil {
+		return volume, auth
+	}
+
+	if errors.Is(err, ErrShareCodeLocked) {
+		// send them through the unlock page, which comes back here afterwards
+		query := r.URL.Query()
+		code := query.Get("sc")
+		query.Del("sc")
+		next := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+		http.Redirect(w, r, fmt.Sprintf("/s/%s?%s", url.PathEscape(code), url.Values{"next": {next.String()}}.Encode()), http.StatusTemporaryRedirect)
+	} else if errors.Is(err, ErrShareCodeExpired) || errors.Is(err, ErrShareCodeExhausted) {
+		shareCodeError(w, err)
+	} else if errors.Is(err, ErrUnauthorized) {
+		gores.Error(w, http.StatusUnauthorized, "unauthorized")
+	} else {
 		gores.Error(w, http.StatusNotFound, "not found")
-		return nil, nil
 	}
+	return nil, nil
+}
+
+const shareUnlockMaxAge = time.Hour
 
-	return volume, auth
+func shareUnlockCookieName(shareCode *ShareCode) string {
+	return fmt.Sprintf("share-unlock-%d", shareCode.Id)
 }
 
-func (a *AuthStore) GenerateUserToken(userId string) string {
-	data, err := json.Marshal(userId)
+// UnlockShareCode sets a short lived signed cookie remembering that the
+// password for a share code was entered.
+func (a *AuthStore) UnlockShareCode(w http.ResponseWriter, shareCode *ShareCode) {
+	expiresAt := time.Now().Add(shareUnlockMaxAge)
+	data := fmt.Sprintf("%s:%d", shareCode.Code, expiresAt.Unix())
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     shareUnlockCookieName(shareCode),
+		Value:    base64.RawURLEncoding.EncodeToString(a.signer.Sign([]byte(data))),
+		Path:     "/",
+		Domain:   a.sessionStore.Options.Domain,
+		Expires:  expiresAt,
+		Secure:   a.sessionStore.Options.Secure,
+		HttpOnly: true,
+		SameSite: a.sessionStore.Options.SameSite,
+	})
+}
+
+func (a *AuthStore) ShareCodeUnlocked(r *http.Request, shareCode *ShareCode) bool {
+	cookie, err := r.Cookie(shareUnlockCookieName(shareCode))
 	if err != nil {
-		return ""
+		return false
 	}
-	return base64.RawURLEncoding.EncodeToString(a.signer.Sign(data))
-}
 
-func (a *AuthStore) ValidateUserToken(token string) string {
-	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	decoded, err := base64.RawURLEncoding.DecodeString(cookie.Value)
 	if err != nil {
-		return ""
+		return false
 	}
+
 	raw, err := a.signer.Unsign(decoded)
 	if err != nil {
-		return ""
+		return false
 	}
-	var result string
-	err = json.Unmarshal(raw, &result)
+
+	code, expiresAt, ok := strings.Cut(string(raw), ":")
+	if !ok || code != shareCode.Code {
+		return false
+	}
+
+	expires, err := strconv.ParseInt(expiresAt, 10, 64)
 	if err != nil {
-		return ""
+		return false
 	}
-	return result
+
+	return time.Now().Unix() < expires
 }
@@ -0,0 +1,212 @@
+package files
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+)
+
+// Backend is the storage a Volume is served from. Every path handed to a
+// Backend is relative to the root of the volume, it is up to the backend to
+// make sure it can never escape that root.
+type Backend interface {
+	Stat(path string) (fs.FileInfo, error)
+	Open(path string) (io.ReadSeekCloser, error)
+	ReadDir(path string) ([]fs.FileInfo, error)
+	WalkDir(root string, fn fs.WalkDirFunc) error
+	Create(path string) (FileWriter, error)
+	// Append opens path for writing at its end, creating it if needed.
+	// Backends that can't append return errors.ErrUnsupported.
+	Append(path string) (io.WriteCloser, error)
+	Rename(from, to string) error
+	Remove(path string) error
+	// RemoveAll removes path and everything below it.
+	RemoveAll(path string) error
+	MkdirAll(path string) error
+}
+
+// FileWriter is what Backend.Create hands out. Nothing written to it shows up
+// at its path until Close succeeds, Abort throws the data away instead so an
+// interrupted write never leaves a partial file behind.
+type FileWriter interface {
+	io.WriteCloser
+	Abort() error
+}
+
+// tempFilePrefix marks files that are still being written, they are hidden
+// the same way as the internal areas of a volume.
+const tempFilePrefix = ".files-tmp-"
+
+func NewBackend(config *VolumeConfig) (Backend, error) {
+	switch config.Backend {
+	case "", "local":
+		if config.Path == "" {
+			return nil, fmt.Errorf("volume '%s' is missing a path", config.Name)
+		}
+		return NewLocalBackend(config.Path), nil
+	case "s3":
+		if config.S3 == nil {
+			return nil, fmt.Errorf("volume '%s' uses the s3 backend but has no s3 block", config.Name)
+		}
+		return NewS3Backend(config.S3, config.Path)
+	default:
+		return nil, fmt.Errorf("volume '%s' has unknown backend '%s'", config.Name, config.Backend)
+	}
+}
+
+// LocalBackend serves a volume from a directory on the local disk.
+type LocalBackend struct {
+	root string
+}
+
+func NewLocalBackend(root string) *LocalBackend {
+	return &LocalBackend{root: root}
+}
+
+func (b *LocalBackend) path(path string) (string, error) {
+	return securejoin.SecureJoin(b.root, path)
+}
+
+func (b *LocalBackend) Stat(p string) (fs.FileInfo, error) {
+	path, err := b.path(p)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(path)
+}
+
+func (b *LocalBackend) Open(p string) (io.ReadSeekCloser, error) {
+	path, err := b.path(p)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (b *LocalBackend) ReadDir(p string) ([]fs.FileInfo, error) {
+	path, err := b.path(p)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]fs.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, info)
+	}
+	return result, nil
+}
+
+func (b *LocalBackend) WalkDir(p string, fn fs.WalkDirFunc) error {
+	root, err := b.path(p)
+	if err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		rel := strings.TrimPrefix(strings.TrimPrefix(path, root), string(filepath.Separator))
+		return fn(filepath.Join(p, rel), d, err)
+	})
+}
+
+// Create writes to a temporary file next to path, which is synced and renamed
+// over path on Close.
+func (b *LocalBackend) Create(p string) (FileWriter, error) {
+	path, err := b.path(p)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), tempFilePrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	return &localFileWriter{File: f, path: path}, nil
+}
+
+func (b *LocalBackend) Append(p string) (io.WriteCloser, error) {
+	path, err := b.path(p)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+}
+
+func (b *LocalBackend) Rename(from, to string) error {
+	fromPath, err := b.path(from)
+	if err != nil {
+		return err
+	}
+	toPath, err := b.path(to)
+	if err != nil {
+		return err
+	}
+	return os.Rename(fromPath, toPath)
+}
+
+func (b *LocalBackend) Remove(p string) error {
+	path, err := b.path(p)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (b *LocalBackend) RemoveAll(p string) error {
+	path, err := b.path(p)
+	if err != nil {
+		return err
+	}
+	if path == filepath.Clean(b.root) {
+		return &fs.PathError{Op: "removeall", Path: p, Err: fs.ErrInvalid}
+	}
+	return os.RemoveAll(path)
+}
+
+func (b *LocalBackend) MkdirAll(p string) error {
+	path, err := b.path(p)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(path, os.ModePerm)
+}
+
+type localFileWriter struct {
+	*os.File
+	path string
+}
+
+func (w *localFileWriter) Close() error {
+	err := w.File.Chmod(0644)
+	if err == nil {
+		err = w.File.Sync()
+	}
+	if closeErr := w.File.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(w.File.Name(), w.path)
+	}
+	if err != nil {
+		os.Remove(w.File.Name())
+	}
+	return err
+}
+
+func (w *localFileWriter) Abort() error {
+	w.File.Close()
+	return os.Remove(w.File.Name())
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/brngle/files"
+)
+
+const apiKeyUsage = `usage: files-web-server apikey <command> [arguments]
+
+commands:
+  create [-label label] [-ttl 30d] [-volume name]... [-lease volume:permissions[:paths]]...
+  list
+  rotate <id>
+  revoke <id>`
+
+// stringList collects a flag that can be given more than once.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+func runAPIKeyCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New(apiKeyUsage)
+	}
+
+	err := files.OpenDatabase(files.DatabasePath)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "create":
+		return createAPIKey(args[1:])
+	case "list":
+		return listAPIKeys()
+	case "rotate":
+		if len(args) != 2 {
+			return errors.New(apiKeyUsage)
+		}
+
+		apikey, err := files.GetAPIKeyById(args[1])
+		if err != nil {
+			return err
+		}
+
+		key, err := files.RotateAPIKey(apikey)
+		if err != nil {
+			return err
+		}
+		fmt.Println(key)
+		return nil
+	case "revoke":
+		if len(args) != 2 {
+			return errors.New(apiKeyUsage)
+		}
+
+		apikey, err := files.GetAPIKeyById(args[1])
+		if err != nil {
+			return err
+		}
+		return files.RevokeAPIKey(apikey)
+	}
+
+	return errors.New(apiKeyUsage)
+}
+
+func createAPIKey(args []string) error {
+	var volumes, leases stringList
+	flags := flag.NewFlagSet("apikey create", flag.ContinueOnError)
+	label := flags.String("label", "", "what the key is for")
+	ttl := flags.String("ttl", "never", "how long the key works for, like 30d")
+	flags.Var(&volumes, "volume", "volume the key can do anything on, * for every volume")
+	flags.Var(&leases, "lease", "permissions on a volume, like media:read,list:movies")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	opts := files.APIKeyOptions{
+		Label:   *label,
+		Creator: "cli",
+		Config:  files.APIKeyConfig{Volumes: volumes},
+	}
+
+	if *ttl != "never" {
+		opts.TTL, err = files.ParseDuration(*ttl)
+		if err != nil {
+			return fmt.Errorf("invalid ttl: %v", err)
+		}
+	}
+
+	for _, it := range leases {
+		lease, err := files.ParseAPIKeyLease(it)
+		if err != nil {
+			return err
+		}
+		opts.Config.Leases = append(opts.Config.Leases, lease)
+	}
+
+	if opts.Config.Empty() {
+		return fmt.Errorf("%v, give it one with -volume or -lease", files.ErrAPIKeyUnscoped)
+	}
+
+	apikey, key, err := files.CreateAPIKey(opts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "created api key %d\n", apikey.Id)
+	fmt.Println(key)
+	return nil
+}
+
+func listAPIKeys() error {
+	keys, err := files.ListAPIKeys()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPREFIX\tLABEL\tACCESS\tCREATOR\tCREATED\tLAST USED\tEXPIRES")
+	for _, it := range keys {
+		lastUsed := "never"
+		if it.LastUsedAt != nil {
+			lastUsed = it.LastUsedAt.Local().Format(time.DateTime)
+		}
+
+		expires := "never"
+		if it.Expired() {
+			expires = "expired"
+		} else if it.ExpiresAt != nil {
+			expires = it.ExpiresAt.Local().Format(time.DateTime)
+		}
+
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			it.Id, it.Prefix, it.Label, strings.Join(it.Leases(), " "), it.Creator,
+			it.CreatedAt.Local().Format(time.DateTime), lastUsed, expires)
+	}
+	return w.Flush()
+}
@@ -8,6 +8,22 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "apikey" {
+		err := runAPIKeyCommand(os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "user" {
+		err := runUserCommand(os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	configPath := os.Getenv("CONFIG")
 	if configPath == "" && len(os.Args) > 1 {
 		configPath = os.Args[1]
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/brngle/files"
+)
+
+const userUsage = `usage: files-web-server user <command> [arguments]
+
+passwords are read from stdin.
+
+commands:
+  create <username>
+  list
+  passwd <username>
+  reset-totp <username>
+  delete <username>`
+
+func readPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func runUserCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New(userUsage)
+	}
+
+	err := files.OpenDatabase(files.DatabasePath)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		return listUsers()
+	case "create", "passwd", "reset-totp", "delete":
+		if len(args) != 2 {
+			return errors.New(userUsage)
+		}
+	default:
+		return errors.New(userUsage)
+	}
+
+	if args[0] == "create" {
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+
+		_, err = files.CreateLocalUser(args[1], password)
+		return err
+	}
+
+	user, err := files.GetLocalUser(args[1])
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "passwd":
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		return user.SetPassword(password)
+	case "reset-totp":
+		return user.SetTOTPSecret("")
+	default:
+		return files.DeleteLocalUser(user)
+	}
+}
+
+func listUsers() error {
+	users, err := files.ListLocalUsers()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "USERNAME\tTWO FACTOR\tCREATED")
+	for _, it := range users {
+		fmt.Fprintf(w, "%s\t%t\t%s\n", it.Username, it.HasTOTP(), it.CreatedAt.Local().Format(time.DateTime))
+	}
+	return w.Flush()
+}
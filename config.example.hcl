@@ -2,6 +2,34 @@ http {
   url    = "https://files.example.com"
   bind   = "localhost:3333"
   secret = "yeet420"
+
+  # to rotate the secret, replace it with a list. the first secret signs new
+  # cookies and tokens, the rest still verify until they are removed
+  # secrets = ["new-secret", "yeet420"]
+
+  # user tokens stop working this long after they were issued
+  token_max_age = "90d"
+
+  # audit events older than this are deleted, without it they are kept forever
+  audit_retention = "365d"
+
+  # requests are limited per user, or per address when nobody is logged in.
+  # "share" covers share codes, "auth" covers logins and requests with api keys
+  # or tokens, "default" covers everything else and is unlimited unless set.
+  # addresses that keep presenting unknown share codes or bad credentials are
+  # also blocked for longer and longer
+  rate_limit "share" {
+    requests = 120
+    per      = "1m"
+    burst    = 30
+  }
+
+  # session cookies are secure when the url is https, sent with same site
+  # requests and top level navigation, and last 30 days unless set here
+  cookie {
+    same_site = "lax"
+    max_age   = "30d"
+  }
 }
 
 volume "personal" {
@@ -14,11 +42,49 @@ volume "sharex" {
   path     = "/mnt/personal/sharex"
   privacy  = "unlisted"
   features = ["sharex", "compress"]
+
+  # keep both files when something is uploaded under an existing name
+  conflict_policy = "rename"
+
+  share_ttl     = "7d"
+  max_share_ttl = "30d"
 }
 
 volume "media" {
   path     = "/mnt/media"
-  features = ["transcode", "compress"]
+  features = ["transcode", "compress", "manage", "trash"]
+
+  # deleted files can be restored from the trash for this long
+  trash_retention = "14d"
+
+  roles = ["members"]
+
+  # acl rules decide access to the paths their glob matches, where ** matches
+  # any number of directories. the first glob that matches a path decides,
+  # through every rule written for it, other paths are open to the roles
+  # of the volume. matched paths aren't public even on public volumes
+  acl "private/**" {
+    roles       = ["admin"]
+    permissions = ["read", "list", "write", "share"]
+  }
+  acl "shows/**" {
+    roles       = ["members"]
+    permissions = ["read", "list"]
+  }
+}
+
+volume "archive" {
+  backend  = "s3"
+  path     = "archive"
+  features = ["compress", "search"]
+
+  s3 {
+    endpoint   = "s3.example.com"
+    bucket     = "files"
+    region     = "us-east-1"
+    access_key = ""
+    secret_key = ""
+  }
 }
 
 discord {
@@ -26,9 +92,34 @@ discord {
   client_id     = ""
   client_secret = ""
   token         = ""
+
+  # how long the guild roles of a user are cached before asking discord again
+  role_cache_ttl = "5m"
 }
 
+# users can also log in with an OpenID Connect issuer, alongside discord
+# oidc {
+#   name          = "SSO"
+#   issuer        = "https://id.example.com"
+#   client_id     = ""
+#   client_secret = ""
+#
+#   # values of the role_claim in the id token map onto the roles below
+#   role_claim   = "groups"
+#   role_mapping = { "files-admins" = "admin" }
+# }
+
 role "admin" {
   user_ids = ["my-discord-user-id"]
   admin    = true
+}
+
+# roles can also be given to everyone holding a role in the discord guild, the
+# bot looks these up so guild membership changes apply without editing this
+role "members" {
+  discord_role_ids = ["my-discord-role-id"]
+
+  # local accounts are made with `files-web-server user create <username>` or
+  # from the users page, and get roles by their username
+  local_users = ["alice"]
 }
\ No newline at end of file
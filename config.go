@@ -1,8 +1,14 @@
 package files
 
 import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/gorilla/sessions"
 	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/hclsimple"
 	"github.com/zclconf/go-cty/cty"
@@ -13,12 +19,57 @@ type Config struct {
 	HTTP    *HTTPConfig    `hcl:"http,block"`
 	Volumes []VolumeConfig `hcl:"volume,block"`
 	Discord *DiscordConfig `hcl:"discord,block"`
+	OIDC    *OIDCConfig    `hcl:"oidc,block"`
 	Roles   []RoleConfig   `hcl:"role,block"`
 }
 
-func (c *Config) IsAdmin(discordId string) bool {
+// IsAdmin reports whether any of the named roles is an admin role.
+func (c *Config) IsAdmin(roles []string) bool {
 	for _, role := range c.Roles {
-		if role.Admin && role.HasUserId(discordId) {
+		if role.Admin && slices.Contains(roles, role.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasRole reports whether a role with the given name is configured.
+func (c *Config) HasRole(name string) bool {
+	for _, role := range c.Roles {
+		if role.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// LocalUserRoles returns the names of the roles a local account has.
+func (c *Config) LocalUserRoles(username string) []string {
+	var roles []string
+	for _, role := range c.Roles {
+		if slices.Contains(role.LocalUsers, username) {
+			roles = append(roles, role.Name)
+		}
+	}
+	return roles
+}
+
+// DiscordUserRoles returns the names of the roles a discord user has, either
+// directly or through the guild roles they hold.
+func (c *Config) DiscordUserRoles(userId string, discordRoleIds []string) []string {
+	var roles []string
+	for _, role := range c.Roles {
+		if role.HasMember(userId, discordRoleIds) {
+			roles = append(roles, role.Name)
+		}
+	}
+	return roles
+}
+
+// UsesDiscordRoles reports whether any role is granted through discord roles.
+func (c *Config) UsesDiscordRoles() bool {
+	for _, role := range c.Roles {
+		if len(role.DiscordRoleIds) > 0 {
 			return true
 		}
 	}
@@ -29,7 +80,226 @@ type HTTPConfig struct {
 	URL      string `hcl:"url,optional"`
 	ShareURL string `hcl:"share_url,optional"`
 	Bind     string `hcl:"bind"`
-	Secret   string `hcl:"secret"`
+	Secret   string `hcl:"secret,optional"`
+	// Secrets replaces Secret with an ordered list to rotate through, the
+	// first one signs and all of them are accepted when verifying.
+	Secrets []string `hcl:"secrets,optional"`
+
+	ShareCodeLength   int    `hcl:"share_code_length,optional"`
+	ShareCodeAlphabet string `hcl:"share_code_alphabet,optional"`
+
+	// TokenMaxAge is how long user tokens work for after they were issued,
+	// "never" keeps them working until they are revoked.
+	TokenMaxAge string `hcl:"token_max_age,optional"`
+
+	// AuditRetention is how long audit events are kept for, they are kept
+	// forever when it isn't set.
+	AuditRetention string `hcl:"audit_retention,optional"`
+
+	RateLimit []RateLimitConfig `hcl:"rate_limit,block"`
+
+	Cookie *CookieConfig `hcl:"cookie,block"`
+}
+
+// CookieConfig sets the options of the session cookie. Cookies are secure
+// when the url is https unless secure says otherwise.
+type CookieConfig struct {
+	Secure   *bool  `hcl:"secure,optional"`
+	SameSite string `hcl:"same_site,optional"`
+	MaxAge   string `hcl:"max_age,optional"`
+	Domain   string `hcl:"domain,optional"`
+}
+
+const defaultSessionMaxAge = 30 * 24 * time.Hour
+
+// SessionOptions returns the options of the session cookie, falling back to
+// defaults for anything the cookie block doesn't set.
+func (h HTTPConfig) SessionOptions() (*sessions.Options, error) {
+	options := &sessions.Options{
+		Path:     "/",
+		MaxAge:   int(defaultSessionMaxAge.Seconds()),
+		Secure:   strings.HasPrefix(h.BaseURL(), "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if h.Cookie == nil {
+		return options, nil
+	}
+
+	options.Domain = h.Cookie.Domain
+	if h.Cookie.Secure != nil {
+		options.Secure = *h.Cookie.Secure
+	}
+
+	switch h.Cookie.SameSite {
+	case "", "lax":
+	case "strict":
+		options.SameSite = http.SameSiteStrictMode
+	case "none":
+		if !options.Secure {
+			return nil, fmt.Errorf("same_site none needs secure cookies")
+		}
+		options.SameSite = http.SameSiteNoneMode
+	default:
+		return nil, fmt.Errorf("unknown same_site '%s'", h.Cookie.SameSite)
+	}
+
+	if h.Cookie.MaxAge != "" {
+		maxAge, err := ParseDuration(h.Cookie.MaxAge)
+		if err != nil {
+			return nil, err
+		} else if maxAge < time.Second {
+			return nil, fmt.Errorf("max_age must be at least a second")
+		}
+		options.MaxAge = int(maxAge.Seconds())
+	}
+	return options, nil
+}
+
+// RateLimitConfig limits the requests of a class to requests per period, with
+// bursts of up to burst requests. Zero requests turns the limit off.
+type RateLimitConfig struct {
+	Class    string `hcl:"class,label"`
+	Requests int    `hcl:"requests"`
+	Per      string `hcl:"per,optional"`
+	Burst    int    `hcl:"burst,optional"`
+}
+
+func (r RateLimitConfig) Period() (time.Duration, error) {
+	if r.Per == "" {
+		return time.Minute, nil
+	}
+
+	per, err := ParseDuration(r.Per)
+	if err != nil {
+		return 0, err
+	} else if per <= 0 {
+		return 0, fmt.Errorf("per must be positive")
+	}
+	return per, nil
+}
+
+// share codes and credentials are limited unless configured otherwise, the
+// rest isn't
+var defaultRateLimits = map[string]RateLimitConfig{
+	RateLimitShare: {Class: RateLimitShare, Requests: 120, Burst: 30},
+	RateLimitAuth:  {Class: RateLimitAuth, Requests: 300, Burst: 60},
+}
+
+// RateLimits returns the limit of every class, configured ones replacing the
+// defaults.
+func (h HTTPConfig) RateLimits() map[string]RateLimitConfig {
+	limits := map[string]RateLimitConfig{}
+	for class, limit := range defaultRateLimits {
+		limits[class] = limit
+	}
+	for _, limit := range h.RateLimit {
+		limits[limit.Class] = limit
+	}
+	return limits
+}
+
+func (h HTTPConfig) validateRateLimits() error {
+	seen := map[string]bool{}
+	for _, limit := range h.RateLimit {
+		switch limit.Class {
+		case RateLimitShare, RateLimitAuth, RateLimitDefault:
+		default:
+			return fmt.Errorf("unknown class '%s'", limit.Class)
+		}
+		if seen[limit.Class] {
+			return fmt.Errorf("class '%s' is limited more than once", limit.Class)
+		}
+		seen[limit.Class] = true
+
+		if limit.Requests < 0 || limit.Burst < 0 {
+			return fmt.Errorf("class '%s' can't allow a negative number of requests", limit.Class)
+		}
+		_, err := limit.Period()
+		if err != nil {
+			return fmt.Errorf("class '%s': %v", limit.Class, err)
+		}
+	}
+	return nil
+}
+
+// minShareCodeLength keeps share codes long enough that they can't be
+// guessed, along with an alphabet of at least two different characters.
+const minShareCodeLength = 8
+
+func (h HTTPConfig) validateShareCodes() error {
+	if h.ShareCodeLength != 0 && h.ShareCodeLength < minShareCodeLength {
+		return fmt.Errorf("share_code_length must be at least %d", minShareCodeLength)
+	}
+
+	if h.ShareCodeAlphabet != "" {
+		distinct := map[rune]bool{}
+		for _, c := range h.ShareCodeAlphabet {
+			distinct[c] = true
+		}
+		if len(distinct) < 2 {
+			return fmt.Errorf("share_code_alphabet needs at least two different characters")
+		}
+	}
+	return nil
+}
+
+const defaultTokenMaxAge = 90 * 24 * time.Hour
+
+// TokenLifetime parses TokenMaxAge, a zero duration is returned for tokens
+// that don't expire.
+func (h HTTPConfig) TokenLifetime() (time.Duration, error) {
+	switch h.TokenMaxAge {
+	case "":
+		return defaultTokenMaxAge, nil
+	case "never":
+		return 0, nil
+	}
+
+	lifetime, err := ParseDuration(h.TokenMaxAge)
+	if err != nil {
+		return 0, err
+	} else if lifetime <= 0 {
+		return 0, fmt.Errorf("token_max_age must be positive")
+	}
+	return lifetime, nil
+}
+
+// AuditRetentionPeriod parses AuditRetention, a zero duration is returned
+// when events are kept forever.
+func (h HTTPConfig) AuditRetentionPeriod() (time.Duration, error) {
+	if h.AuditRetention == "" {
+		return 0, nil
+	}
+
+	retention, err := ParseDuration(h.AuditRetention)
+	if err != nil {
+		return 0, err
+	} else if retention <= 0 {
+		return 0, fmt.Errorf("audit_retention must be positive")
+	}
+	return retention, nil
+}
+
+// SigningSecrets returns the secrets to sign and verify with, in order.
+func (h HTTPConfig) SigningSecrets() ([]string, error) {
+	if h.Secret != "" && len(h.Secrets) > 0 {
+		return nil, fmt.Errorf("only one of secret and secrets can be set")
+	}
+
+	secrets := h.Secrets
+	if h.Secret != "" {
+		secrets = []string{h.Secret}
+	}
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("a secret is required")
+	}
+	for _, secret := range secrets {
+		if secret == "" {
+			return nil, fmt.Errorf("secrets can't be empty")
+		}
+	}
+	return secrets, nil
 }
 
 func (h HTTPConfig) BaseShareURL() string {
@@ -41,11 +311,43 @@ func (h HTTPConfig) BaseURL() string {
 }
 
 type VolumeConfig struct {
-	Name     string   `hcl:"name,label"`
-	Path     string   `hcl:"path"`
-	Features []string `hcl:"features,optional"`
-	Roles    []string `hcl:"roles,optional"`
-	Privacy  string   `hcl:"privacy,optional"`
+	Name     string    `hcl:"name,label"`
+	Path     string    `hcl:"path,optional"`
+	Backend  string    `hcl:"backend,optional"`
+	S3       *S3Config `hcl:"s3,block"`
+	Features []string  `hcl:"features,optional"`
+	Roles    []string  `hcl:"roles,optional"`
+	Privacy  string    `hcl:"privacy,optional"`
+
+	// ConflictPolicy decides what uploads do when the file already exists,
+	// one of "overwrite" (the default), "rename" or "reject".
+	ConflictPolicy string `hcl:"conflict_policy,optional"`
+
+	// TrashRetention is how long entries deleted on volumes with the trash
+	// feature are kept, "never" keeps them until deleted from the trash.
+	TrashRetention string `hcl:"trash_retention,optional"`
+
+	ShareTTL    string `hcl:"share_ttl,optional"`
+	MaxShareTTL string `hcl:"max_share_ttl,optional"`
+
+	ACL []ACLConfig `hcl:"acl,block"`
+}
+
+// ACLConfig gives roles permissions on the paths matching a glob, one of
+// "read", "list", "write" or "share".
+type ACLConfig struct {
+	Path        string   `hcl:"path,label"`
+	Roles       []string `hcl:"roles"`
+	Permissions []string `hcl:"permissions"`
+}
+
+type S3Config struct {
+	Endpoint  string `hcl:"endpoint"`
+	Bucket    string `hcl:"bucket"`
+	Region    string `hcl:"region,optional"`
+	AccessKey string `hcl:"access_key,optional"`
+	SecretKey string `hcl:"secret_key,optional"`
+	Insecure  bool   `hcl:"insecure,optional"`
 }
 
 type DiscordConfig struct {
@@ -53,12 +355,68 @@ type DiscordConfig struct {
 	ClientId     string `hcl:"client_id"`
 	ClientSecret string `hcl:"client_secret"`
 	Token        string `hcl:"token"`
+
+	// RoleCacheTTL is how long the guild roles of a user are trusted before
+	// they are fetched again.
+	RoleCacheTTL string `hcl:"role_cache_ttl,optional"`
+}
+
+func (d DiscordConfig) RoleCacheLifetime() (time.Duration, error) {
+	if d.RoleCacheTTL == "" {
+		return defaultRoleCacheTTL, nil
+	}
+
+	ttl, err := ParseDuration(d.RoleCacheTTL)
+	if err != nil {
+		return 0, err
+	} else if ttl <= 0 {
+		return 0, fmt.Errorf("role_cache_ttl must be positive")
+	}
+	return ttl, nil
+}
+
+type OIDCConfig struct {
+	// Name is shown on the login button, defaulting to "SSO".
+	Name         string   `hcl:"name,optional"`
+	Issuer       string   `hcl:"issuer"`
+	ClientId     string   `hcl:"client_id"`
+	ClientSecret string   `hcl:"client_secret"`
+	Scopes       []string `hcl:"scopes,optional"`
+
+	// RoleClaim names the id token claim holding the groups of a user, either
+	// a string or a list of strings. RoleMapping maps its values onto roles.
+	RoleClaim   string            `hcl:"role_claim,optional"`
+	RoleMapping map[string]string `hcl:"role_mapping,optional"`
+}
+
+func (o OIDCConfig) DisplayName() string {
+	if o.Name == "" {
+		return "SSO"
+	}
+	return o.Name
+}
+
+// UserRoles maps the values of the role claim of a user onto role names.
+func (o OIDCConfig) UserRoles(claimValues []string) []string {
+	var roles []string
+	for _, value := range claimValues {
+		role, ok := o.RoleMapping[value]
+		if ok && !slices.Contains(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+	return roles
 }
 
 type RoleConfig struct {
 	Name    string   `hcl:"name,label"`
-	UserIds []string `hcl:"user_ids"`
-	Admin   bool     `hcl:"admin,optional"`
+	UserIds []string `hcl:"user_ids,optional"`
+	// DiscordRoleIds grants the role to everyone holding one of these roles
+	// in the discord guild.
+	DiscordRoleIds []string `hcl:"discord_role_ids,optional"`
+	// LocalUsers are the usernames of local accounts with the role.
+	LocalUsers []string `hcl:"local_users,optional"`
+	Admin      bool     `hcl:"admin,optional"`
 }
 
 func (r *RoleConfig) HasUserId(userId string) bool {
@@ -70,6 +428,33 @@ func (r *RoleConfig) HasUserId(userId string) bool {
 	return false
 }
 
+func (r *RoleConfig) HasDiscordRole(discordRoleIds []string) bool {
+	for _, id := range r.DiscordRoleIds {
+		if slices.Contains(discordRoleIds, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasMember reports whether the role is given to a user, either directly or
+// through one of the discord roles they hold.
+func (r *RoleConfig) HasMember(userId string, discordRoleIds []string) bool {
+	return r.HasUserId(userId) || r.HasDiscordRole(discordRoleIds)
+}
+
+// ParseDuration parses a duration in the format accepted by time.ParseDuration,
+// additionally accepting a whole number of days such as "30d".
+func ParseDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err == nil {
+			return time.Duration(n) * 24 * time.Hour, nil
+		}
+	}
+	return time.ParseDuration(s)
+}
+
 func newHCLEvalContext() *hcl.EvalContext {
 	return &hcl.EvalContext{
 		Variables: map[string]cty.Value{},
@@ -84,5 +469,54 @@ func LoadConfig(path string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	if cfg.HTTP != nil {
+		_, err = cfg.HTTP.SigningSecrets()
+		if err != nil {
+			return nil, fmt.Errorf("invalid http secrets: %v", err)
+		}
+
+		err = cfg.HTTP.validateShareCodes()
+		if err != nil {
+			return nil, fmt.Errorf("invalid share codes: %v", err)
+		}
+
+		_, err = cfg.HTTP.TokenLifetime()
+		if err != nil {
+			return nil, fmt.Errorf("invalid token_max_age: %v", err)
+		}
+
+		_, err = cfg.HTTP.AuditRetentionPeriod()
+		if err != nil {
+			return nil, fmt.Errorf("invalid audit_retention: %v", err)
+		}
+
+		err = cfg.HTTP.validateRateLimits()
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate_limit: %v", err)
+		}
+
+		_, err = cfg.HTTP.SessionOptions()
+		if err != nil {
+			return nil, fmt.Errorf("invalid cookie: %v", err)
+		}
+	}
+
+	if cfg.UsesDiscordRoles() && cfg.Discord == nil {
+		return nil, fmt.Errorf("roles with discord_role_ids need a discord block")
+	}
+	if cfg.Discord != nil {
+		_, err = cfg.Discord.RoleCacheLifetime()
+		if err != nil {
+			return nil, fmt.Errorf("invalid role_cache_ttl: %v", err)
+		}
+	}
+	if cfg.OIDC != nil {
+		for value, role := range cfg.OIDC.RoleMapping {
+			if !cfg.HasRole(role) {
+				return nil, fmt.Errorf("oidc role_mapping maps '%s' onto unknown role '%s'", value, role)
+			}
+		}
+	}
 	return &cfg, nil
 }
@@ -0,0 +1,107 @@
+package files
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/alioygur/gores"
+)
+
+const (
+	csrfHeader = "X-CSRF-Token"
+	csrfField  = "csrf_token"
+)
+
+// CSRFToken returns the csrf token of the session of r, issuing one when the
+// session doesn't have one yet. Pages put it into their forms and htmx sends
+// it along as a header.
+func (a *AuthStore) CSRFToken(w http.ResponseWriter, r *http.Request) string {
+	// a fresh session is returned along with the error when the cookie can't
+	// be decoded, saving it replaces the broken cookie
+	session, _ := a.sessionStore.Get(r, "session")
+	if token, ok := session.Values["csrf-token"].(string); ok && token != "" {
+		return token
+	}
+
+	data := make([]byte, 32)
+	_, err := rand.Read(data)
+	if err != nil {
+		panic(err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(data)
+
+	session.Values["csrf-token"] = token
+	err = session.Save(r, w)
+	if err != nil {
+		log.Printf("failed to save csrf token: %v", err)
+		return ""
+	}
+	return token
+}
+
+// sessionCSRFToken returns the csrf token already issued to the session of r.
+func (a *AuthStore) sessionCSRFToken(r *http.Request) string {
+	session := a.GetSession(r)
+	if session == nil {
+		return ""
+	}
+	token, _ := session.Values["csrf-token"].(string)
+	return token
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// csrfExempt reports whether a request is authorized by something a browser
+// won't attach on its own, so it can't be forged by another site.
+func csrfExempt(r *http.Request) bool {
+	scheme, _, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	switch strings.ToLower(scheme) {
+	case "token", "apikey":
+		return true
+	}
+
+	// webdav only takes basic credentials, never the session
+	return strings.HasPrefix(r.URL.Path, "/dav/")
+}
+
+// csrf is middleware rejecting requests that change something without the
+// csrf token of their session, either in the X-CSRF-Token header or in the
+// csrf_token field of a form.
+func (h *HTTPService) csrf(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isSafeMethod(r.Method) || csrfExempt(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := r.Header.Get(csrfHeader)
+		if token == "" {
+			// only reads url encoded bodies, multipart bodies are left for the
+			// handler to parse with its own limits and send the header instead
+			r.ParseForm()
+			token = r.PostForm.Get(csrfField)
+		}
+
+		expected := h.authStore.sessionCSRFToken(r)
+		if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			if strings.HasPrefix(r.URL.Path, "/api/") {
+				apiErrorResponse(w, NewStatusError(http.StatusForbidden, "invalid csrf token"))
+				return
+			}
+			gores.Error(w, http.StatusForbidden, "invalid csrf token")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
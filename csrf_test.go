@@ -0,0 +1,118 @@
+package files
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+// newTestCSRFService returns a service with only a session store, along with
+// a session cookie and the csrf token issued to it.
+func newTestCSRFService(t *testing.T) (*HTTPService, *http.Cookie, string) {
+	t.Helper()
+
+	h := &HTTPService{
+		authStore: &AuthStore{sessionStore: sessions.NewCookieStore([]byte("csrf-test-secret-csrf-test-secret"))},
+	}
+
+	w := httptest.NewRecorder()
+	token := h.authStore.CSRFToken(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if token == "" {
+		t.Fatal("no csrf token was issued")
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("issuing a csrf token set %d cookies, want 1", len(cookies))
+	}
+	return h, cookies[0], token
+}
+
+func TestCSRFToken(t *testing.T) {
+	h, cookie, token := newTestCSRFService(t)
+
+	// the same session keeps its token
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookie)
+	if got := h.authStore.CSRFToken(httptest.NewRecorder(), r); got != token {
+		t.Errorf("token = %q, want %q", got, token)
+	}
+
+	// other sessions get their own
+	other := h.authStore.CSRFToken(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if other == "" || other == token {
+		t.Errorf("another session got token %q", other)
+	}
+}
+
+func TestCSRFMiddleware(t *testing.T) {
+	h, cookie, token := newTestCSRFService(t)
+	handler := h.csrf(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	form := func(token string) string {
+		return url.Values{csrfField: {token}}.Encode()
+	}
+
+	cases := []struct {
+		name    string
+		method  string
+		path    string
+		session bool
+		header  map[string]string
+		body    string
+		allow   bool
+	}{
+		{"get", http.MethodGet, "/volume/v/", false, nil, "", true},
+		{"head", http.MethodHead, "/volume/v/", false, nil, "", true},
+		{"options", http.MethodOptions, "/api/v1/volumes", false, nil, "", true},
+
+		{"header token", http.MethodPost, "/api/v1/manage/v/mkdir", true, map[string]string{csrfHeader: token}, "", true},
+		{"form token", http.MethodPost, "/share", true, nil, form(token), true},
+		{"delete with header token", http.MethodDelete, "/api/v1/share/abc", true, map[string]string{csrfHeader: token}, "", true},
+
+		{"missing token", http.MethodPost, "/share", true, nil, "", false},
+		{"wrong header token", http.MethodPost, "/share", true, map[string]string{csrfHeader: token + "x"}, "", false},
+		{"wrong form token", http.MethodPost, "/share", true, nil, form("x" + token), false},
+		{"wrong header beats right form", http.MethodPost, "/share", true, map[string]string{csrfHeader: "x"}, form(token), false},
+		{"token without a session", http.MethodPost, "/share", false, map[string]string{csrfHeader: token}, "", false},
+		{"empty token without a session", http.MethodPost, "/share", false, map[string]string{csrfHeader: ""}, "", false},
+		{"api missing token", http.MethodPut, "/api/v1/share/abc", true, nil, "", false},
+
+		{"token scheme", http.MethodPost, "/api/v1/manage/v/mkdir", false, map[string]string{"Authorization": "Token abc"}, "", true},
+		{"apikey scheme", http.MethodPost, "/api/v1/manage/v/mkdir", false, map[string]string{"Authorization": "ApiKey abc"}, "", true},
+		{"apikey scheme lowercase", http.MethodDelete, "/api/v1/share/abc", false, map[string]string{"Authorization": "apikey abc"}, "", true},
+		{"basic scheme", http.MethodPost, "/share", true, map[string]string{"Authorization": "Basic YTpi"}, "", false},
+		{"bearer scheme", http.MethodPost, "/share", true, map[string]string{"Authorization": "Bearer abc"}, "", false},
+		{"dav", "PROPPATCH", "/dav/v/a.txt", true, nil, "", true},
+		{"dav put", http.MethodPut, "/dav/v/a.txt", false, nil, "", true},
+		{"not dav", http.MethodPut, "/davx/v/a.txt", true, nil, "", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+			if c.body != "" {
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			for k, v := range c.header {
+				r.Header.Set(k, v)
+			}
+			if c.session {
+				r.AddCookie(cookie)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if c.allow && w.Code != http.StatusNoContent {
+				t.Errorf("status = %d, want the request through", w.Code)
+			} else if !c.allow && w.Code != http.StatusForbidden {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusForbidden)
+			}
+		})
+	}
+}
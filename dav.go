@@ -0,0 +1,470 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/net/webdav"
+)
+
+func init() {
+	for _, method := range []string{"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK"} {
+		chi.RegisterMethod(method)
+	}
+}
+
+// davFileSystem exposes a volume over WebDAV to whoever auth is. Every path goes
+// through the volume backend, so it gets the same protection against escaping
+// the volume as everything else, and is checked against auth before it is
+// touched. Creating files needs the upload feature, deleting, moving and
+// creating directories need the manage feature.
+type davFileSystem struct {
+	volume *Volume
+	auth   Authorization
+
+	// upload is the body of a PUT request
+	upload *davUpload
+}
+
+// newDavFileSystem makes the file system a WebDAV request r is served from.
+// The body of a PUT is wrapped so the file it ends up in can tell whether all
+// of it arrived.
+func newDavFileSystem(volume *Volume, auth Authorization, r *http.Request) *davFileSystem {
+	d := &davFileSystem{volume: volume, auth: auth}
+	if r.Method == http.MethodPut && r.Body != nil {
+		d.upload = &davUpload{ReadCloser: r.Body, length: r.ContentLength}
+		r.Body = d.upload
+	}
+	return d
+}
+
+// davUpload remembers whether reading the body of an upload failed. The
+// webdav handler closes the file it copies the body into either way, so the
+// file has to find out on its own that it should be thrown away.
+type davUpload struct {
+	io.ReadCloser
+	length int64
+	err    error
+}
+
+func (u *davUpload) Read(p []byte) (int, error) {
+	n, err := u.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		u.err = err
+	}
+	return n, err
+}
+
+func davPath(name string) string {
+	return cleanVolumePath(name)
+}
+
+func davError(err error) error {
+	if errors.Is(err, ErrFileExists) {
+		return os.ErrExist
+	} else if errors.Is(err, fs.ErrInvalid) {
+		return os.ErrPermission
+	}
+	return err
+}
+
+// canSee reports whether auth can look at path, listing directories and
+// reading files.
+func (d *davFileSystem) canSee(path string, isDir bool) bool {
+	if isDir {
+		return d.auth.CanAccess(d.volume, path, PermissionList)
+	}
+	return d.auth.CanAccess(d.volume, path, PermissionRead)
+}
+
+func (d *davFileSystem) canWrite(path string) bool {
+	return d.auth.CanAccess(d.volume, path, PermissionWrite)
+}
+
+// stat looks up path, pretending paths auth can't see don't exist. The error
+// is a PathError so listings skip such entries rather than failing.
+func (d *davFileSystem) stat(path string) (fs.FileInfo, error) {
+	if isInternalPath(path) {
+		return nil, &fs.PathError{Op: "stat", Path: path, Err: fs.ErrNotExist}
+	}
+
+	info, err := d.volume.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !d.canSee(path, info.IsDir()) {
+		return nil, &fs.PathError{Op: "stat", Path: path, Err: fs.ErrNotExist}
+	}
+	return info, nil
+}
+
+func (d *davFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	path := davPath(name)
+	if !d.volume.HasFeature("manage") || !d.canWrite(path) {
+		return os.ErrPermission
+	}
+	return davError(d.volume.Mkdir(path))
+}
+
+func (d *davFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	path := davPath(name)
+	if isInternalPath(path) {
+		return nil, os.ErrNotExist
+	}
+
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		return d.create(path, flag)
+	}
+
+	info, err := d.stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := &davFile{path: path, info: info}
+	if info.IsDir() {
+		infos, err := d.volume.Backend.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+
+		entries := make([]*VolumeEntry, 0, len(infos))
+		byPath := map[string]fs.FileInfo{}
+		for _, it := range infos {
+			entryPath := davPath(path + "/" + it.Name())
+			if isInternalPath(entryPath) {
+				continue
+			}
+			entries = append(entries, NewVolumeEntryFromStat(entryPath, it))
+			byPath[entryPath] = it
+		}
+		for _, entry := range d.volume.FilterVisible(d.auth, entries) {
+			file.entries = append(file.entries, byPath[entry.Path])
+		}
+		return file, nil
+	}
+
+	file.reader, err = d.volume.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (d *davFileSystem) create(path string, flag int) (webdav.File, error) {
+	if !d.volume.HasFeature("upload") || isVolumeRoot(path) || !d.canWrite(path) {
+		return nil, os.ErrPermission
+	}
+
+	info, err := d.volume.Stat(path)
+	if err == nil {
+		if info.IsDir() || flag&os.O_EXCL != 0 {
+			return nil, os.ErrExist
+		}
+		// clients expect to be able to save over their files, so only the
+		// reject policy stops them
+		if d.volume.ConflictPolicy == ConflictReject {
+			return nil, os.ErrExist
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	writer, err := d.volume.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &davFile{path: path, writer: writer, upload: d.upload}, nil
+}
+
+func (d *davFileSystem) RemoveAll(ctx context.Context, name string) error {
+	path := davPath(name)
+	if !d.volume.HasFeature("manage") {
+		return os.ErrPermission
+	}
+	if err := manageRemovable(d.volume, d.auth, "remove", path); err != nil {
+		return err
+	}
+
+	if d.volume.HasFeature("trash") {
+		_, err := d.volume.Trash(path, d.auth.Identity())
+		return davError(err)
+	}
+	return davError(d.volume.Delete(path))
+}
+
+func (d *davFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	from, to := davPath(oldName), davPath(newName)
+	if !d.volume.HasFeature("manage") {
+		return os.ErrPermission
+	}
+	if err := manageTransferable(d.volume, d.auth, "rename", from, to, PermissionWrite); err != nil {
+		return err
+	}
+
+	_, err := d.volume.Move(from, to)
+	return davError(err)
+}
+
+func (d *davFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return d.stat(davPath(name))
+}
+
+// davFile is a file or directory opened over WebDAV, files are either being
+// read or written, never both.
+type davFile struct {
+	path string
+	info fs.FileInfo
+
+	reader io.ReadSeekCloser
+
+	writer  FileWriter
+	written int64
+	err     error
+	upload  *davUpload
+
+	entries []fs.FileInfo
+}
+
+func (f *davFile) Read(p []byte) (int, error) {
+	if f.reader == nil {
+		return 0, os.ErrInvalid
+	}
+	return f.reader.Read(p)
+}
+
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	if f.reader == nil {
+		// a directory or a new file, only asking for the position works
+		if offset == 0 && whence != io.SeekCurrent {
+			return 0, nil
+		}
+		return f.written, nil
+	}
+	return f.reader.Seek(offset, whence)
+}
+
+func (f *davFile) Write(p []byte) (int, error) {
+	if f.writer == nil {
+		return 0, os.ErrInvalid
+	}
+	n, err := f.writer.Write(p)
+	f.written += int64(n)
+	if err != nil {
+		f.err = err
+	}
+	return n, err
+}
+
+// incomplete reports why a file being written didn't get all of what was
+// meant to go into it, if it didn't.
+func (f *davFile) incomplete() error {
+	if f.err != nil {
+		return f.err
+	} else if f.upload == nil {
+		return nil
+	} else if f.upload.err != nil {
+		return f.upload.err
+	} else if f.upload.length >= 0 && f.written != f.upload.length {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func (f *davFile) Readdir(count int) ([]fs.FileInfo, error) {
+	if count <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	if count > len(f.entries) {
+		count = len(f.entries)
+	}
+	entries := f.entries[:count]
+	f.entries = f.entries[count:]
+	return entries, nil
+}
+
+func (f *davFile) Stat() (fs.FileInfo, error) {
+	if f.writer != nil {
+		return &writtenFileInfo{name: f.path[strings.LastIndex(f.path, "/")+1:], size: f.written}, nil
+	}
+	return f.info, nil
+}
+
+// Close saves a written file, unless writing it was cut short, in which case
+// whatever was there before is kept.
+func (f *davFile) Close() error {
+	if f.writer != nil {
+		if err := f.incomplete(); err != nil {
+			f.writer.Abort()
+			return err
+		}
+		return f.writer.Close()
+	} else if f.reader != nil {
+		return f.reader.Close()
+	}
+	return nil
+}
+
+// writtenFileInfo describes a file that is still being written and so can't
+// be looked up in the volume yet.
+type writtenFileInfo struct {
+	name string
+	size int64
+}
+
+func (i *writtenFileInfo) Name() string       { return i.name }
+func (i *writtenFileInfo) Size() int64        { return i.size }
+func (i *writtenFileInfo) Mode() fs.FileMode  { return 0644 }
+func (i *writtenFileInfo) ModTime() time.Time { return time.Now() }
+func (i *writtenFileInfo) IsDir() bool        { return false }
+func (i *writtenFileInfo) Sys() any           { return nil }
+
+// newDavLockSystems makes the lock system of every volume, they outlive the
+// handlers made for each request.
+func newDavLockSystems(fileStore *FileStore) map[string]webdav.LockSystem {
+	locks := map[string]webdav.LockSystem{}
+	for name := range fileStore.Volumes {
+		locks[name] = webdav.NewMemLS()
+	}
+	return locks
+}
+
+func davLogger(r *http.Request, err error) {
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("webdav %s %s: %v", r.Method, r.URL.Path, err)
+	}
+}
+
+// davAuditAction is the audit action of a WebDAV method. Reads of contents
+// are audited like downloads through the browser, while the metadata and lock
+// requests clients make all the time aren't audited at all.
+var davAuditAction = map[string]string{
+	http.MethodGet:    "download",
+	http.MethodPut:    "upload",
+	http.MethodDelete: "delete",
+	"MKCOL":           "mkdir",
+	"COPY":            "copy",
+	"MOVE":            "move",
+}
+
+// davAudit records what a WebDAV request did once the handler is done with
+// it, copies and moves with where they went.
+func davAudit(volume *Volume, auth Authorization, path string) func(*http.Request, error) {
+	return func(r *http.Request, err error) {
+		davLogger(r, err)
+
+		action, ok := davAuditAction[r.Method]
+		if !ok {
+			return
+		}
+
+		if action == "delete" && volume.HasFeature("trash") {
+			action = "trash"
+		}
+
+		event := AuditEvent{Action: action, Volume: volume.Name, Path: path}
+		if action == "copy" || action == "move" {
+			event.Detail, _ = davDestination(r, volume.Name)
+		}
+		if errors.Is(err, fs.ErrPermission) {
+			event.Result = AuditDenied
+		} else if err != nil {
+			event.Result, event.Detail = AuditFailure, err.Error()
+		}
+		RecordAudit(r, auth, event)
+	}
+}
+
+// davPermission is what a WebDAV method needs on the path it is for, methods
+// that aren't listed here change something.
+var davPermission = map[string]Permission{
+	http.MethodGet:     PermissionRead,
+	http.MethodHead:    PermissionRead,
+	http.MethodOptions: PermissionRead,
+	"PROPFIND":         PermissionList,
+}
+
+// davVolumePath is the path within the volume that webdav serves for the
+// unescaped urlPath, the same way the handler strips its prefix and cleans
+// what is left.
+func davVolumePath(urlPath string, volumeName string) (string, bool) {
+	rest, ok := strings.CutPrefix(urlPath, fmt.Sprintf("/dav/%s", volumeName))
+	if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+		return "", false
+	}
+	return davPath(rest), true
+}
+
+// davDestination is the path within the volume a COPY or MOVE goes to.
+func davDestination(r *http.Request, volumeName string) (string, bool) {
+	u, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil {
+		return "", false
+	}
+	return davVolumePath(u.Path, volumeName)
+}
+
+func (h *HTTPService) routeDav(w http.ResponseWriter, r *http.Request) {
+	auth := h.authStore.CheckBasic(r)
+	if auth == nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="files"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	permission, ok := davPermission[r.Method]
+	if !ok {
+		permission = PermissionWrite
+	}
+
+	// the route parameter is still escaped, webdav serves the unescaped path
+	volumeName := chi.URLParam(r, "volumeName")
+	volume, ok := h.fileStore.Volumes[volumeName]
+	locks, hasLocks := h.davLocks[volumeName]
+	path, inVolume := davVolumePath(r.URL.Path, volumeName)
+	if !ok || !hasLocks || !inVolume {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	audit := davAudit(volume, auth, path)
+	if !auth.CanAccess(volume, path, permission) {
+		audit(r, os.ErrPermission)
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == "COPY" || r.Method == "MOVE" {
+		destination, ok := davDestination(r, volumeName)
+		if !ok || !auth.CanAccess(volume, destination, PermissionWrite) {
+			audit(r, os.ErrPermission)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
+	handler := &webdav.Handler{
+		Prefix:     fmt.Sprintf("/dav/%s", volumeName),
+		FileSystem: newDavFileSystem(volume, auth, r),
+		LockSystem: locks,
+		Logger:     audit,
+	}
+	handler.ServeHTTP(w, r)
+}
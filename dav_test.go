@@ -0,0 +1,134 @@
+package files
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/webdav"
+	"gorm.io/datatypes"
+)
+
+// failingBody hands out data and then fails, like a connection dropping in
+// the middle of an upload.
+type failingBody struct {
+	data string
+}
+
+func (b *failingBody) Read(p []byte) (int, error) {
+	if b.data == "" {
+		return 0, errors.New("connection reset")
+	}
+	n := copy(p, b.data)
+	b.data = b.data[n:]
+	return n, nil
+}
+
+func (b *failingBody) Close() error {
+	return nil
+}
+
+func newTestDavVolume(t *testing.T) (*Volume, string) {
+	t.Helper()
+
+	root := t.TempDir()
+	volume := &Volume{
+		Name:           "v",
+		Backend:        NewLocalBackend(root),
+		ConflictPolicy: ConflictOverwrite,
+		Features:       map[string]struct{}{"upload": {}},
+	}
+	return volume, root
+}
+
+func davPut(t *testing.T, volume *Volume, name string, body io.ReadCloser, length int64) *httptest.ResponseRecorder {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodPut, "/dav/v/"+name, nil)
+	r.Body, r.ContentLength = body, length
+
+	auth := NewAPIKeyAuthorization(&APIKey{Config: datatypes.NewJSONType(APIKeyConfig{Volumes: []string{"v"}})})
+	handler := &webdav.Handler{
+		Prefix:     "/dav/v",
+		FileSystem: newDavFileSystem(volume, auth, r),
+		LockSystem: webdav.NewMemLS(),
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestDavPut(t *testing.T) {
+	cases := []struct {
+		name     string
+		body     io.ReadCloser
+		length   int64
+		complete bool
+	}{
+		{"complete", io.NopCloser(strings.NewReader("replaced")), 8, true},
+		{"complete without length", io.NopCloser(strings.NewReader("replaced")), -1, true},
+		{"body fails", &failingBody{data: "repl"}, 8, false},
+		{"body fails without length", &failingBody{data: "repl"}, -1, false},
+		{"body shorter than length", io.NopCloser(strings.NewReader("repl")), 8, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			volume, root := newTestDavVolume(t)
+			err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("original"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := davPut(t, volume, "a.txt", c.body, c.length)
+			if c.complete && w.Code >= 300 {
+				t.Fatalf("status = %d, want success", w.Code)
+			} else if !c.complete && w.Code < 300 {
+				t.Fatalf("status = %d, want an error", w.Code)
+			}
+
+			data, err := os.ReadFile(filepath.Join(root, "a.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := "original"
+			if c.complete {
+				want = "replaced"
+			}
+			if string(data) != want {
+				t.Errorf("a.txt = %q, want %q", data, want)
+			}
+
+			entries, err := os.ReadDir(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				t.Errorf("volume has %d entries after the upload, want only a.txt", len(entries))
+			}
+		})
+	}
+}
+
+func TestDavPutInterruptedNewFile(t *testing.T) {
+	volume, root := newTestDavVolume(t)
+
+	w := davPut(t, volume, "new.txt", &failingBody{data: "partial"}, 100)
+	if w.Code < 300 {
+		t.Fatalf("status = %d, want an error", w.Code)
+	}
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("interrupted upload left %s behind", entry.Name())
+	}
+}
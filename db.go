@@ -2,13 +2,9 @@ package files
 
 import (
 	"errors"
-	"fmt"
 	"net/http"
-	"time"
 
 	"github.com/alioygur/gores"
-	"github.com/sqids/sqids-go"
-	"gorm.io/datatypes"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
@@ -22,112 +18,71 @@ func OpenDatabase(path string) error {
 	}
 	db = it
 
+	err = migrateLegacyAPIKeys()
+	if err != nil {
+		return err
+	}
+
 	err = db.AutoMigrate(
 		&APIKey{},
 		&ShareCode{},
+		&ShareCodeAccess{},
+		&TusUpload{},
+		&TrashItem{},
+		&UserToken{},
+		&OIDCUser{},
+		&LocalUser{},
+		&AuditEvent{},
 	)
 	if err != nil {
 		return err
 
 	}
 
-	return nil
-}
-
-func ErrorResponse(w http.ResponseWriter, err error) {
-	if errors.Is(err, gorm.ErrRecordNotFound) {
-		gores.Error(w, http.StatusNotFound, "not found")
-		return
+	err = migrateUserTokenIds()
+	if err != nil {
+		return err
 	}
 
-	gores.Error(w, http.StatusInternalServerError, "something went wrong")
-}
-
-type APIKeyConfig struct {
-	Volumes []string `json:"volumes"`
-}
-
-type APIKey struct {
-	Key    string                           `json:"key" gorm:"primaryKey"`
-	Config datatypes.JSONType[APIKeyConfig] `json:"config"`
-}
-
-type ShareCode struct {
-	Id        uint      `json:"id" gorm:"primaryKey"`
-	Volume    string    `json:"volume"`
-	Path      string    `json:"path"`
-	ExpiresAt time.Time `json:"expires_at"`
-}
-
-var sqid *sqids.Sqids
-
-func init() {
-	it, err := sqids.New()
+	err = migrateUnscopedAPIKeys()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	sqid = it
-}
 
-func (s *ShareCode) Code() string {
-	id, _ := sqid.Encode([]uint64{uint64(s.Id)})
-	return id
+	return nil
 }
 
-func (s *ShareCode) URL(httpConfig *HTTPConfig) string {
-	url := httpConfig.BaseShareURL()
-	if url != "" {
-		url = fmt.Sprintf(url, s.Code())
-	} else {
-		url = fmt.Sprintf("%s/s/%s?raw", httpConfig.BaseURL(), s.Code())
-	}
-	return url
+// StatusError is an error that maps onto an HTTP status. Logic shared between
+// pages and the API returns it so each can report it in its own format.
+type StatusError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
 }
 
-func MakeShareCode(volume, path string) (*ShareCode, error) {
-	var existing ShareCode
-	err := db.First(&existing, "volume = ? AND path = ?", volume, path).Error
-	if err != nil {
-		if !errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, err
-		}
-	} else {
-		return &existing, nil
-	}
-
-	shareCode := &ShareCode{
-		Volume:    volume,
-		Path:      path,
-		ExpiresAt: time.Now().Add(time.Hour * 24 * 365 * 100),
-	}
-
-	err = db.Create(shareCode).Error
-	if err != nil {
-		return nil, err
-	}
-
-	return shareCode, nil
+func NewStatusError(status int, message string) *StatusError {
+	return &StatusError{Status: status, Message: message}
 }
 
-func GetShareCode(code string) (*ShareCode, error) {
-	id := sqid.Decode(code)
-	if len(id) != 1 {
-		return nil, errors.New("invalid share code")
-	}
+func (e *StatusError) Error() string {
+	return e.Message
+}
 
-	var shareCode ShareCode
-	err := db.Take(&shareCode, "id = ?", id[0]).Error
-	if err != nil {
-		return nil, err
+// statusErrorResponse writes err as a plain text error, falling back to
+// ErrorResponse for errors that aren't a StatusError.
+func statusErrorResponse(w http.ResponseWriter, err error) {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		gores.Error(w, statusErr.Status, statusErr.Message)
+		return
 	}
-
-	return &shareCode, nil
+	ErrorResponse(w, err)
 }
 
-func GetAPIKey(key string) (*APIKey, error) {
-	var apikey APIKey
-	if err := db.Take(&apikey, "key = ?", key).Error; err != nil {
-		return nil, err
+func ErrorResponse(w http.ResponseWriter, err error) {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		gores.Error(w, http.StatusNotFound, "not found")
+		return
 	}
-	return &apikey, nil
+
+	gores.Error(w, http.StatusInternalServerError, "something went wrong")
 }
@@ -11,12 +11,10 @@ import (
 	"time"
 
 	"github.com/alioygur/gores"
-	"github.com/bwmarrin/discordgo"
 	"golang.org/x/oauth2"
 )
 
 var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
-var discord *discordgo.Session
 
 // Return a random character sequence of n length
 func randSeq(n int) string {
@@ -44,19 +42,6 @@ type DiscordUser struct {
 	Verified      bool   `json:"verified"`
 }
 
-func (h *HTTPService) discordGetLogoutRoute(w http.ResponseWriter, r *http.Request) {
-	session := h.authStore.GetSession(r)
-	if session == nil {
-		gores.Error(w, http.StatusBadRequest, "invalid session")
-		return
-	}
-
-	session.Values["discord-user-id"] = nil
-	session.Values["discord-state"] = nil
-	session.Save(r, w)
-	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
-}
-
 func (h *HTTPService) discordGetLoginRoute(w http.ResponseWriter, r *http.Request) {
 	session := h.authStore.GetSession(r)
 	if session == nil {
@@ -93,6 +78,7 @@ func (h *HTTPService) discordGetLoginCallbackRoute(w http.ResponseWriter, r *htt
 
 	errorMessage := r.FormValue("error")
 	if errorMessage != "" {
+		RecordAudit(r, nil, AuditEvent{Actor: ProviderDiscord, Action: "login", Result: AuditFailure, Detail: errorMessage})
 		gores.Error(w, http.StatusBadRequest, fmt.Sprintf("Error: %v", errorMessage))
 		return
 	}
@@ -138,23 +124,19 @@ func (h *HTTPService) discordGetLoginCallbackRoute(w http.ResponseWriter, r *htt
 		return
 	}
 
-	session.Values["discord-user-id"] = discordUser.ID
+	session.Values["user-id"] = ProviderDiscord + ":" + discordUser.ID
+	session.Values["discord-user-id"] = nil
 	session.Values["discord-state"] = nil
 	err = session.Save(r, w)
 	if err != nil {
 		panic(err)
 	}
+	RecordAudit(r, nil, AuditEvent{Actor: ProviderDiscord + ":" + discordUser.ID, Action: "login"})
 
 	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 }
 
 func setupDiscord(config *DiscordConfig, baseURL string) {
-	s, err := discordgo.New(config.Token)
-	if err != nil {
-		panic(err)
-	}
-	discord = s
-
 	cachedConfig = &oauth2.Config{
 		ClientID:     config.ClientId,
 		ClientSecret: config.ClientSecret,
@@ -1,34 +1,61 @@
 package files
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"io/fs"
 	"mime"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
-	securejoin "github.com/cyphar/filepath-securejoin"
 	"github.com/dustin/go-humanize"
 )
 
+// stagingDir is where data is kept while it is being uploaded to a volume, it
+// lives inside the volume so finished files can be renamed into place.
+const stagingDir = ".staging"
+
+// trashDir is where deleted entries are kept on volumes with the trash
+// feature until they are restored or purged.
+const trashDir = ".trash"
+
+// isInternalPath reports whether path belongs to one of the areas the server
+// keeps inside a volume for itself, those are never listed or served.
+func isInternalPath(path string) bool {
+	path = cleanSharePath(path)
+	first, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	return first == stagingDir || first == trashDir || strings.HasPrefix(filepath.Base(path), tempFilePrefix)
+}
+
+// Conflict policies decide what happens when a file is written to a path that
+// already exists.
+const (
+	ConflictOverwrite = "overwrite"
+	ConflictRename    = "rename"
+	ConflictReject    = "reject"
+)
+
+var ErrFileExists = errors.New("a file with that name already exists")
+
 type FileStore struct {
 	Volumes map[string]*Volume
 }
 
-func NewFileStore(config *Config) *FileStore {
+func NewFileStore(config *Config) (*FileStore, error) {
 	volumes := map[string]*Volume{}
 	for _, volume := range config.Volumes {
+		backend, err := NewBackend(&volume)
+		if err != nil {
+			return nil, err
+		}
 
-		userIds := make(map[string]struct{})
+		roles := make(map[string]struct{})
 		for _, roleName := range volume.Roles {
-			for _, role := range config.Roles {
-				if role.Name == roleName {
-					for _, userId := range role.UserIds {
-						userIds[userId] = struct{}{}
-					}
-				}
-			}
+			roles[roleName] = struct{}{}
 		}
 
 		features := make(map[string]struct{})
@@ -40,18 +67,73 @@ func NewFileStore(config *Config) *FileStore {
 			volume.Privacy = "private"
 		}
 
+		var trashRetention time.Duration
+		switch volume.TrashRetention {
+		case "":
+			trashRetention = defaultTrashRetention
+		case "never":
+		default:
+			trashRetention, err = ParseDuration(volume.TrashRetention)
+			if err != nil {
+				return nil, fmt.Errorf("volume '%s' has invalid trash_retention: %v", volume.Name, err)
+			}
+		}
+
+		switch volume.ConflictPolicy {
+		case "":
+			volume.ConflictPolicy = ConflictOverwrite
+		case ConflictOverwrite, ConflictRename, ConflictReject:
+		default:
+			return nil, fmt.Errorf("volume '%s' has unknown conflict_policy '%s'", volume.Name, volume.ConflictPolicy)
+		}
+
+		var shareTTL, maxShareTTL time.Duration
+		if volume.ShareTTL != "" {
+			shareTTL, err = ParseDuration(volume.ShareTTL)
+			if err != nil {
+				return nil, fmt.Errorf("volume '%s' has invalid share_ttl: %v", volume.Name, err)
+			}
+		}
+		if volume.MaxShareTTL != "" {
+			maxShareTTL, err = ParseDuration(volume.MaxShareTTL)
+			if err != nil {
+				return nil, fmt.Errorf("volume '%s' has invalid max_share_ttl: %v", volume.Name, err)
+			}
+		}
+
+		var acl []ACLRule
+		for _, it := range volume.ACL {
+			rule, err := NewACLRule(it)
+			if err != nil {
+				return nil, fmt.Errorf("volume '%s' has invalid acl: %v", volume.Name, err)
+			}
+			for _, role := range rule.Roles {
+				if !config.HasRole(role) {
+					return nil, fmt.Errorf("volume '%s' has an acl for unknown role '%s'", volume.Name, role)
+				}
+			}
+			acl = append(acl, rule)
+		}
+
 		volumes[volume.Name] = &Volume{
 			Name:     volume.Name,
-			Path:     volume.Path,
+			Backend:  backend,
 			Privacy:  volume.Privacy,
 			Features: features,
-			UserIds:  userIds,
+			Roles:    roles,
+			ACL:      acl,
+
+			ConflictPolicy: volume.ConflictPolicy,
+			TrashRetention: trashRetention,
+
+			ShareTTL:    shareTTL,
+			MaxShareTTL: maxShareTTL,
 		}
 	}
 
 	return &FileStore{
 		Volumes: volumes,
-	}
+	}, nil
 }
 
 func (f *FileStore) GetVolume(name string) *Volume {
@@ -60,16 +142,39 @@ func (f *FileStore) GetVolume(name string) *Volume {
 
 type Volume struct {
 	Name    string
-	Path    string
 	Privacy string
+	Backend Backend
 
 	Features map[string]struct{}
-	UserIds  map[string]struct{}
+	// Roles are the names of the roles that can access the volume.
+	Roles map[string]struct{}
+	// ACL narrows down what roles can do on some paths, in the order the
+	// rules were configured.
+	ACL []ACLRule
+
+	// ConflictPolicy is one of the Conflict constants.
+	ConflictPolicy string
+	// TrashRetention is how long deleted entries stay in the trash, zero
+	// keeps them until they are deleted by hand.
+	TrashRetention time.Duration
+
+	ShareTTL    time.Duration
+	MaxShareTTL time.Duration
+
+	// writing holds the paths WriteFile is still writing to, so concurrent
+	// writes under the reject and rename policies settle on different names.
+	writingLock sync.Mutex
+	writing     map[string]struct{}
 }
 
-func (v *Volume) HasUserId(userId string) bool {
-	_, ok := v.UserIds[userId]
-	return ok
+// HasRole reports whether one of the named roles gives access to the volume.
+func (v *Volume) HasRole(roles []string) bool {
+	for _, role := range roles {
+		if _, ok := v.Roles[role]; ok {
+			return true
+		}
+	}
+	return false
 }
 
 func (v *Volume) HasFeature(feature string) bool {
@@ -77,66 +182,203 @@ func (v *Volume) HasFeature(feature string) bool {
 	return ok
 }
 
-func (v *Volume) path(path string) (string, error) {
-	return securejoin.SecureJoin(v.Path, path)
-}
+// ShareLifetime resolves how long a new share code on this volume lives for,
+// given the lifetime requested by the user. An empty request falls back to the
+// volume default, "never" asks for a share that does not expire. A zero
+// duration is returned for shares that never expire.
+func (v *Volume) ShareLifetime(requested string) (time.Duration, error) {
+	ttl := v.ShareTTL
+	if requested == "never" {
+		ttl = 0
+	} else if requested != "" {
+		it, err := ParseDuration(requested)
+		if err != nil || it <= 0 {
+			return 0, fmt.Errorf("invalid share lifetime '%s'", requested)
+		}
+		ttl = it
+	}
 
-func (v *Volume) Stat(p string) (os.FileInfo, error) {
-	path, err := v.path(p)
-	if err != nil {
-		return nil, err
+	if v.MaxShareTTL > 0 && (ttl == 0 || ttl > v.MaxShareTTL) {
+		if requested != "" {
+			return 0, fmt.Errorf("share lifetime may not exceed %s", v.MaxShareTTL)
+		}
+		ttl = v.MaxShareTTL
 	}
-	return os.Stat(path)
+
+	return ttl, nil
+}
+
+func (v *Volume) Stat(p string) (fs.FileInfo, error) {
+	return v.Backend.Stat(p)
 }
 
 func (v *Volume) Data(p string) ([]byte, error) {
-	path, err := v.path(p)
+	f, err := v.Backend.Open(p)
 	if err != nil {
 		return nil, err
 	}
-	return os.ReadFile(path)
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func (v *Volume) Open(p string) (io.ReadSeekCloser, error) {
+	return v.Backend.Open(p)
+}
+
+func (v *Volume) MkdirAll(p string) error {
+	return v.Backend.MkdirAll(p)
+}
+
+func (v *Volume) Create(p string) (FileWriter, error) {
+	return v.Backend.Create(p)
 }
 
-func (v *Volume) Open(p string) (*os.File, error) {
-	path, err := v.path(p)
+// ResolveConflict picks the path a new file meant for p is written to under
+// the given conflict policy. With the rename policy a free name is found by
+// adding a numbered suffix, with reject ErrFileExists is returned if p is
+// taken. Paths WriteFile is still writing to count as taken.
+func (v *Volume) ResolveConflict(p string, policy string) (string, error) {
+	v.writingLock.Lock()
+	defer v.writingLock.Unlock()
+	return v.resolveConflict(p, policy)
+}
+
+func (v *Volume) resolveConflict(p string, policy string) (string, error) {
+	taken, err := v.taken(p)
 	if err != nil {
-		return nil, err
+		return "", err
+	} else if !taken {
+		return p, nil
 	}
-	return os.Open(path)
+
+	switch policy {
+	case ConflictOverwrite:
+		return p, nil
+	case ConflictRename:
+		ext := filepath.Ext(p)
+		base := strings.TrimSuffix(p, ext)
+		for i := 1; i < 1000; i++ {
+			candidate := fmt.Sprintf("%s (%d)%s", base, i, ext)
+			taken, err := v.taken(candidate)
+			if err != nil {
+				return "", err
+			} else if !taken {
+				return candidate, nil
+			}
+		}
+	}
+
+	return "", ErrFileExists
 }
 
-func (v *Volume) OpenFile(p string, flag int, mode os.FileMode) (*os.File, error) {
-	path, err := v.path(p)
+func (v *Volume) taken(p string) (bool, error) {
+	if _, ok := v.writing[p]; ok {
+		return true, nil
+	}
+
+	_, err := v.Backend.Stat(p)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// reserve settles the path a new file meant for p goes to under policy and
+// holds it until release is called, so nothing else picks the same one in the
+// meantime. Overwrites don't need to hold anything.
+func (v *Volume) reserve(p string, policy string) (string, func(), error) {
+	v.writingLock.Lock()
+	defer v.writingLock.Unlock()
+
+	p, err := v.resolveConflict(p, policy)
 	if err != nil {
-		return nil, err
+		return "", nil, err
+	} else if policy == ConflictOverwrite {
+		return p, func() {}, nil
 	}
-	return os.OpenFile(path, flag, mode)
+
+	if v.writing == nil {
+		v.writing = map[string]struct{}{}
+	}
+	v.writing[p] = struct{}{}
+	return p, func() {
+		v.writingLock.Lock()
+		delete(v.writing, p)
+		v.writingLock.Unlock()
+	}, nil
 }
 
-func (v *Volume) MkdirAll(p string, perm fs.FileMode) error {
-	path, err := v.path(p)
+// WriteFile writes everything from src to p, or to wherever the conflict
+// policy sends it, returning the path that was written. The file only shows
+// up once it was written completely. The path is settled before writing and
+// held until the file shows up, so concurrent writes never pick the same one
+// unless the policy is to overwrite.
+func (v *Volume) WriteFile(p string, src io.Reader, policy string) (string, int64, error) {
+	if isInternalPath(p) {
+		return "", 0, &fs.PathError{Op: "write", Path: p, Err: fs.ErrInvalid}
+	}
+
+	p, release, err := v.reserve(p, policy)
+	if err != nil {
+		return "", 0, err
+	}
+	defer release()
+
+	f, err := v.Backend.Create(p)
+	if err != nil {
+		return "", 0, err
+	}
+
+	n, err := io.Copy(f, src)
+	if err != nil {
+		f.Abort()
+		return "", 0, err
+	}
+
+	err = f.Close()
 	if err != nil {
-		return err
+		return "", 0, err
 	}
-	return os.MkdirAll(path, perm)
+	return p, n, nil
 }
 
-func (v *Volume) Create(p string) (*os.File, error) {
-	path, err := v.path(p)
+// PlaceFile moves the complete file at from to p, or to wherever the conflict
+// policy sends it, returning the path it ended up at. The path is settled the
+// same way as for WriteFile, so the two never pick the same one.
+func (v *Volume) PlaceFile(from string, p string, policy string) (string, error) {
+	if isInternalPath(p) {
+		return "", &fs.PathError{Op: "place", Path: p, Err: fs.ErrInvalid}
+	}
+
+	p, release, err := v.reserve(p, policy)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	return os.Create(path)
+	defer release()
+
+	return p, v.Backend.Rename(from, p)
+}
+
+func (v *Volume) Append(p string) (io.WriteCloser, error) {
+	return v.Backend.Append(p)
+}
+
+func (v *Volume) Rename(from, to string) error {
+	return v.Backend.Rename(from, to)
+}
+
+func (v *Volume) Remove(p string) error {
+	return v.Backend.Remove(p)
 }
 
 type VolumeEntry struct {
-	Name      string
-	Path      string
-	Size      int64
-	HumanSize string
-	IsDir     bool
-	Type      string
-	ModTime   time.Time
+	Name      string    `json:"name"`
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	HumanSize string    `json:"human_size"`
+	IsDir     bool      `json:"is_dir"`
+	Type      string    `json:"type"`
+	ModTime   time.Time `json:"mod_time"`
 }
 
 func NewVolumeEntryFromStat(path string, info fs.FileInfo) *VolumeEntry {
@@ -158,24 +400,17 @@ func (e *VolumeEntry) HasTag(tag string) bool {
 	return hasMediaTag(e.Type, tag)
 }
 
-func (v *Volume) WalkDir(p string, fn func(string, fs.DirEntry, error) error) error {
-	root, err := v.path(p)
-	if err != nil {
-		return err
-	}
-
-	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
-		return fn(filepath.Join(p, strings.TrimPrefix(path, root)), d, err)
+func (v *Volume) WalkDir(p string, fn fs.WalkDirFunc) error {
+	return v.Backend.WalkDir(p, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() && isInternalPath(path) {
+			return fs.SkipDir
+		}
+		return fn(path, d, err)
 	})
 }
 
 func (v *Volume) Entry(path string) (*VolumeEntry, error) {
-	p, err := v.path(path)
-	if err != nil {
-		return nil, err
-	}
-
-	info, err := os.Stat(p)
+	info, err := v.Backend.Stat(path)
 	if err != nil {
 		return nil, err
 	}
@@ -184,24 +419,18 @@ func (v *Volume) Entry(path string) (*VolumeEntry, error) {
 }
 
 func (v *Volume) Entries(path string) ([]*VolumeEntry, error) {
-	vpath, err := v.path(path)
-	if err != nil {
-		return nil, err
-	}
-
-	entries, err := os.ReadDir(vpath)
+	infos, err := v.Backend.ReadDir(path)
 	if err != nil {
 		return nil, err
 	}
 
 	result := []*VolumeEntry{}
-	for _, e := range entries {
-		info, err := e.Info()
-		if err != nil {
-			return nil, err
+	for _, info := range infos {
+		entryPath := filepath.Join(path, info.Name())
+		if isInternalPath(entryPath) {
+			continue
 		}
-
-		result = append(result, NewVolumeEntryFromStat(filepath.Join(path, info.Name()), info))
+		result = append(result, NewVolumeEntryFromStat(entryPath, info))
 	}
 
 	return result, nil
@@ -0,0 +1,88 @@
+package files
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowRenameBackend widens the window between a path being picked and a file
+// showing up there.
+type slowRenameBackend struct {
+	Backend
+}
+
+func (b *slowRenameBackend) Rename(from, to string) error {
+	time.Sleep(10 * time.Millisecond)
+	return b.Backend.Rename(from, to)
+}
+
+func TestVolumePlaceFileConcurrent(t *testing.T) {
+	for _, policy := range []string{ConflictRename, ConflictReject} {
+		t.Run(policy, func(t *testing.T) {
+			root := t.TempDir()
+			volume := &Volume{Name: "v", Backend: &slowRenameBackend{NewLocalBackend(root)}}
+
+			const uploads = 16
+			for i := 0; i < uploads; i++ {
+				err := os.WriteFile(filepath.Join(root, fmt.Sprintf("staged-%d", i)), []byte(fmt.Sprint(i)), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var wg sync.WaitGroup
+			placed := make([]string, uploads)
+			errs := make([]error, uploads)
+			for i := 0; i < uploads; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					// half of them race regular writes for the same name
+					if i%2 == 0 {
+						placed[i], errs[i] = volume.PlaceFile(fmt.Sprintf("staged-%d", i), "a.txt", policy)
+					} else {
+						placed[i], _, errs[i] = volume.WriteFile("a.txt", strings.NewReader(fmt.Sprint(i)), policy)
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			seen := map[string]int{}
+			for i, p := range placed {
+				if errs[i] != nil {
+					if !errors.Is(errs[i], ErrFileExists) {
+						t.Fatalf("upload %d: %v", i, errs[i])
+					}
+					continue
+				}
+				if other, ok := seen[p]; ok {
+					t.Errorf("uploads %d and %d both ended up at %s", other, i, p)
+				}
+				seen[p] = i
+			}
+
+			want := uploads
+			if policy == ConflictReject {
+				want = 1
+			}
+			if len(seen) != want {
+				t.Errorf("%d uploads were kept, want %d", len(seen), want)
+			}
+			for p, i := range seen {
+				data, err := os.ReadFile(filepath.Join(root, p))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(data) != fmt.Sprint(i) {
+					t.Errorf("%s holds upload %s, want %d", p, data, i)
+				}
+			}
+		})
+	}
+}
@@ -13,30 +13,37 @@ require (
 	github.com/gorilla/sessions v1.4.0
 	github.com/hashicorp/hcl/v2 v2.22.0
 	github.com/lithammer/fuzzysearch v1.1.8
+	github.com/minio/minio-go/v7 v7.0.80
 	github.com/sqids/sqids-go v0.4.1
 	github.com/thejerf/suture/v4 v4.0.5
 	github.com/zclconf/go-cty v1.15.0
+	golang.org/x/crypto v0.28.0
+	golang.org/x/net v0.30.0
 	golang.org/x/oauth2 v0.23.0
 	gorm.io/datatypes v1.2.4
 	gorm.io/driver/sqlite v1.5.6
 	gorm.io/gorm v1.25.12
-
 )
 
 require (
 	filippo.io/edwards25519 v1.1.0 // indirect
 	github.com/agext/levenshtein v1.2.3 // indirect
 	github.com/apparentlymart/go-textseg/v15 v15.0.0 // indirect
+	github.com/go-ini/ini v1.67.0 // indirect
 	github.com/go-sql-driver/mysql v1.8.1 // indirect
+	github.com/goccy/go-json v0.10.3 // indirect
 	github.com/google/go-cmp v0.6.0 // indirect
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/gorilla/securecookie v1.1.2 // indirect
 	github.com/gorilla/websocket v1.5.3 // indirect
 	github.com/jinzhu/inflection v1.0.0 // indirect
 	github.com/jinzhu/now v1.1.5 // indirect
+	github.com/klauspost/compress v1.17.11 // indirect
+	github.com/klauspost/cpuid/v2 v2.2.8 // indirect
 	github.com/mattn/go-sqlite3 v1.14.24 // indirect
+	github.com/minio/md5-simd v1.1.2 // indirect
 	github.com/mitchellh/go-wordwrap v1.0.1 // indirect
-	golang.org/x/crypto v0.28.0 // indirect
+	github.com/rs/xid v1.6.0 // indirect
 	golang.org/x/mod v0.21.0 // indirect
 	golang.org/x/sync v0.8.0 // indirect
 	golang.org/x/sys v0.26.0 // indirect
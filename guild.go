@@ -0,0 +1,101 @@
+package files
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const defaultRoleCacheTTL = 5 * time.Minute
+
+type guildMember struct {
+	roleIds   []string
+	fetchedAt time.Time
+}
+
+// GuildRoles resolves the roles users hold in the discord guild through the
+// bot, so roles can grant access by discord role instead of listing users.
+// Lookups are cached and refreshed once they are older than the cache ttl.
+type GuildRoles struct {
+	session *discordgo.Session
+	guildId string
+	ttl     time.Duration
+
+	sync.Mutex
+	members map[string]guildMember
+}
+
+// NewGuildRoles returns nil when no role references discord roles, in which
+// case the guild is never asked about anyone.
+func NewGuildRoles(config *Config) (*GuildRoles, error) {
+	if config.Discord == nil || !config.UsesDiscordRoles() {
+		return nil, nil
+	}
+
+	token := config.Discord.Token
+	if !strings.HasPrefix(token, "Bot ") {
+		token = "Bot " + token
+	}
+	session, err := discordgo.New(token)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl, err := config.Discord.RoleCacheLifetime()
+	if err != nil {
+		return nil, err
+	}
+
+	return &GuildRoles{
+		session: session,
+		guildId: config.Discord.GuildId,
+		ttl:     ttl,
+		members: map[string]guildMember{},
+	}, nil
+}
+
+// MemberRoles returns the ids of the guild roles userId holds. When the guild
+// can't be reached the last known roles are kept, so an outage doesn't lock
+// everyone out.
+func (g *GuildRoles) MemberRoles(userId string) []string {
+	if g == nil {
+		return nil
+	}
+
+	g.Lock()
+	cached, ok := g.members[userId]
+	g.Unlock()
+	if ok && time.Since(cached.fetchedAt) < g.ttl {
+		return cached.roleIds
+	}
+
+	roleIds, err := g.fetch(userId)
+	if err != nil {
+		// keep what we had for another ttl instead of asking on every request
+		log.Printf("failed to fetch guild roles of %v: %v", userId, err)
+		roleIds = cached.roleIds
+	}
+
+	g.Lock()
+	g.members[userId] = guildMember{roleIds: roleIds, fetchedAt: time.Now()}
+	g.Unlock()
+	return roleIds
+}
+
+func (g *GuildRoles) fetch(userId string) ([]string, error) {
+	member, err := g.session.GuildMember(g.guildId, userId)
+	if err != nil {
+		// users that left the guild, or never joined it, hold no roles
+		var restErr *discordgo.RESTError
+		if errors.As(err, &restErr) && restErr.Response != nil && restErr.Response.StatusCode == http.StatusNotFound {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	return member.Roles, nil
+}
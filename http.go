@@ -6,9 +6,11 @@ import (
 	"context"
 	"fmt"
 	"html/template"
+	"io"
 	"io/fs"
 	"log"
 	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -21,6 +23,7 @@ import (
 	"github.com/dustin/go-humanize"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"golang.org/x/net/webdav"
 )
 
 var mediaTags = map[string][]string{
@@ -80,16 +83,31 @@ type HTTPService struct {
 	fileStore *FileStore
 	config    *Config
 	authStore *AuthStore
+	oidc      *OIDCProvider
+
+	rateLimiters map[string]*RateLimiter
+
+	davLocks map[string]webdav.LockSystem
 
 	done chan struct{}
 }
 
 func NewHTTPService(config *Config, fileStore *FileStore) *HTTPService {
+	var oidc *OIDCProvider
+	if config.OIDC != nil {
+		oidc = NewOIDCProvider(config.OIDC, config.HTTP.BaseURL())
+	}
+
 	return &HTTPService{
 		fileStore: fileStore,
 		config:    config,
 		authStore: NewAuthStore(fileStore, config),
-		done:      make(chan struct{}),
+		oidc:      oidc,
+
+		rateLimiters: newRateLimiters(config.HTTP),
+
+		davLocks: newDavLockSystems(fileStore),
+		done:     make(chan struct{}),
 	}
 }
 
@@ -102,32 +120,87 @@ func (h *HTTPService) router() http.Handler {
 	rtr.Use(middleware.RealIP)
 	rtr.Use(middleware.Logger)
 	rtr.Use(middleware.Recoverer)
+	rtr.Use(h.rateLimit)
+	rtr.Use(h.csrf)
 
 	rtr.Get("/", h.routeGetIndex)
 	rtr.Get("/token", h.routeGetToken)
+	rtr.Post("/token", h.routePostToken)
+	rtr.Delete("/token/{tokenId}", h.routeDeleteToken)
 	rtr.Get("/user", h.routeGetUser)
+	rtr.Get("/login", h.routeGetLogin)
+	rtr.Post("/login", h.routePostLogin)
+	rtr.Post("/login/totp", h.routePostLoginTOTP)
+	rtr.Get("/logout", h.routeGetLogout)
+	rtr.Get("/account", h.routeGetAccount)
+	rtr.Post("/account/password", h.routePostAccountPassword)
+	rtr.Post("/account/totp", h.routePostAccountTOTP)
+	rtr.Post("/account/totp/confirm", h.routePostAccountTOTPConfirm)
+	rtr.Post("/account/totp/disable", h.routePostAccountTOTPDisable)
+	rtr.Get("/users", h.routeGetUsers)
+	rtr.Post("/users", h.routePostUsers)
+	rtr.Post("/users/{username}/password", h.routePostUserPassword)
+	rtr.Post("/users/{username}/totp/reset", h.routePostUserTOTPReset)
+	rtr.Delete("/users/{username}", h.routeDeleteUser)
+	rtr.Get("/audit", h.routeGetAudit)
+	rtr.Get("/audit/export", h.routeGetAuditExport)
 
 	// discord stuff
 	if h.config.Discord != nil {
 		setupDiscord(h.config.Discord, h.config.HTTP.BaseURL())
-		rtr.Get("/discord/logout", h.discordGetLogoutRoute)
+		rtr.Get("/discord/logout", h.routeGetLogout)
 		rtr.Get("/discord/login", h.discordGetLoginRoute)
 		rtr.Get("/discord/login/callback", h.discordGetLoginCallbackRoute)
 	}
 
+	if h.oidc != nil {
+		rtr.Get("/oidc/login", h.oidcGetLoginRoute)
+		rtr.Get("/oidc/login/callback", h.oidcGetLoginCallbackRoute)
+	}
+
 	rtr.Get("/static/*", h.routeGetStatic)
+	rtr.Mount("/api/v1", h.apiRouter())
 
 	rtr.Get("/s/{shareCode}", h.routeGetShareCode)
+	rtr.Post("/s/{shareCode}", h.routePostShareCode)
+	rtr.Get("/r/{shareCode}", h.routeGetFileRequest)
+
+	rtr.Get("/shares", h.routeGetShares)
+	rtr.Delete("/shares/{shareId}", h.routeDeleteShare)
+	rtr.Post("/shares/{shareId}/expiry", h.routePostShareExpiry)
+
+	rtr.Get("/apikeys", h.routeGetAPIKeys)
+	rtr.Post("/apikeys", h.routePostAPIKeys)
+	rtr.Post("/apikeys/{keyId}/rotate", h.routePostAPIKeyRotate)
+	rtr.Delete("/apikeys/{keyId}", h.routeDeleteAPIKey)
 
 	rtr.Get("/volume/{volumeName}/upload", h.routeGetUpload)
 	rtr.Post("/volume/{volumeName}/upload", h.routePostUpload)
 
+	rtr.Options("/volume/{volumeName}/tus/", h.routeOptionsTus)
+	rtr.Post("/volume/{volumeName}/tus/", h.routePostTus)
+	rtr.Options("/volume/{volumeName}/tus/{uploadId}", h.routeOptionsTus)
+	rtr.Head("/volume/{volumeName}/tus/{uploadId}", h.routeHeadTus)
+	rtr.Patch("/volume/{volumeName}/tus/{uploadId}", h.routePatchTus)
+	rtr.Delete("/volume/{volumeName}/tus/{uploadId}", h.routeDeleteTus)
+
 	rtr.Get("/volume/{volumeName}/browse/*", h.routeGetVolume)
 	rtr.Post("/volume/{volumeName}/share/*", h.routePostShareVolume)
 	rtr.Post("/volume/{volumeName}/sharex", h.routePostSharex)
+	rtr.Post("/volume/{volumeName}/manage/delete", h.routePostManageDelete)
+	rtr.Post("/volume/{volumeName}/manage/rename", h.routePostManageRename)
+	rtr.Post("/volume/{volumeName}/manage/move", h.routePostManageMove)
+	rtr.Post("/volume/{volumeName}/manage/copy", h.routePostManageCopy)
+	rtr.Post("/volume/{volumeName}/manage/mkdir", h.routePostManageMkdir)
+	rtr.Get("/volume/{volumeName}/trash", h.routeGetTrash)
+	rtr.Post("/volume/{volumeName}/trash/{itemId}/restore", h.routePostTrashRestore)
+	rtr.Delete("/volume/{volumeName}/trash/{itemId}", h.routeDeleteTrashItem)
 	rtr.Get("/volume/{volumeName}/search", h.routeGetSearch)
 	rtr.Post("/volume/{volumeName}/search", h.routePostSearch)
 
+	rtr.Handle("/dav/{volumeName}", http.HandlerFunc(h.routeDav))
+	rtr.Handle("/dav/{volumeName}/*", http.HandlerFunc(h.routeDav))
+
 	return rtr
 }
 
@@ -154,7 +227,7 @@ func (h *HTTPService) routeGetIndex(w http.ResponseWriter, r *http.Request) {
 
 	volumes := []*Volume{}
 	for _, volume := range h.fileStore.Volumes {
-		if volume.Privacy == "public" || (auth != nil && auth.CanAccess(volume, "", false)) {
+		if volume.Privacy == "public" || (auth != nil && auth.CanAccess(volume, "", PermissionRead)) {
 			volumes = append(volumes, volume)
 		}
 	}
@@ -166,55 +239,66 @@ func (h *HTTPService) routeGetIndex(w http.ResponseWriter, r *http.Request) {
 		return ii.Name < jj.Name
 	})
 
-	h.template(w, "static/index.html", map[string]interface{}{
+	h.template(w, r, "static/index.html", map[string]interface{}{
 		"Volumes": volumes,
 	})
 }
 
-func (h *HTTPService) routeGetToken(w http.ResponseWriter, r *http.Request) {
-	auth := h.authStore.Check(r)
-
-	if auth == nil {
-		gores.Error(w, http.StatusUnauthorized, "unauthorized")
-		return
+// routeGetLogin sends users straight to the login provider when it is the
+// only way to log in, otherwise they pick one or use a local account.
+func (h *HTTPService) routeGetLogin(w http.ResponseWriter, r *http.Request) {
+	if !HasLocalUsers() {
+		if h.config.Discord != nil && h.oidc == nil {
+			http.Redirect(w, r, "/discord/login", http.StatusTemporaryRedirect)
+			return
+		} else if h.config.Discord == nil && h.oidc != nil {
+			http.Redirect(w, r, "/oidc/login", http.StatusTemporaryRedirect)
+			return
+		}
 	}
 
-	discordUserId := auth.DiscordUserId()
-	if discordUserId == "" {
-		gores.Error(w, http.StatusBadRequest, "can only generate tokens for user authentication")
+	h.loginPage(w, r, map[string]interface{}{})
+}
+
+func (h *HTTPService) routeGetLogout(w http.ResponseWriter, r *http.Request) {
+	session := h.authStore.GetSession(r)
+	if session == nil {
+		gores.Error(w, http.StatusBadRequest, "invalid session")
 		return
 	}
 
-	token := h.authStore.GenerateUserToken(discordUserId)
-	h.template(w, "static/token.html", token)
+	session.Values["user-id"] = nil
+	session.Values["discord-user-id"] = nil
+	session.Values["discord-state"] = nil
+	session.Values["oidc-state"] = nil
+	session.Values["oidc-nonce"] = nil
+	session.Values["oidc-verifier"] = nil
+	session.Values["local-pending-user"] = nil
+	session.Values["local-pending-at"] = nil
+	session.Values["totp-pending-secret"] = nil
+	session.Save(r, w)
+	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 }
 
 func (h *HTTPService) routeGetUser(w http.ResponseWriter, r *http.Request) {
 	auth := h.authStore.Check(r)
 
 	if auth == nil {
-		h.templateFragment(w, "user-topbar", "0")
-		return
-	}
-
-	h.templateFragment(w, "user-topbar", auth.DiscordUserId())
-}
-
-func (h *HTTPService) routeGetShareCode(w http.ResponseWriter, r *http.Request) {
-	shareCode, err := GetShareCode(chi.URLParam(r, "shareCode"))
-	if err != nil {
-		gores.Error(w, http.StatusNotFound, "not found")
+		h.templateFragment(w, r, "user-topbar", map[string]interface{}{
+			"UserId": "0",
+		})
 		return
 	}
 
-	v := r.URL.Query()
-	v.Set("sc", shareCode.Code())
-
-	http.Redirect(w, r, fmt.Sprintf("/volume/%s/browse/%s?%s", shareCode.Volume, shareCode.Path, v.Encode()), http.StatusTemporaryRedirect)
+	h.templateFragment(w, r, "user-topbar", map[string]interface{}{
+		"UserId":  auth.UserId(),
+		"IsAdmin": auth.IsAdmin(),
+		"IsLocal": strings.HasPrefix(auth.UserId(), ProviderLocal+":"),
+	})
 }
 
-func (h *HTTPService) routePostShareVolume(w http.ResponseWriter, r *http.Request) {
-	volume, _ := h.authStore.GetVolume(w, r, true)
+func (h *HTTPService) routeGetVolume(w http.ResponseWriter, r *http.Request) {
+	volume, auth := h.authStore.GetVolume(w, r, PermissionRead)
 	if volume == nil {
 		return
 	}
@@ -224,49 +308,60 @@ func (h *HTTPService) routePostShareVolume(w http.ResponseWriter, r *http.Reques
 		panic(err)
 	}
 
-	// make sure the path exists
-	_, err = volume.Stat(path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			gores.Error(w, http.StatusNotFound, "not found")
-			return
-		}
-
-		gores.Error(w, http.StatusInternalServerError, "failed to stat path")
+	if isInternalPath(path) {
+		gores.Error(w, http.StatusNotFound, "not found")
 		return
 	}
 
-	shareCode, err := MakeShareCode(volume.Name, path)
-	if err != nil {
-		gores.Error(w, http.StatusInternalServerError, "failed to generate share code")
-		return
-	}
+	canList := (volume.Privacy == "public" && volume.PublicAt(path)) || (auth != nil && auth.CanAccess(volume, path, PermissionList))
+	h.servePath(w, r, volume, path, canList, auth)
+}
 
-	url := shareCode.URL(h.config.HTTP)
-	h.templateFragment(w, "share-code", url)
-	return
+// isRangeContinuation reports whether a request picks up partway through a
+// file, like a media player seeking, rather than starting a new download. It
+// is only a claim of the client, share codes check it against the downloads
+// they counted.
+func isRangeContinuation(r *http.Request) bool {
+	rangeHeader := r.Header.Get("Range")
+	return rangeHeader != "" && !strings.HasPrefix(rangeHeader, "bytes=0-")
 }
 
-func (h *HTTPService) routeGetVolume(w http.ResponseWriter, r *http.Request) {
-	volume, auth := h.authStore.GetVolume(w, r, false)
-	if volume == nil {
-		return
-	}
+// servePathAction names what a request to servePath does for the audit log.
+func servePathAction(r *http.Request, isDir bool) string {
+	query := r.URL.Query()
+	switch {
+	case query.Get("hash") != "":
+		return "hash"
+	case query.Has("raw") || query.Has("download"):
+		return "download"
+	case isDir && query.Get("compress") != "":
+		return "zip"
+	case isDir:
+		return "list"
+	}
+	return "view"
+}
 
-	path, err := url.PathUnescape(chi.URLParam(r, "*"))
-	if err != nil {
-		panic(err)
+func (h *HTTPService) servePath(w http.ResponseWriter, r *http.Request, volume *Volume, path string, canList bool, auth Authorization) {
+	var shareCode *ShareCode
+	if it, ok := auth.(*ShareCodeAuthorization); ok {
+		shareCode = it.shareCode
 	}
 
-	// TODO: pass through sharecode
-	// shareCodeRaw := r.URL.Query().Get("sc")
-	h.servePath(w, r, volume, path, volume.Privacy != "unlisted" || auth != nil, nil)
-}
+	audit := func(isDir bool, result, detail string) {
+		RecordAudit(r, auth, AuditEvent{
+			Action: servePathAction(r, isDir),
+			Volume: volume.Name,
+			Path:   path,
+			Result: result,
+			Detail: detail,
+		})
+	}
 
-func (h *HTTPService) servePath(w http.ResponseWriter, r *http.Request, volume *Volume, path string, canList bool, shareCode *ShareCode) {
 	info, err := volume.Stat(path)
 	if err != nil {
 		if os.IsNotExist(err) {
+			audit(false, AuditFailure, "not found")
 			gores.Error(w, http.StatusNotFound, "not found")
 			return
 		}
@@ -277,12 +372,40 @@ func (h *HTTPService) servePath(w http.ResponseWriter, r *http.Request, volume *
 	}
 
 	if info.IsDir() && !canList {
+		audit(true, AuditDenied, "")
 		gores.Error(w, http.StatusNotFound, "not found")
 		return
 	}
 
+	download := r.URL.Query().Has("download")
+	raw := r.URL.Query().Has("raw")
+
+	compress := r.URL.Query().Get("compress")
+	if compress != "" && !volume.HasFeature("compress") {
+		gores.Error(w, http.StatusBadRequest, "compression is not available")
+		return
+	}
+
+	if shareCode != nil {
+		isDownload := !info.IsDir() && (raw || download)
+		isDownload = isDownload || (info.IsDir() && compress == "zip")
+
+		err = RecordShareCodeAccess(shareCode, r, path, isDownload)
+		if err != nil {
+			audit(info.IsDir(), AuditDenied, err.Error())
+			shareCodeError(w, err)
+			return
+		}
+	}
+
+	// previews and hashes read the file without it counting as a download
+	preview := shareCode == nil || !shareCode.LimitsDownloads()
+
 	hash := r.URL.Query().Get("hash")
-	if hash != "" && info.IsDir() {
+	if hash != "" && !preview {
+		gores.Error(w, http.StatusForbidden, "hashes aren't available for shares with a download limit")
+		return
+	} else if hash != "" && info.IsDir() {
 		gores.Error(w, http.StatusBadRequest, "cannot hash directory")
 		return
 	} else if hash == "sha256" {
@@ -291,6 +414,7 @@ func (h *HTTPService) servePath(w http.ResponseWriter, r *http.Request, volume *
 			gores.Error(w, http.StatusInternalServerError, "failed to hash file")
 			return
 		}
+		audit(false, AuditSuccess, "sha256")
 		gores.String(w, http.StatusOK, hashContents)
 		return
 	} else if hash != "" {
@@ -298,9 +422,6 @@ func (h *HTTPService) servePath(w http.ResponseWriter, r *http.Request, volume *
 		return
 	}
 
-	download := r.URL.Query().Has("download")
-	raw := r.URL.Query().Has("raw")
-
 	if raw || download {
 		if info.IsDir() {
 			gores.Error(w, http.StatusBadRequest, "cannot view or download directory")
@@ -313,6 +434,11 @@ func (h *HTTPService) servePath(w http.ResponseWriter, r *http.Request, volume *
 			return
 		}
 		defer f.Close()
+
+		// seeking through media is part of the download it started with
+		if !isRangeContinuation(r) {
+			audit(false, AuditSuccess, "")
+		}
 		if download {
 			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", info.Name()))
 		}
@@ -320,12 +446,6 @@ func (h *HTTPService) servePath(w http.ResponseWriter, r *http.Request, volume *
 		return
 	}
 
-	compress := r.URL.Query().Get("compress")
-	if compress != "" && !volume.HasFeature("compress") {
-		gores.Error(w, http.StatusBadRequest, "compression is not available")
-		return
-	}
-
 	var entries []*VolumeEntry
 	var mimetype string
 	var content string
@@ -333,25 +453,36 @@ func (h *HTTPService) servePath(w http.ResponseWriter, r *http.Request, volume *
 	if info.IsDir() {
 		switch compress {
 		case "zip":
+			audit(true, AuditSuccess, "")
 			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.zip\"", filepath.Base(path)))
 
 			zw := zip.NewWriter(w)
 			err := volume.WalkDir(path, func(s string, de fs.DirEntry, err error) error {
-				if de.IsDir() {
+				if err != nil {
+					return err
+				}
+
+				if de.IsDir() || !volume.Visible(auth, s, false) {
 					return nil
 				}
 
-				f, err := zw.Create(strings.TrimPrefix(s, path+"/"))
+				name, err := filepath.Rel(path, s)
+				if err != nil {
+					return err
+				}
+
+				f, err := zw.Create(name)
 				if err != nil {
 					return err
 				}
 
-				data, err := volume.Data(s)
+				src, err := volume.Open(s)
 				if err != nil {
 					return err
 				}
+				defer src.Close()
 
-				_, err = f.Write(data)
+				_, err = io.Copy(f, src)
 				if err != nil {
 					return err
 				}
@@ -381,6 +512,8 @@ func (h *HTTPService) servePath(w http.ResponseWriter, r *http.Request, volume *
 			gores.Error(w, http.StatusInternalServerError, "failed to list directory")
 			return
 		}
+		entries = volume.FilterVisible(auth, entries)
+		audit(true, AuditSuccess, "")
 
 		sortDir := r.URL.Query().Get("sort-dir")
 		sortBy := r.URL.Query().Get("sort-by")
@@ -424,10 +557,12 @@ func (h *HTTPService) servePath(w http.ResponseWriter, r *http.Request, volume *
 			entries = entries[:1000]
 		}
 	} else {
+		audit(false, AuditSuccess, "")
+
 		mtraw := mime.TypeByExtension(filepath.Ext(path))
 		mimetype, _, err = mime.ParseMediaType(mtraw)
 		if err == nil {
-			if hasMediaTag(mimetype, "text") && ByteSize(info.Size()) < 8*MB {
+			if preview && hasMediaTag(mimetype, "text") && ByteSize(info.Size()) < 8*MB {
 				data, err := volume.Data(path)
 				if err == nil {
 					content = string(data)
@@ -439,16 +574,28 @@ func (h *HTTPService) servePath(w http.ResponseWriter, r *http.Request, volume *
 	args := url.Values{}
 
 	if shareCode != nil {
-		args.Add("sc", shareCode.Code())
+		args.Add("sc", shareCode.Code)
 	}
 
-	link := fmt.Sprintf("/volume/%s/browse/%s?%s", volume.Name, path, args.Encode())
+	// links carry the share code along so shared directories can be browsed
+	linkTo := func(path string, extra ...string) string {
+		link := fmt.Sprintf("/volume/%s/browse/%s?%s", volume.Name, path, args.Encode())
+		if len(extra) > 0 {
+			return fmt.Sprintf("%s&%s", link, strings.Join(extra, "&"))
+		}
+		return link
+	}
 
 	template := "static/volume.html"
 
-	h.template(w, template, map[string]interface{}{
-		"Gallery":   r.URL.Query().Has("gallery") && info.IsDir(),
+	canWrite := auth != nil && auth.CanAccess(volume, path, PermissionWrite)
+	h.template(w, r, template, map[string]interface{}{
+		"Gallery":   r.URL.Query().Has("gallery") && info.IsDir() && preview,
+		"Preview":   preview,
 		"Volume":    volume,
+		"CanShare":  auth != nil && auth.CanAccess(volume, path, PermissionShare),
+		"CanWrite":  canWrite,
+		"CanManage": canWrite && volume.HasFeature("manage"),
 		"Path":      path,
 		"Dir":       filepath.Dir(path),
 		"Stat":      info,
@@ -460,11 +607,9 @@ func (h *HTTPService) servePath(w http.ResponseWriter, r *http.Request, volume *
 			return hasMediaTag(mimetype, tag)
 		},
 		"MakeLink": func(args ...string) string {
-			if len(args) > 0 {
-				return fmt.Sprintf("%s&%s", link, strings.Join(args, "&"))
-			}
-			return link
+			return linkTo(path, args...)
 		},
+		"LinkTo": linkTo,
 	})
 }
 
@@ -485,26 +630,34 @@ func (h *HTTPService) routeGetStatic(w http.ResponseWriter, r *http.Request) {
 	http.ServeContent(w, r, fileName, time.Now(), bytes.NewReader(data))
 }
 
-func (h *HTTPService) template(w http.ResponseWriter, templateName string, context interface{}) {
+func (h *HTTPService) template(w http.ResponseWriter, r *http.Request, templateName string, context interface{}) {
 	paths := getTemplatePaths()
 	paths = append(paths, templateName)
 
-	ts, err := template.ParseFS(templates, paths...)
+	// the token has to be issued before anything is written, since it may
+	// need to set the session cookie
+	csrfToken := h.authStore.CSRFToken(w, r)
+
+	ts, err := template.New("").Funcs(templateFuncs(csrfToken)).ParseFS(templates, paths...)
 	if err != nil {
 		gores.Error(w, 500, fmt.Sprintf("Error rendering template: %v", err))
 		return
 	}
 
-	err = ts.Execute(w, context)
+	// every page is laid out by base.html, executing the set directly would
+	// run whichever template file happens to sort first
+	err = ts.ExecuteTemplate(w, "base.html", context)
 	if err != nil {
 		gores.Error(w, 500, fmt.Sprintf("Error rendering template: %v", err))
 	}
 }
 
-func (h *HTTPService) templateFragment(w http.ResponseWriter, fragName string, context interface{}) {
+// templateFragment renders part of a page for htmx. Fragments are only asked
+// for by pages, which already issued a csrf token.
+func (h *HTTPService) templateFragment(w http.ResponseWriter, r *http.Request, fragName string, context interface{}) {
 	paths := getTemplatePaths()
 
-	ts, err := template.ParseFS(templates, paths...)
+	ts, err := template.New("").Funcs(templateFuncs(h.authStore.sessionCSRFToken(r))).ParseFS(templates, paths...)
 	if err != nil {
 		gores.Error(w, 500, fmt.Sprintf("Error rendering template: %v", err))
 		return
@@ -515,3 +668,21 @@ func (h *HTTPService) templateFragment(w http.ResponseWriter, fragName string, c
 		gores.Error(w, 500, fmt.Sprintf("Error rendering template: %v", err))
 	}
 }
+
+func templateFuncs(csrfToken string) template.FuncMap {
+	return template.FuncMap{
+		"csrfToken": func() string {
+			return csrfToken
+		},
+	}
+}
+
+// requestIP returns the address of the client, RealIP has already replaced
+// RemoteAddr with the forwarded address when there is one.
+func requestIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
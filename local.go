@@ -0,0 +1,585 @@
+package files
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/alioygur/gores"
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// LocalUser is an account that logs in with a password, for deployments
+// without a login provider. They are identified by their username.
+type LocalUser struct {
+	Id           uint   `json:"id" gorm:"primaryKey"`
+	Username     string `json:"username" gorm:"uniqueIndex"`
+	PasswordHash string `json:"-"`
+	// TOTPSecret is base32 encoded, empty when two factor isn't enabled.
+	TOTPSecret string `json:"-"`
+	// TOTPStep is the last time step a code was accepted for, so a code can't
+	// be used twice.
+	TOTPStep  int64     `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (u *LocalUser) HasTOTP() bool {
+	return u.TOTPSecret != ""
+}
+
+func (u *LocalUser) UserId() string {
+	return ProviderLocal + ":" + u.Username
+}
+
+var (
+	ErrInvalidCredentials = errors.New("invalid username or password")
+
+	usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+
+	// dummyPasswordHash is compared against for unknown usernames, so they take
+	// as long to reject as wrong passwords.
+	dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+)
+
+const minPasswordLength = 8
+
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", NewStatusError(http.StatusBadRequest, fmt.Sprintf("passwords need at least %d characters", minPasswordLength))
+	} else if len(password) > 72 {
+		// bcrypt ignores anything past 72 bytes
+		return "", NewStatusError(http.StatusBadRequest, "passwords can't be longer than 72 characters")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func CreateLocalUser(username, password string) (*LocalUser, error) {
+	if !usernamePattern.MatchString(username) {
+		return nil, NewStatusError(http.StatusBadRequest, "usernames can only contain letters, numbers, '.', '_' and '-'")
+	}
+
+	var count int64
+	err := db.Model(&LocalUser{}).Where("username = ?", username).Count(&count).Error
+	if err != nil {
+		return nil, err
+	} else if count > 0 {
+		return nil, NewStatusError(http.StatusConflict, fmt.Sprintf("user '%s' already exists", username))
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &LocalUser{Username: username, PasswordHash: hash}
+	err = db.Create(user).Error
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func GetLocalUser(username string) (*LocalUser, error) {
+	var user LocalUser
+	if err := db.Take(&user, "username = ?", username).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func ListLocalUsers() ([]LocalUser, error) {
+	var users []LocalUser
+	err := db.Order("username").Find(&users).Error
+	return users, err
+}
+
+// HasLocalUsers reports whether any local accounts exist, login only offers
+// a password form when they do.
+func HasLocalUsers() bool {
+	var count int64
+	db.Model(&LocalUser{}).Count(&count)
+	return count > 0
+}
+
+// AuthenticateLocalUser checks the password of a user, returning
+// ErrInvalidCredentials for both unknown users and wrong passwords.
+func AuthenticateLocalUser(username, password string) (*LocalUser, error) {
+	user, err := GetLocalUser(username)
+	if err != nil {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return nil, ErrInvalidCredentials
+	}
+	return user, nil
+}
+
+func (u *LocalUser) SetPassword(password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	u.PasswordHash = hash
+	return db.Model(u).Update("password_hash", hash).Error
+}
+
+// SetTOTPSecret enables two factor with secret, or disables it when empty.
+func (u *LocalUser) SetTOTPSecret(secret string) error {
+	u.TOTPSecret = secret
+	u.TOTPStep = 0
+	return db.Model(u).Select("totp_secret", "totp_step").Updates(u).Error
+}
+
+// DeleteLocalUser deletes a user along with the tokens issued to them.
+func DeleteLocalUser(user *LocalUser) error {
+	err := db.Where("user_id = ?", user.UserId()).Delete(&UserToken{}).Error
+	if err != nil {
+		return err
+	}
+	return db.Delete(user).Error
+}
+
+const totpPeriod = 30
+
+func GenerateTOTPSecret() string {
+	secret := make([]byte, 20)
+	rand.Read(secret)
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+}
+
+// TOTPURI is what authenticator apps are given to add secret, usually as a
+// QR code.
+func TOTPURI(secret, username string) string {
+	return (&url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/files:" + username,
+		RawQuery: url.Values{"secret": {secret}, "issuer": {"files"}}.Encode(),
+	}).String()
+}
+
+// totpCode computes the code for a time step as in RFC 6238, with the
+// defaults every authenticator app supports.
+func totpCode(secret string, step int64) string {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		return ""
+	}
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// checkTOTP returns the time step code is valid for with secret, allowing a
+// step of clock drift either way, or zero when it isn't valid.
+func checkTOTP(secret, code string) int64 {
+	now := time.Now().Unix() / totpPeriod
+	for step := now - 1; step <= now+1; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step
+		}
+	}
+	return 0
+}
+
+// VerifyTOTP checks a code from the authenticator of a user, remembering it so
+// it can't be used again.
+func (u *LocalUser) VerifyTOTP(code string) bool {
+	step := checkTOTP(u.TOTPSecret, code)
+	if step == 0 || step <= u.TOTPStep {
+		return false
+	}
+
+	// only one request can move the step forward, so a code can't be raced
+	result := db.Model(&LocalUser{}).Where("id = ? AND totp_step < ?", u.Id, step).Update("totp_step", step)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false
+	}
+	u.TOTPStep = step
+	return true
+}
+
+// totpLoginWindow is how long after their password a user has to enter their
+// two factor code.
+const totpLoginWindow = 5 * time.Minute
+
+func (h *HTTPService) loginPage(w http.ResponseWriter, r *http.Request, data map[string]interface{}) {
+	data["Discord"] = h.config.Discord != nil
+	data["OIDC"] = h.oidc != nil
+	if h.oidc != nil {
+		data["OIDCName"] = h.config.OIDC.DisplayName()
+	}
+	data["Local"] = HasLocalUsers() || (h.config.Discord == nil && h.oidc == nil)
+	h.template(w, r, "static/login.html", data)
+}
+
+func (h *HTTPService) routePostLogin(w http.ResponseWriter, r *http.Request) {
+	session := h.authStore.GetSession(r)
+	if session == nil {
+		gores.Error(w, http.StatusBadRequest, "invalid session")
+		return
+	}
+
+	user, err := AuthenticateLocalUser(r.FormValue("username"), r.FormValue("password"))
+	if err != nil {
+		h.authStore.Failed(r)
+		RecordAudit(r, nil, AuditEvent{
+			Actor:  ProviderLocal + ":" + r.FormValue("username"),
+			Action: "login",
+			Result: AuditFailure,
+			Detail: err.Error(),
+		})
+		h.loginPage(w, r, map[string]interface{}{"Error": err.Error()})
+		return
+	}
+
+	if user.HasTOTP() {
+		session.Values["local-pending-user"] = user.Username
+		session.Values["local-pending-at"] = time.Now().Unix()
+		session.Save(r, w)
+		h.loginPage(w, r, map[string]interface{}{"TOTP": true})
+		return
+	}
+
+	session.Values["user-id"] = user.UserId()
+	session.Save(r, w)
+	RecordAudit(r, nil, AuditEvent{Actor: user.UserId(), Action: "login"})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (h *HTTPService) routePostLoginTOTP(w http.ResponseWriter, r *http.Request) {
+	session := h.authStore.GetSession(r)
+	if session == nil {
+		gores.Error(w, http.StatusBadRequest, "invalid session")
+		return
+	}
+
+	username, _ := session.Values["local-pending-user"].(string)
+	pendingAt, _ := session.Values["local-pending-at"].(int64)
+	if username == "" || time.Since(time.Unix(pendingAt, 0)) > totpLoginWindow {
+		h.loginPage(w, r, map[string]interface{}{"Error": "login again, it took too long to enter a code"})
+		return
+	}
+
+	user, err := GetLocalUser(username)
+	if err != nil || !user.VerifyTOTP(r.FormValue("code")) {
+		h.authStore.Failed(r)
+		RecordAudit(r, nil, AuditEvent{
+			Actor:  ProviderLocal + ":" + username,
+			Action: "login",
+			Result: AuditFailure,
+			Detail: "invalid two factor code",
+		})
+		h.loginPage(w, r, map[string]interface{}{"TOTP": true, "Error": "invalid code"})
+		return
+	}
+
+	session.Values["local-pending-user"] = nil
+	session.Values["local-pending-at"] = nil
+	session.Values["user-id"] = user.UserId()
+	session.Save(r, w)
+	RecordAudit(r, nil, AuditEvent{Actor: user.UserId(), Action: "login"})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// localUser returns the local account a request is made by, writing an error
+// and returning nil when it isn't made by one.
+func (h *HTTPService) localUser(w http.ResponseWriter, r *http.Request) *LocalUser {
+	// tokens and api keys can't take over the account they were made for
+	if r.Header.Get("Authorization") != "" || r.URL.Query().Has("sc") {
+		gores.Error(w, http.StatusForbidden, "accounts can only be managed from a logged in session")
+		return nil
+	}
+
+	auth := h.authStore.CheckSession(r)
+	if auth == nil {
+		gores.Error(w, http.StatusUnauthorized, "unauthorized")
+		return nil
+	}
+
+	username, ok := localUsername(auth.UserId())
+	if !ok {
+		gores.Error(w, http.StatusBadRequest, "only local accounts can be managed here")
+		return nil
+	}
+
+	user, err := GetLocalUser(username)
+	if err != nil {
+		ErrorResponse(w, err)
+		return nil
+	}
+	return user
+}
+
+// localUsername returns the username of a local user id.
+func localUsername(userId string) (string, bool) {
+	provider, username, _ := strings.Cut(userId, ":")
+	return username, provider == ProviderLocal
+}
+
+func (h *HTTPService) accountPage(w http.ResponseWriter, r *http.Request, user *LocalUser, data map[string]interface{}) {
+	data["User"] = user
+	h.template(w, r, "static/account.html", data)
+}
+
+func (h *HTTPService) routeGetAccount(w http.ResponseWriter, r *http.Request) {
+	user := h.localUser(w, r)
+	if user == nil {
+		return
+	}
+
+	h.accountPage(w, r, user, map[string]interface{}{})
+}
+
+func (h *HTTPService) routePostAccountPassword(w http.ResponseWriter, r *http.Request) {
+	user := h.localUser(w, r)
+	if user == nil {
+		return
+	}
+
+	_, err := AuthenticateLocalUser(user.Username, r.FormValue("current"))
+	if err != nil {
+		h.authStore.Failed(r)
+		h.accountPage(w, r, user, map[string]interface{}{"Error": "current password is wrong"})
+		return
+	}
+
+	err = user.SetPassword(r.FormValue("password"))
+	if err != nil {
+		h.accountPage(w, r, user, map[string]interface{}{"Error": err.Error()})
+		return
+	}
+	h.accountPage(w, r, user, map[string]interface{}{"Message": "password changed"})
+}
+
+// routePostAccountTOTP starts setting up two factor. The secret is only saved
+// once a code from it is confirmed, until then it is kept in the session.
+func (h *HTTPService) routePostAccountTOTP(w http.ResponseWriter, r *http.Request) {
+	user := h.localUser(w, r)
+	if user == nil {
+		return
+	}
+
+	session := h.authStore.GetSession(r)
+	if session == nil {
+		gores.Error(w, http.StatusBadRequest, "invalid session")
+		return
+	}
+
+	secret := GenerateTOTPSecret()
+	session.Values["totp-pending-secret"] = secret
+	session.Save(r, w)
+
+	h.accountPage(w, r, user, map[string]interface{}{
+		"TOTPSecret": secret,
+		"TOTPURI":    TOTPURI(secret, user.Username),
+	})
+}
+
+func (h *HTTPService) routePostAccountTOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	user := h.localUser(w, r)
+	if user == nil {
+		return
+	}
+
+	session := h.authStore.GetSession(r)
+	if session == nil {
+		gores.Error(w, http.StatusBadRequest, "invalid session")
+		return
+	}
+
+	secret, _ := session.Values["totp-pending-secret"].(string)
+	if secret == "" {
+		h.accountPage(w, r, user, map[string]interface{}{"Error": "start setting up two factor again"})
+		return
+	}
+
+	if checkTOTP(secret, r.FormValue("code")) == 0 {
+		h.accountPage(w, r, user, map[string]interface{}{
+			"Error":      "invalid code",
+			"TOTPSecret": secret,
+			"TOTPURI":    TOTPURI(secret, user.Username),
+		})
+		return
+	}
+
+	err := user.SetTOTPSecret(secret)
+	if err != nil {
+		ErrorResponse(w, err)
+		return
+	}
+
+	session.Values["totp-pending-secret"] = nil
+	session.Save(r, w)
+	h.accountPage(w, r, user, map[string]interface{}{"Message": "two factor enabled"})
+}
+
+func (h *HTTPService) routePostAccountTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	user := h.localUser(w, r)
+	if user == nil {
+		return
+	}
+
+	if !user.HasTOTP() || !user.VerifyTOTP(r.FormValue("code")) {
+		h.authStore.Failed(r)
+		h.accountPage(w, r, user, map[string]interface{}{"Error": "invalid code"})
+		return
+	}
+
+	err := user.SetTOTPSecret("")
+	if err != nil {
+		ErrorResponse(w, err)
+		return
+	}
+	h.accountPage(w, r, user, map[string]interface{}{"Message": "two factor disabled"})
+}
+
+func (h *HTTPService) usersPage(w http.ResponseWriter, r *http.Request, data map[string]interface{}) {
+	users, err := ListLocalUsers()
+	if err != nil {
+		ErrorResponse(w, err)
+		return
+	}
+
+	data["Users"] = users
+	h.template(w, r, "static/users.html", data)
+}
+
+func (h *HTTPService) routeGetUsers(w http.ResponseWriter, r *http.Request) {
+	if h.adminAuth(w, r) == nil {
+		return
+	}
+
+	if wantsJSON(r) {
+		users, err := ListLocalUsers()
+		if err != nil {
+			ErrorResponse(w, err)
+			return
+		}
+
+		gores.JSON(w, http.StatusOK, map[string]interface{}{
+			"users": users,
+		})
+		return
+	}
+
+	h.usersPage(w, r, map[string]interface{}{})
+}
+
+func (h *HTTPService) routePostUsers(w http.ResponseWriter, r *http.Request) {
+	if h.adminAuth(w, r) == nil {
+		return
+	}
+
+	user, err := CreateLocalUser(r.FormValue("username"), r.FormValue("password"))
+	if wantsJSON(r) {
+		if err != nil {
+			statusErrorResponse(w, err)
+			return
+		}
+
+		gores.JSON(w, http.StatusCreated, map[string]interface{}{
+			"user": user,
+		})
+		return
+	}
+
+	if err != nil {
+		h.usersPage(w, r, map[string]interface{}{"Error": err.Error()})
+		return
+	}
+	h.usersPage(w, r, map[string]interface{}{"Message": fmt.Sprintf("created '%s'", user.Username)})
+}
+
+func (h *HTTPService) routePostUserPassword(w http.ResponseWriter, r *http.Request) {
+	if h.adminAuth(w, r) == nil {
+		return
+	}
+
+	user, err := GetLocalUser(chi.URLParam(r, "username"))
+	if err != nil {
+		ErrorResponse(w, err)
+		return
+	}
+
+	err = user.SetPassword(r.FormValue("password"))
+	if err != nil {
+		h.usersPage(w, r, map[string]interface{}{"Error": err.Error()})
+		return
+	}
+	h.usersPage(w, r, map[string]interface{}{"Message": fmt.Sprintf("changed the password of '%s'", user.Username)})
+}
+
+// routePostUserTOTPReset disables two factor for users that lost their
+// authenticator.
+func (h *HTTPService) routePostUserTOTPReset(w http.ResponseWriter, r *http.Request) {
+	if h.adminAuth(w, r) == nil {
+		return
+	}
+
+	user, err := GetLocalUser(chi.URLParam(r, "username"))
+	if err != nil {
+		ErrorResponse(w, err)
+		return
+	}
+
+	err = user.SetTOTPSecret("")
+	if err != nil {
+		ErrorResponse(w, err)
+		return
+	}
+	h.usersPage(w, r, map[string]interface{}{"Message": fmt.Sprintf("disabled two factor for '%s'", user.Username)})
+}
+
+func (h *HTTPService) routeDeleteUser(w http.ResponseWriter, r *http.Request) {
+	if h.adminAuth(w, r) == nil {
+		return
+	}
+
+	user, err := GetLocalUser(chi.URLParam(r, "username"))
+	if err != nil {
+		ErrorResponse(w, err)
+		return
+	}
+
+	err = DeleteLocalUser(user)
+	if err != nil {
+		ErrorResponse(w, err)
+		return
+	}
+
+	if wantsJSON(r) {
+		gores.NoContent(w)
+		return
+	}
+
+	// htmx swaps the row out for this empty response
+	gores.HTML(w, http.StatusOK, "")
+}
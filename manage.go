@@ -0,0 +1,447 @@
+package files
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/alioygur/gores"
+)
+
+var ErrInvalidName = errors.New("invalid name")
+
+// validEntryName checks a name given for a new or renamed entry is a single
+// path segment.
+func validEntryName(name string) bool {
+	return name != "" && name != "." && name != ".." &&
+		!strings.ContainsAny(name, `/\`) && !isInternalPath(name)
+}
+
+// isVolumeRoot reports whether p refers to the root of a volume, which can't
+// be deleted or moved.
+func isVolumeRoot(p string) bool {
+	return cleanSharePath(p) == "/"
+}
+
+// isWithin reports whether p is parent itself or somewhere below it.
+func isWithin(p, parent string) bool {
+	p, parent = cleanSharePath(p), cleanSharePath(parent)
+	return parent == "/" || p == parent || strings.HasPrefix(p, parent+"/")
+}
+
+// manageTarget resolves where a moved, copied or renamed entry ends up. These
+// never replace what is already there, the rename policy still picks a free
+// name.
+func (v *Volume) manageTarget(to string) (string, error) {
+	policy := v.ConflictPolicy
+	if policy != ConflictRename {
+		policy = ConflictReject
+	}
+	return v.ResolveConflict(to, policy)
+}
+
+// Delete removes a file or a directory with everything inside of it.
+func (v *Volume) Delete(p string) error {
+	if isVolumeRoot(p) || isInternalPath(p) {
+		return &fs.PathError{Op: "delete", Path: p, Err: fs.ErrInvalid}
+	}
+
+	_, err := v.Backend.Stat(p)
+	if err != nil {
+		return err
+	}
+	return v.Backend.RemoveAll(p)
+}
+
+// Move moves a file or directory to the path to, returning where it ended up.
+func (v *Volume) Move(from, to string) (string, error) {
+	if isVolumeRoot(from) || isInternalPath(from) || isInternalPath(to) || isWithin(to, from) {
+		return "", &fs.PathError{Op: "move", Path: from, Err: fs.ErrInvalid}
+	}
+
+	_, err := v.Backend.Stat(from)
+	if err != nil {
+		return "", err
+	}
+
+	to, err = v.manageTarget(to)
+	if err != nil {
+		return "", err
+	}
+	return to, v.Backend.Rename(from, to)
+}
+
+// Copy copies a file or a directory with everything inside of it to the path
+// to, returning where it ended up.
+func (v *Volume) Copy(from, to string) (string, error) {
+	if isInternalPath(from) || isInternalPath(to) || isWithin(to, from) {
+		return "", &fs.PathError{Op: "copy", Path: from, Err: fs.ErrInvalid}
+	}
+
+	_, err := v.Backend.Stat(from)
+	if err != nil {
+		return "", err
+	}
+
+	to, err = v.manageTarget(to)
+	if err != nil {
+		return "", err
+	}
+
+	return to, v.WalkDir(from, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(from, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(to, rel)
+
+		if d.IsDir() {
+			return v.Backend.MkdirAll(target)
+		}
+
+		f, err := v.Backend.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, _, err = v.WriteFile(target, f, ConflictOverwrite)
+		return err
+	})
+}
+
+// Mkdir creates a new directory, failing if something already exists there.
+func (v *Volume) Mkdir(p string) error {
+	if isInternalPath(p) {
+		return &fs.PathError{Op: "mkdir", Path: p, Err: fs.ErrInvalid}
+	}
+
+	_, err := v.Backend.Stat(p)
+	if err == nil {
+		return ErrFileExists
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return v.Backend.MkdirAll(p)
+}
+
+// manageRequest is the body accepted by the manage routes, either as form
+// values or as JSON. Operations that work on several entries take all of
+// their paths at once.
+type manageRequest struct {
+	Paths       []string `json:"paths"`
+	Destination string   `json:"destination"`
+	Name        string   `json:"name"`
+}
+
+func parseManageRequest(r *http.Request) (*manageRequest, error) {
+	var req manageRequest
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			return nil, err
+		}
+		return &req, nil
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		return nil, err
+	}
+
+	req.Paths = r.Form["path"]
+	req.Destination = r.Form.Get("destination")
+	req.Name = r.Form.Get("name")
+
+	// htmx prompts send what was entered as a header
+	if req.Name == "" {
+		req.Name = r.Header.Get("HX-Prompt")
+	}
+	return &req, nil
+}
+
+type manageResult struct {
+	Path  string `json:"path"`
+	To    string `json:"to,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+func manageErrorStatus(err error) int {
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+		return http.StatusNotFound
+	} else if errors.Is(err, ErrFileExists) {
+		return http.StatusConflict
+	} else if errors.Is(err, fs.ErrInvalid) || errors.Is(err, ErrInvalidName) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// manageErrorMessage keeps backend details like absolute paths out of
+// responses.
+func manageErrorMessage(err error) string {
+	switch manageErrorStatus(err) {
+	case http.StatusNotFound:
+		return "not found"
+	case http.StatusConflict:
+		return ErrFileExists.Error()
+	case http.StatusBadRequest:
+		return "invalid path"
+	}
+	return "something went wrong"
+}
+
+// manageVolume parses a manage request and authorizes it for every path it
+// touches, writing an error and returning nil when the request can't
+// continue.
+func (h *HTTPService) manageVolume(w http.ResponseWriter, r *http.Request) (*Volume, Authorization, *manageRequest) {
+	req, err := parseManageRequest(r)
+	if err != nil {
+		gores.Error(w, http.StatusBadRequest, "invalid request")
+		return nil, nil, nil
+	}
+
+	paths := req.Paths
+	if req.Destination != "" {
+		paths = append(paths[:len(paths):len(paths)], req.Destination)
+	}
+
+	first := ""
+	if len(paths) > 0 {
+		first = paths[0]
+	}
+
+	volume, auth := h.authStore.GetVolumeAt(w, r, first, PermissionWrite)
+	if volume == nil {
+		return nil, nil, nil
+	}
+
+	for _, path := range paths {
+		if !auth.CanAccess(volume, path, PermissionWrite) {
+			gores.Error(w, http.StatusNotFound, "not found")
+			return nil, nil, nil
+		}
+	}
+
+	if !volume.HasFeature("manage") {
+		gores.Error(w, http.StatusNotFound, "manage is not available for this volume")
+		return nil, nil, nil
+	}
+
+	return volume, auth, req
+}
+
+// manageRemovable checks the caller may write to p and everything below it
+// before it is deleted, trashed or moved away.
+func manageRemovable(volume *Volume, auth Authorization, op, p string) error {
+	ok, err := volume.AllowsTree(auth, p, PermissionWrite)
+	if err != nil {
+		return err
+	} else if !ok {
+		return &fs.PathError{Op: op, Path: p, Err: fs.ErrPermission}
+	}
+	return nil
+}
+
+// manageTransferable checks the caller may use permission on from and
+// everything below it, write for moves and read for copies, and write where
+// each of those ends up below to.
+func manageTransferable(volume *Volume, auth Authorization, op, from, to string, permission Permission) error {
+	ok, err := volume.allowsTree(from, func(child string) bool {
+		rel, err := filepath.Rel(from, child)
+		if err != nil {
+			return false
+		}
+		return volume.Allows(auth, child, permission) && volume.Allows(auth, filepath.Join(to, rel), PermissionWrite)
+	})
+	if err != nil {
+		return err
+	} else if !ok {
+		return &fs.PathError{Op: op, Path: from, Err: fs.ErrPermission}
+	}
+	return nil
+}
+
+// manageWritable checks the caller may write to target, the path an entry is
+// created at or moved or copied to. Denials look like the target's directory
+// doesn't exist, the same as for the paths of the request itself.
+func manageWritable(volume *Volume, auth Authorization, op, target string) error {
+	if !auth.CanAccess(volume, target, PermissionWrite) {
+		return &fs.PathError{Op: op, Path: target, Err: fs.ErrPermission}
+	}
+	return nil
+}
+
+// manageResponse audits and reports the outcome of a manage operation. A
+// single failed operation is returned as an error, batches list what happened
+// to each path.
+func (h *HTTPService) manageResponse(w http.ResponseWriter, r *http.Request, volume *Volume, auth Authorization, action string, results []manageResult, errs []error) {
+	failed := []string{}
+	for i, err := range errs {
+		event := AuditEvent{Action: action, Volume: volume.Name, Path: results[i].Path, Detail: results[i].To}
+		if err != nil {
+			results[i].Error = manageErrorMessage(err)
+			failed = append(failed, fmt.Sprintf("%s: %s", results[i].Path, results[i].Error))
+
+			event.Result, event.Detail = AuditFailure, err.Error()
+			if errors.Is(err, fs.ErrPermission) {
+				event.Result = AuditDenied
+			}
+		}
+		RecordAudit(r, auth, event)
+	}
+
+	if len(results) == 1 && errs[0] != nil {
+		gores.Error(w, manageErrorStatus(errs[0]), results[0].Error)
+		return
+	}
+
+	if wantsJSON(r) {
+		gores.JSON(w, http.StatusOK, map[string]interface{}{
+			"results": results,
+		})
+		return
+	}
+
+	if len(failed) > 0 {
+		gores.Error(w, http.StatusBadRequest, strings.Join(failed, "\n"))
+		return
+	}
+
+	w.Header().Set("HX-Refresh", "true")
+	gores.NoContent(w)
+}
+
+func (h *HTTPService) routePostManageDelete(w http.ResponseWriter, r *http.Request) {
+	volume, auth, req := h.manageVolume(w, r)
+	if volume == nil {
+		return
+	}
+
+	if len(req.Paths) == 0 {
+		gores.Error(w, http.StatusBadRequest, "no paths given")
+		return
+	}
+
+	action := "delete"
+	if volume.HasFeature("trash") {
+		action = "trash"
+	}
+
+	results := make([]manageResult, len(req.Paths))
+	errs := make([]error, len(req.Paths))
+	for i, path := range req.Paths {
+		results[i].Path = path
+		errs[i] = manageRemovable(volume, auth, action, path)
+		if errs[i] != nil {
+			continue
+		}
+
+		if volume.HasFeature("trash") {
+			_, errs[i] = volume.Trash(path, auth.Identity())
+		} else {
+			errs[i] = volume.Delete(path)
+		}
+	}
+
+	h.manageResponse(w, r, volume, auth, action, results, errs)
+}
+
+func (h *HTTPService) routePostManageRename(w http.ResponseWriter, r *http.Request) {
+	volume, auth, req := h.manageVolume(w, r)
+	if volume == nil {
+		return
+	}
+
+	if len(req.Paths) != 1 {
+		gores.Error(w, http.StatusBadRequest, "rename takes exactly one path")
+		return
+	}
+
+	path := req.Paths[0]
+	results := []manageResult{{Path: path}}
+	errs := []error{ErrInvalidName}
+	if validEntryName(req.Name) {
+		target := filepath.Join(filepath.Dir(path), req.Name)
+		errs[0] = manageTransferable(volume, auth, "rename", path, target, PermissionWrite)
+		if errs[0] == nil {
+			results[0].To, errs[0] = volume.Move(path, target)
+		}
+	}
+
+	h.manageResponse(w, r, volume, auth, "rename", results, errs)
+}
+
+// manageTransfer moves or copies every path of the request into its
+// destination directory.
+func (h *HTTPService) manageTransfer(w http.ResponseWriter, r *http.Request, op string, permission Permission, transfer func(*Volume, string, string) (string, error)) {
+	volume, auth, req := h.manageVolume(w, r)
+	if volume == nil {
+		return
+	}
+
+	if len(req.Paths) == 0 {
+		gores.Error(w, http.StatusBadRequest, "no paths given")
+		return
+	}
+
+	info, err := volume.Stat(req.Destination)
+	if err != nil || !info.IsDir() || isInternalPath(req.Destination) {
+		gores.Error(w, http.StatusBadRequest, "destination is not a directory")
+		return
+	}
+
+	results := make([]manageResult, len(req.Paths))
+	errs := make([]error, len(req.Paths))
+	for i, path := range req.Paths {
+		results[i].Path = path
+		target := filepath.Join(req.Destination, filepath.Base(path))
+		errs[i] = manageTransferable(volume, auth, op, path, target, permission)
+		if errs[i] == nil {
+			results[i].To, errs[i] = transfer(volume, path, target)
+		}
+	}
+
+	h.manageResponse(w, r, volume, auth, op, results, errs)
+}
+
+func (h *HTTPService) routePostManageMove(w http.ResponseWriter, r *http.Request) {
+	h.manageTransfer(w, r, "move", PermissionWrite, (*Volume).Move)
+}
+
+func (h *HTTPService) routePostManageCopy(w http.ResponseWriter, r *http.Request) {
+	h.manageTransfer(w, r, "copy", PermissionRead, (*Volume).Copy)
+}
+
+func (h *HTTPService) routePostManageMkdir(w http.ResponseWriter, r *http.Request) {
+	volume, auth, req := h.manageVolume(w, r)
+	if volume == nil {
+		return
+	}
+
+	parent := ""
+	if len(req.Paths) > 0 {
+		parent = req.Paths[0]
+	}
+
+	path := filepath.Join(parent, req.Name)
+	results := []manageResult{{Path: path}}
+	errs := []error{ErrInvalidName}
+	if validEntryName(req.Name) {
+		errs[0] = manageWritable(volume, auth, "mkdir", path)
+		if errs[0] == nil {
+			errs[0] = volume.Mkdir(path)
+		}
+	}
+
+	h.manageResponse(w, r, volume, auth, "mkdir", results, errs)
+}
@@ -0,0 +1,240 @@
+package files
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsWithin(t *testing.T) {
+	cases := []struct {
+		path   string
+		parent string
+		within bool
+	}{
+		{"photos", "photos", true},
+		{"photos/a.jpg", "photos", true},
+		{"photos/trip/a.jpg", "photos", true},
+		{"/photos/a.jpg", "photos/", true},
+		{"photos-old", "photos", false},
+		{"photos-old/a.jpg", "photos", false},
+		{"photo", "photos", false},
+		{"photos", "photos/trip", false},
+		{"photos/../secret", "photos", false},
+		{"anything", "", true},
+		{"anything", "/", true},
+		{"", "photos", false},
+	}
+
+	for _, c := range cases {
+		if got := isWithin(c.path, c.parent); got != c.within {
+			t.Errorf("isWithin(%q, %q) = %v, want %v", c.path, c.parent, got, c.within)
+		}
+	}
+}
+
+func TestIsVolumeRoot(t *testing.T) {
+	for _, p := range []string{"", "/", ".", "./", "a/..", "/a/../"} {
+		if !isVolumeRoot(p) {
+			t.Errorf("%q isn't the volume root", p)
+		}
+	}
+	for _, p := range []string{"a", "/a", "a/b/.."} {
+		if isVolumeRoot(p) {
+			t.Errorf("%q is the volume root", p)
+		}
+	}
+}
+
+func TestValidEntryName(t *testing.T) {
+	for _, name := range []string{"a.txt", "photos", ".hidden", "a b", "..a"} {
+		if !validEntryName(name) {
+			t.Errorf("%q was rejected", name)
+		}
+	}
+	for _, name := range []string{"", ".", "..", "a/b", `a\b`, "/", trashDir, stagingDir, tempFilePrefix + "x"} {
+		if validEntryName(name) {
+			t.Errorf("%q was accepted", name)
+		}
+	}
+}
+
+// newTestManageVolume makes a volume with a few files for manage operations.
+func newTestManageVolume(t *testing.T, policy string) (*Volume, string) {
+	t.Helper()
+
+	root := t.TempDir()
+	for _, p := range []string{"a.txt", "b.txt", "dir/c.txt", "dir/sub/d.txt", "other/e.txt"} {
+		err := os.MkdirAll(filepath.Join(root, filepath.Dir(p)), 0755)
+		if err == nil {
+			err = os.WriteFile(filepath.Join(root, p), []byte(p), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &Volume{Name: "v", Backend: NewLocalBackend(root), ConflictPolicy: policy}, root
+}
+
+func assertContents(t *testing.T, root, p, want string) {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join(root, p))
+	if err != nil {
+		t.Errorf("reading %s: %v", p, err)
+	} else if string(data) != want {
+		t.Errorf("%s = %q, want %q", p, data, want)
+	}
+}
+
+func assertMissing(t *testing.T, root, p string) {
+	t.Helper()
+
+	if _, err := os.Stat(filepath.Join(root, p)); !os.IsNotExist(err) {
+		t.Errorf("%s still exists", p)
+	}
+}
+
+func TestVolumeManageGuards(t *testing.T) {
+	volume, _ := newTestManageVolume(t, ConflictRename)
+
+	cases := []struct {
+		name string
+		run  func() error
+	}{
+		{"delete root", func() error { return volume.Delete("") }},
+		{"delete root slash", func() error { return volume.Delete("/") }},
+		{"delete trash", func() error { return volume.Delete(trashDir) }},
+		{"move root", func() error { _, err := volume.Move("/", "other/root"); return err }},
+		{"move into itself", func() error { _, err := volume.Move("dir", "dir/sub/dir"); return err }},
+		{"move onto itself", func() error { _, err := volume.Move("dir", "dir"); return err }},
+		{"move into trash", func() error { _, err := volume.Move("a.txt", trashDir+"/a.txt"); return err }},
+		{"move out of staging", func() error { _, err := volume.Move(stagingDir, "staging"); return err }},
+		{"copy into itself", func() error { _, err := volume.Copy("dir", "dir/sub/dir"); return err }},
+		{"copy root into itself", func() error { _, err := volume.Copy("", "other/root"); return err }},
+		{"copy into staging", func() error { _, err := volume.Copy("a.txt", stagingDir+"/a.txt"); return err }},
+		{"mkdir in trash", func() error { return volume.Mkdir(trashDir + "/x") }},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := c.run(); !errors.Is(err, fs.ErrInvalid) {
+				t.Errorf("err = %v, want an invalid path", err)
+			}
+		})
+	}
+}
+
+func TestVolumeDelete(t *testing.T) {
+	volume, root := newTestManageVolume(t, ConflictRename)
+
+	if err := volume.Delete("dir"); err != nil {
+		t.Fatal(err)
+	}
+	assertMissing(t, root, "dir")
+	assertContents(t, root, "a.txt", "a.txt")
+
+	if err := volume.Delete("missing.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("deleting a missing file: %v", err)
+	}
+}
+
+func TestVolumeMove(t *testing.T) {
+	volume, root := newTestManageVolume(t, ConflictRename)
+
+	to, err := volume.Move("dir", "other/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if to != "other/dir" {
+		t.Errorf("moved to %s", to)
+	}
+	assertMissing(t, root, "dir")
+	assertContents(t, root, "other/dir/sub/d.txt", "dir/sub/d.txt")
+
+	if _, err := volume.Move("missing.txt", "other/missing.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("moving a missing file: %v", err)
+	}
+}
+
+func TestVolumeCopy(t *testing.T) {
+	volume, root := newTestManageVolume(t, ConflictRename)
+
+	to, err := volume.Copy("dir", "other/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if to != "other/dir" {
+		t.Errorf("copied to %s", to)
+	}
+	assertContents(t, root, "dir/sub/d.txt", "dir/sub/d.txt")
+	assertContents(t, root, "other/dir/c.txt", "dir/c.txt")
+	assertContents(t, root, "other/dir/sub/d.txt", "dir/sub/d.txt")
+
+	// a sibling sharing the name as a prefix isn't inside
+	to, err = volume.Copy("dir", "dir-copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertContents(t, root, filepath.Join(to, "c.txt"), "dir/c.txt")
+}
+
+func TestVolumeManageConflicts(t *testing.T) {
+	cases := []struct {
+		policy string
+		// where moving a.txt onto b.txt ends up, empty when it is rejected
+		to string
+	}{
+		{ConflictRename, "b (1).txt"},
+		{ConflictReject, ""},
+		// manage operations never replace what is already there
+		{ConflictOverwrite, ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.policy, func(t *testing.T) {
+			for _, op := range []string{"move", "copy"} {
+				volume, root := newTestManageVolume(t, c.policy)
+
+				transfer := volume.Move
+				if op == "copy" {
+					transfer = volume.Copy
+				}
+
+				to, err := transfer("a.txt", "b.txt")
+				if c.to == "" {
+					if !errors.Is(err, ErrFileExists) {
+						t.Errorf("%s: err = %v, want ErrFileExists", op, err)
+					}
+					assertContents(t, root, "a.txt", "a.txt")
+				} else if err != nil {
+					t.Errorf("%s: %v", op, err)
+				} else if to != c.to {
+					t.Errorf("%s ended up at %s, want %s", op, to, c.to)
+				} else {
+					assertContents(t, root, c.to, "a.txt")
+				}
+				assertContents(t, root, "b.txt", "b.txt")
+			}
+		})
+	}
+}
+
+func TestVolumeMkdir(t *testing.T) {
+	volume, root := newTestManageVolume(t, ConflictRename)
+
+	if err := volume.Mkdir("dir/new"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(root, "dir/new")); err != nil || !info.IsDir() {
+		t.Errorf("dir/new wasn't created: %v", err)
+	}
+
+	for _, p := range []string{"dir/new", "a.txt"} {
+		if err := volume.Mkdir(p); !errors.Is(err, ErrFileExists) {
+			t.Errorf("mkdir %s: err = %v, want ErrFileExists", p, err)
+		}
+	}
+}
@@ -0,0 +1,419 @@
+package files
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alioygur/gores"
+	"golang.org/x/oauth2"
+	"gorm.io/datatypes"
+	"gorm.io/gorm/clause"
+)
+
+// OIDCUser remembers what the issuer said about a user when they last logged
+// in, so their roles are known to requests made with their tokens.
+type OIDCUser struct {
+	Subject    string                       `json:"subject" gorm:"primaryKey"`
+	Name       string                       `json:"name"`
+	Email      string                       `json:"email"`
+	RoleClaims datatypes.JSONType[[]string] `json:"role_claims"`
+	UpdatedAt  time.Time                    `json:"updated_at"`
+}
+
+func (OIDCUser) TableName() string {
+	return "oidc_users"
+}
+
+// GetOIDCUserClaims returns the role claim values a user had when they last
+// logged in.
+func GetOIDCUserClaims(subject string) []string {
+	var user OIDCUser
+	if err := db.Take(&user, "subject = ?", subject).Error; err != nil {
+		return nil
+	}
+	return user.RoleClaims.Data()
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcJWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// OIDCProvider logs users in with an OpenID Connect issuer. The issuer is
+// discovered on first use, so the server starts even while it is down.
+type OIDCProvider struct {
+	config      *OIDCConfig
+	redirectURL string
+	client      *http.Client
+
+	sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+}
+
+func NewOIDCProvider(config *OIDCConfig, baseURL string) *OIDCProvider {
+	return &OIDCProvider{
+		config:      config,
+		redirectURL: baseURL + "/oidc/login/callback",
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %v", url, res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func (p *OIDCProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.Lock()
+	defer p.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	issuer := strings.TrimRight(p.config.Issuer, "/")
+	var discovery oidcDiscovery
+	err := p.getJSON(ctx, issuer+"/.well-known/openid-configuration", &discovery)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(discovery.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("issuer discovered as '%s' instead of '%s'", discovery.Issuer, p.config.Issuer)
+	}
+
+	p.discovery = &discovery
+	return p.discovery, nil
+}
+
+func (p *OIDCProvider) oauth2Config(discovery *oidcDiscovery) *oauth2.Config {
+	scopes := p.config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "profile", "email"}
+	} else if !slices.Contains(scopes, "openid") {
+		scopes = append([]string{"openid"}, scopes...)
+	}
+
+	return &oauth2.Config{
+		ClientID:     p.config.ClientId,
+		ClientSecret: p.config.ClientSecret,
+		RedirectURL:  p.redirectURL,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  discovery.AuthorizationEndpoint,
+			TokenURL: discovery.TokenEndpoint,
+		},
+		Scopes: scopes,
+	}
+}
+
+// key returns the signing key with the given id, fetching the keys of the
+// issuer when it isn't known or refresh is set, so keys can be rotated.
+func (p *OIDCProvider) key(ctx context.Context, discovery *oidcDiscovery, kid string, refresh bool) (crypto.PublicKey, error) {
+	p.Lock()
+	key, ok := p.keys[kid]
+	p.Unlock()
+	if ok && !refresh {
+		return key, nil
+	}
+
+	var jwks struct {
+		Keys []oidcJWK `json:"keys"`
+	}
+	err := p.getJSON(ctx, discovery.JWKSURI, &jwks)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	p.Lock()
+	p.keys = keys
+	p.Unlock()
+
+	key, ok = keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key '%s'", kid)
+	}
+	return key, nil
+}
+
+func (k oidcJWK) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type '%s'", k.Kty)
+}
+
+// verifyIDToken checks the signature and claims of an id token, returning
+// its claims. Only RS256 and ES256 signatures are accepted.
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, discovery *oidcDiscovery, raw string, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed id token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+
+	// a key that doesn't verify may have been replaced under the same id
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	verified := false
+	for _, refresh := range []bool{false, true} {
+		key, err := p.key(ctx, discovery, header.Kid, refresh)
+		if err != nil {
+			return nil, err
+		}
+		if verifySignature(key, header.Alg, digest[:], signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("invalid id token signature")
+	}
+
+	data, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, err
+	}
+
+	if iss, _ := claims["iss"].(string); iss != discovery.Issuer {
+		return nil, errors.New("id token is from another issuer")
+	}
+	if !slices.Contains(claimStrings(claims["aud"]), p.config.ClientId) {
+		return nil, errors.New("id token is for another client")
+	}
+	if exp, _ := claims["exp"].(float64); time.Now().After(time.Unix(int64(exp), 0)) {
+		return nil, errors.New("id token has expired")
+	}
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, errors.New("id token nonce doesn't match")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("id token has no subject")
+	}
+	return claims, nil
+}
+
+func verifySignature(key crypto.PublicKey, alg string, digest []byte, signature []byte) bool {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return alg == "RS256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		return alg == "ES256" && len(signature) == 64 &&
+			ecdsa.Verify(key, digest, new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:]))
+	}
+	return false
+}
+
+// claimStrings reads a claim that is either a string or a list of strings.
+func claimStrings(claim interface{}) []string {
+	switch claim := claim.(type) {
+	case string:
+		return []string{claim}
+	case []interface{}:
+		values := make([]string, 0, len(claim))
+		for _, value := range claim {
+			if value, ok := value.(string); ok {
+				values = append(values, value)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func oidcRandom() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (h *HTTPService) oidcGetLoginRoute(w http.ResponseWriter, r *http.Request) {
+	session := h.authStore.GetSession(r)
+	if session == nil {
+		gores.Error(w, http.StatusBadRequest, "invalid session")
+		return
+	}
+
+	discovery, err := h.oidc.discover(r.Context())
+	if err != nil {
+		gores.Error(w, http.StatusBadGateway, fmt.Sprintf("Error: %v", err))
+		return
+	}
+
+	state, nonce, verifier := oidcRandom(), oidcRandom(), oauth2.GenerateVerifier()
+	session.Values["oidc-state"] = state
+	session.Values["oidc-nonce"] = nonce
+	session.Values["oidc-verifier"] = verifier
+	session.Save(r, w)
+
+	url := h.oidc.oauth2Config(discovery).AuthCodeURL(state,
+		oauth2.S256ChallengeOption(verifier),
+		oauth2.SetAuthURLParam("nonce", nonce),
+	)
+	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+}
+
+func (h *HTTPService) oidcGetLoginCallbackRoute(w http.ResponseWriter, r *http.Request) {
+	session := h.authStore.GetSession(r)
+	if session == nil {
+		gores.Error(w, http.StatusBadRequest, "invalid session")
+		return
+	}
+
+	state, _ := session.Values["oidc-state"].(string)
+	nonce, _ := session.Values["oidc-nonce"].(string)
+	verifier, _ := session.Values["oidc-verifier"].(string)
+	if state == "" || r.FormValue("state") != state {
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+
+	errorMessage := r.FormValue("error")
+	if errorMessage != "" {
+		RecordAudit(r, nil, AuditEvent{Actor: ProviderOIDC, Action: "login", Result: AuditFailure, Detail: errorMessage})
+		gores.Error(w, http.StatusBadRequest, fmt.Sprintf("Error: %v", errorMessage))
+		return
+	}
+
+	discovery, err := h.oidc.discover(r.Context())
+	if err != nil {
+		gores.Error(w, http.StatusBadGateway, fmt.Sprintf("Error: %v", err))
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), oauth2.HTTPClient, h.oidc.client)
+	token, err := h.oidc.oauth2Config(discovery).Exchange(ctx, r.FormValue("code"), oauth2.VerifierOption(verifier))
+	if err != nil {
+		gores.Error(w, http.StatusBadGateway, fmt.Sprintf("Error: %v", err))
+		return
+	}
+
+	rawIDToken, _ := token.Extra("id_token").(string)
+	claims, err := h.oidc.verifyIDToken(r.Context(), discovery, rawIDToken, nonce)
+	if err != nil {
+		RecordAudit(r, nil, AuditEvent{Actor: ProviderOIDC, Action: "login", Result: AuditFailure, Detail: err.Error()})
+		gores.Error(w, http.StatusUnauthorized, fmt.Sprintf("Error: %v", err))
+		return
+	}
+
+	user := OIDCUser{Subject: claims["sub"].(string)}
+	user.Email, _ = claims["email"].(string)
+	for _, claim := range []string{"name", "preferred_username", "email"} {
+		if name, ok := claims[claim].(string); ok && name != "" {
+			user.Name = name
+			break
+		}
+	}
+	var roleClaims []string
+	if h.config.OIDC.RoleClaim != "" {
+		roleClaims = claimStrings(claims[h.config.OIDC.RoleClaim])
+	}
+	user.RoleClaims = datatypes.NewJSONType(roleClaims)
+
+	err = db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&user).Error
+	if err != nil {
+		gores.Error(w, http.StatusInternalServerError, "failed to save user")
+		return
+	}
+
+	session.Values["user-id"] = ProviderOIDC + ":" + user.Subject
+	session.Values["oidc-state"] = nil
+	session.Values["oidc-nonce"] = nil
+	session.Values["oidc-verifier"] = nil
+	err = session.Save(r, w)
+	if err != nil {
+		panic(err)
+	}
+	RecordAudit(r, nil, AuditEvent{Actor: ProviderOIDC + ":" + user.Subject, Action: "login"})
+
+	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+}
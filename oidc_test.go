@@ -0,0 +1,361 @@
+package files
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testIssuer is an OpenID Connect issuer serving discovery and its signing
+// keys, which can be swapped out to rotate them.
+type testIssuer struct {
+	server *httptest.Server
+	// issuer is what discovery claims the issuer is
+	issuer string
+
+	sync.Mutex
+	keys         map[string]crypto.Signer
+	jwksRequests int
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+
+	issuer := &testIssuer{keys: map[string]crypto.Signer{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                issuer.issuer,
+			AuthorizationEndpoint: issuer.server.URL + "/authorize",
+			TokenEndpoint:         issuer.server.URL + "/token",
+			JWKSURI:               issuer.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		issuer.Lock()
+		defer issuer.Unlock()
+		issuer.jwksRequests++
+
+		keys := []oidcJWK{}
+		for kid, key := range issuer.keys {
+			keys = append(keys, testJWK(kid, key.Public()))
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	})
+
+	issuer.server = httptest.NewServer(mux)
+	issuer.issuer = issuer.server.URL
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+func (i *testIssuer) setKeys(keys map[string]crypto.Signer) {
+	i.Lock()
+	defer i.Unlock()
+	i.keys = keys
+}
+
+func (i *testIssuer) provider() *OIDCProvider {
+	return NewOIDCProvider(&OIDCConfig{Issuer: i.server.URL, ClientId: "files"}, "http://files.test")
+}
+
+func testRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func testECKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func testJWK(kid string, key crypto.PublicKey) oidcJWK {
+	encode := base64.RawURLEncoding.EncodeToString
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return oidcJWK{Kty: "RSA", Kid: kid, N: encode(key.N.Bytes()), E: encode(big.NewInt(int64(key.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return oidcJWK{Kty: "EC", Kid: kid, Crv: "P-256", X: encode(key.X.FillBytes(make([]byte, 32))), Y: encode(key.Y.FillBytes(make([]byte, 32)))}
+	}
+	panic("unsupported key")
+}
+
+// signTestToken signs claims with key under kid, using alg in the header.
+func signTestToken(t *testing.T, key crypto.Signer, alg, kid string, claims map[string]interface{}) string {
+	t.Helper()
+
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (i *testIssuer) claims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":   i.issuer,
+		"aud":   "files",
+		"sub":   "user-1",
+		"nonce": "nonce-1",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+	}
+}
+
+func TestOIDCDiscover(t *testing.T) {
+	issuer := newTestIssuer(t)
+
+	provider := issuer.provider()
+	discovery, err := provider.discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if discovery.JWKSURI != issuer.server.URL+"/jwks" || discovery.TokenEndpoint != issuer.server.URL+"/token" {
+		t.Errorf("discovered %+v", discovery)
+	}
+
+	config := provider.oauth2Config(discovery)
+	if config.Endpoint.AuthURL != issuer.server.URL+"/authorize" || config.RedirectURL != "http://files.test/oidc/login/callback" {
+		t.Errorf("oauth2 config %+v", config)
+	}
+	if strings.Join(config.Scopes, " ") != "openid profile email" {
+		t.Errorf("scopes = %v", config.Scopes)
+	}
+
+	// a trailing slash in the configured issuer is the same issuer
+	provider = NewOIDCProvider(&OIDCConfig{Issuer: issuer.server.URL + "/", ClientId: "files"}, "")
+	if _, err := provider.discover(context.Background()); err != nil {
+		t.Errorf("discover with trailing slash: %v", err)
+	}
+}
+
+func TestOIDCDiscoverRejects(t *testing.T) {
+	issuer := newTestIssuer(t)
+	issuer.issuer = "https://evil.test"
+
+	provider := issuer.provider()
+	if _, err := provider.discover(context.Background()); err == nil {
+		t.Error("discovery naming another issuer was accepted")
+	}
+	if provider.discovery != nil {
+		t.Error("failed discovery was cached")
+	}
+
+	missing := NewOIDCProvider(&OIDCConfig{Issuer: issuer.server.URL + "/missing", ClientId: "files"}, "")
+	if _, err := missing.discover(context.Background()); err == nil {
+		t.Error("discovery of an issuer without a configuration succeeded")
+	}
+}
+
+func TestOIDCOAuth2ConfigScopes(t *testing.T) {
+	provider := NewOIDCProvider(&OIDCConfig{ClientId: "files", Scopes: []string{"email", "groups"}}, "")
+	config := provider.oauth2Config(&oidcDiscovery{})
+	if strings.Join(config.Scopes, " ") != "openid email groups" {
+		t.Errorf("scopes = %v, want openid added in front", config.Scopes)
+	}
+}
+
+func TestOIDCVerifyIDToken(t *testing.T) {
+	issuer := newTestIssuer(t)
+	rsaKey, ecKey := testRSAKey(t), testECKey(t)
+	otherRSA, otherEC := testRSAKey(t), testECKey(t)
+	issuer.setKeys(map[string]crypto.Signer{"rsa": rsaKey, "ec": ecKey})
+
+	provider := issuer.provider()
+	discovery, err := provider.discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	with := func(changes map[string]interface{}) map[string]interface{} {
+		claims := issuer.claims()
+		for name, value := range changes {
+			if value == nil {
+				delete(claims, name)
+			} else {
+				claims[name] = value
+			}
+		}
+		return claims
+	}
+
+	cases := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"rs256", signTestToken(t, rsaKey, "RS256", "rsa", issuer.claims()), true},
+		{"es256", signTestToken(t, ecKey, "ES256", "ec", issuer.claims()), true},
+		{"audience list", signTestToken(t, rsaKey, "RS256", "rsa", with(map[string]interface{}{"aud": []string{"other", "files"}})), true},
+
+		{"wrong nonce", signTestToken(t, rsaKey, "RS256", "rsa", with(map[string]interface{}{"nonce": "nonce-2"})), false},
+		{"no nonce", signTestToken(t, rsaKey, "RS256", "rsa", with(map[string]interface{}{"nonce": nil})), false},
+		{"wrong audience", signTestToken(t, rsaKey, "RS256", "rsa", with(map[string]interface{}{"aud": "other"})), false},
+		{"audience list without client", signTestToken(t, ecKey, "ES256", "ec", with(map[string]interface{}{"aud": []string{"other"}})), false},
+		{"no audience", signTestToken(t, rsaKey, "RS256", "rsa", with(map[string]interface{}{"aud": nil})), false},
+		{"wrong issuer", signTestToken(t, rsaKey, "RS256", "rsa", with(map[string]interface{}{"iss": "https://evil.test"})), false},
+		{"no issuer", signTestToken(t, ecKey, "ES256", "ec", with(map[string]interface{}{"iss": nil})), false},
+		{"expired", signTestToken(t, rsaKey, "RS256", "rsa", with(map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()})), false},
+		{"no expiry", signTestToken(t, ecKey, "ES256", "ec", with(map[string]interface{}{"exp": nil})), false},
+		{"no subject", signTestToken(t, rsaKey, "RS256", "rsa", with(map[string]interface{}{"sub": nil})), false},
+
+		{"rsa key claimed as es256", signTestToken(t, rsaKey, "ES256", "rsa", issuer.claims()), false},
+		{"ec key claimed as rs256", signTestToken(t, ecKey, "RS256", "ec", issuer.claims()), false},
+		{"rs256 under the ec kid", signTestToken(t, rsaKey, "RS256", "ec", issuer.claims()), false},
+		{"rs256 by another key", signTestToken(t, otherRSA, "RS256", "rsa", issuer.claims()), false},
+		{"es256 by another key", signTestToken(t, otherEC, "ES256", "ec", issuer.claims()), false},
+		{"unknown kid", signTestToken(t, rsaKey, "RS256", "missing", issuer.claims()), false},
+		{"alg none", strings.Join(strings.Split(signTestToken(t, rsaKey, "none", "rsa", issuer.claims()), ".")[:2], ".") + ".", false},
+		{"malformed", "not-a-token", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			claims, err := provider.verifyIDToken(context.Background(), discovery, c.token, "nonce-1")
+			if c.valid && err != nil {
+				t.Fatalf("valid token rejected: %v", err)
+			} else if !c.valid && err == nil {
+				t.Fatalf("invalid token accepted with claims %v", claims)
+			}
+			if c.valid && claims["sub"] != "user-1" {
+				t.Errorf("sub = %v", claims["sub"])
+			}
+		})
+	}
+}
+
+func TestOIDCVerifyIDTokenTampered(t *testing.T) {
+	issuer := newTestIssuer(t)
+	key := testRSAKey(t)
+	issuer.setKeys(map[string]crypto.Signer{"rsa": key})
+
+	provider := issuer.provider()
+	discovery, err := provider.discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(signTestToken(t, key, "RS256", "rsa", issuer.claims()), ".")
+	claims := issuer.claims()
+	claims["sub"] = "admin"
+	payload, _ := json.Marshal(claims)
+	parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+
+	_, err = provider.verifyIDToken(context.Background(), discovery, strings.Join(parts, "."), "nonce-1")
+	if err == nil {
+		t.Error("token with a swapped payload was accepted")
+	}
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	issuer := newTestIssuer(t)
+	first, second, replaced := testRSAKey(t), testECKey(t), testRSAKey(t)
+	issuer.setKeys(map[string]crypto.Signer{"first": first})
+
+	provider := issuer.provider()
+	discovery, err := provider.discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify := func(key crypto.Signer, alg, kid string) error {
+		token := signTestToken(t, key, alg, kid, issuer.claims())
+		_, err := provider.verifyIDToken(context.Background(), discovery, token, "nonce-1")
+		return err
+	}
+	requests := func() int {
+		issuer.Lock()
+		defer issuer.Unlock()
+		return issuer.jwksRequests
+	}
+
+	if err := verify(first, "RS256", "first"); err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(first, "RS256", "first"); err != nil {
+		t.Fatal(err)
+	}
+	if n := requests(); n != 1 {
+		t.Errorf("keys fetched %d times, want them cached after the first", n)
+	}
+
+	// a new key id is fetched when it shows up
+	issuer.setKeys(map[string]crypto.Signer{"first": first, "second": second})
+	if err := verify(second, "ES256", "second"); err != nil {
+		t.Errorf("token signed by a new key: %v", err)
+	}
+	if n := requests(); n != 2 {
+		t.Errorf("keys fetched %d times, want 2", n)
+	}
+
+	// retired keys stop verifying once the keys are fetched again
+	issuer.setKeys(map[string]crypto.Signer{"second": second})
+	if err := verify(second, "RS256", "missing"); err == nil {
+		t.Error("token with an unknown key id was accepted")
+	}
+	if err := verify(first, "RS256", "first"); err == nil {
+		t.Error("token signed by a retired key was accepted")
+	}
+
+	// a key replaced under the same id is picked up when the old one fails
+	issuer.setKeys(map[string]crypto.Signer{"second": replaced})
+	if err := verify(replaced, "RS256", "second"); err != nil {
+		t.Errorf("token signed by a key replaced under the same id: %v", err)
+	}
+	if err := verify(second, "ES256", "second"); err == nil {
+		t.Error("token signed by the key that was replaced was accepted")
+	}
+}
+
+func TestOIDCJWKRejectsUnsupported(t *testing.T) {
+	for _, jwk := range []oidcJWK{
+		{Kty: "oct", Kid: "hmac"},
+		{Kty: "EC", Kid: "p384", Crv: "P-384", X: "AA", Y: "AA"},
+		{Kty: "RSA", Kid: "broken", N: "!!", E: "AQAB"},
+	} {
+		if _, err := jwk.publicKey(); err == nil {
+			t.Errorf("jwk %s was accepted", jwk.Kid)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package files
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alioygur/gores"
+)
+
+const (
+	RateLimitShare   = "share"
+	RateLimitAuth    = "auth"
+	RateLimitDefault = "default"
+)
+
+// idle buckets and failures are swept this often, so addresses that stop
+// making requests don't stay in memory
+const rateLimitSweepInterval = time.Minute
+
+// tokenBucket holds up to burst tokens, refilled at rate per second.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// RateLimiter is an in memory token bucket limiter with a bucket per key.
+type RateLimiter struct {
+	rate  float64
+	burst float64
+
+	sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func NewRateLimiter(requests int, per time.Duration, burst int) *RateLimiter {
+	if burst <= 0 {
+		burst = requests
+	}
+
+	return &RateLimiter{
+		rate:    float64(requests) / per.Seconds(),
+		burst:   float64(burst),
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+// Allow takes a token from the bucket of key, returning how long until one
+// is available when the bucket is empty.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	now := time.Now()
+
+	l.Lock()
+	defer l.Unlock()
+	l.sweep(now)
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate)
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	}
+
+	bucket.tokens--
+	return true, 0
+}
+
+// sweep drops buckets that have refilled, they are the same as new ones.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+const (
+	// a few mistakes, like a mistyped share code, go unpunished
+	backoffFreeFailures = 3
+	backoffBase         = time.Second
+	backoffMax          = 15 * time.Minute
+	// failures are forgotten once there haven't been any for this long
+	backoffReset = time.Hour
+)
+
+type backoffEntry struct {
+	failures int
+	last     time.Time
+	until    time.Time
+}
+
+// Backoff blocks keys for exponentially longer after each failure, to slow
+// down guessing share codes, api keys and passwords.
+type Backoff struct {
+	sync.Mutex
+	entries   map[string]*backoffEntry
+	lastSweep time.Time
+}
+
+func NewBackoff() *Backoff {
+	return &Backoff{entries: map[string]*backoffEntry{}}
+}
+
+// Fail records a failure for key.
+func (b *Backoff) Fail(key string) {
+	now := time.Now()
+
+	b.Lock()
+	defer b.Unlock()
+	b.sweep(now)
+
+	entry, ok := b.entries[key]
+	if !ok || now.Sub(entry.last) > backoffReset {
+		entry = &backoffEntry{}
+		b.entries[key] = entry
+	}
+
+	entry.failures++
+	entry.last = now
+	if entry.failures > backoffFreeFailures {
+		delay := backoffMax
+		if shift := entry.failures - backoffFreeFailures - 1; shift < 20 {
+			delay = min(backoffBase<<shift, backoffMax)
+		}
+		entry.until = now.Add(delay)
+	}
+}
+
+// Blocked returns how long key is blocked for, zero when it isn't.
+func (b *Backoff) Blocked(key string) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+
+	entry, ok := b.entries[key]
+	if !ok {
+		return 0
+	}
+	return max(time.Until(entry.until), 0)
+}
+
+func (b *Backoff) sweep(now time.Time) {
+	if now.Sub(b.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	b.lastSweep = now
+
+	for key, entry := range b.entries {
+		if now.Sub(entry.last) > backoffReset {
+			delete(b.entries, key)
+		}
+	}
+}
+
+// rateLimitClass sorts requests into the classes limits are configured for.
+// Anything presenting a share code or credentials can be used for guessing,
+// so those are limited separately from everything else.
+func rateLimitClass(r *http.Request) string {
+	switch {
+	case r.URL.Query().Has("sc"), strings.HasPrefix(r.URL.Path, "/s/"), strings.HasPrefix(r.URL.Path, "/r/"):
+		return RateLimitShare
+	case r.Header.Get("Authorization") != "",
+		r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/login"),
+		r.Method == http.MethodPost && (r.URL.Path == "/account/password" || r.URL.Path == "/account/totp/disable"),
+		strings.HasSuffix(r.URL.Path, "/login/callback"):
+		return RateLimitAuth
+	}
+	return RateLimitDefault
+}
+
+// rateLimitKey is the user a request comes from when their session says so,
+// and otherwise the address it comes from.
+func (h *HTTPService) rateLimitKey(r *http.Request) string {
+	if session := h.authStore.GetSession(r); session != nil {
+		if userId := SessionUserId(session); userId != "" {
+			return "user:" + userId
+		}
+	}
+	return "ip:" + requestIP(r)
+}
+
+// rateLimit is middleware applying the limit of the class of each request,
+// along with the backoff of addresses that failed to present valid share
+// codes or credentials.
+func (h *HTTPService) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		class := rateLimitClass(r)
+
+		if class != RateLimitDefault {
+			if wait := h.authStore.backoff.Blocked(requestIP(r)); wait > 0 {
+				tooManyRequests(w, r, wait)
+				return
+			}
+		}
+
+		if limiter := h.rateLimiters[class]; limiter != nil {
+			if ok, wait := limiter.Allow(h.rateLimitKey(r)); !ok {
+				tooManyRequests(w, r, wait)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func tooManyRequests(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		apiErrorResponse(w, NewStatusError(http.StatusTooManyRequests, "too many requests"))
+		return
+	}
+	gores.Error(w, http.StatusTooManyRequests, "too many requests")
+}
+
+// newRateLimiters builds the limiter of every class that is limited.
+func newRateLimiters(config *HTTPConfig) map[string]*RateLimiter {
+	limiters := map[string]*RateLimiter{}
+	for class, limit := range config.RateLimits() {
+		if limit.Requests > 0 {
+			per, _ := limit.Period()
+			limiters[class] = NewRateLimiter(limit.Requests, per, limit.Burst)
+		}
+	}
+	return limiters
+}
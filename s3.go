@@ -0,0 +1,355 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Backend serves a volume from a bucket on any S3 compatible object store.
+// Directories only exist implicitly as key prefixes, MkdirAll writes an empty
+// "dir/" marker object so that empty directories survive.
+type S3Backend struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func NewS3Backend(config *S3Config, prefix string) (*S3Backend, error) {
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+		Secure: !config.Insecure,
+		Region: config.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3Backend{
+		client: client,
+		bucket: config.Bucket,
+		prefix: strings.Trim(prefix, "/"),
+	}, nil
+}
+
+// key maps a volume path onto an object key, resolving any ".." lexically so
+// it can never climb out of the configured prefix.
+func (b *S3Backend) key(p string) string {
+	p = path.Clean("/" + filepath.ToSlash(p))
+	return strings.TrimPrefix(path.Join(b.prefix, p), "/")
+}
+
+func (b *S3Backend) dirPrefix(key string) string {
+	if key == "" {
+		return ""
+	}
+	return key + "/"
+}
+
+func isNoSuchKey(err error) bool {
+	resp := minio.ToErrorResponse(err)
+	return resp.Code == "NoSuchKey" || resp.StatusCode == http.StatusNotFound
+}
+
+func (b *S3Backend) Stat(p string) (fs.FileInfo, error) {
+	ctx := context.Background()
+	key := b.key(p)
+	if key == b.prefix {
+		return &objectInfo{name: path.Base("/" + key), dir: true}, nil
+	}
+
+	obj, err := b.client.StatObject(ctx, b.bucket, key, minio.StatObjectOptions{})
+	if err == nil {
+		return newObjectInfo(obj.Key, obj.Size, obj.LastModified), nil
+	} else if !isNoSuchKey(err) {
+		return nil, err
+	}
+
+	// a directory is any prefix with at least one object under it, stop
+	// listing as soon as the first one shows up
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	objects := b.client.ListObjects(ctx, b.bucket, minio.ListObjectsOptions{
+		Prefix:  b.dirPrefix(key),
+		MaxKeys: 1,
+	})
+	for obj := range objects {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		return &objectInfo{name: path.Base(key), dir: true}, nil
+	}
+
+	return nil, &fs.PathError{Op: "stat", Path: p, Err: fs.ErrNotExist}
+}
+
+func (b *S3Backend) Open(p string) (io.ReadSeekCloser, error) {
+	ctx := context.Background()
+	key := b.key(p)
+
+	_, err := b.client.StatObject(ctx, b.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		if isNoSuchKey(err) {
+			return nil, &fs.PathError{Op: "open", Path: p, Err: fs.ErrNotExist}
+		}
+		return nil, err
+	}
+
+	return b.client.GetObject(ctx, b.bucket, key, minio.GetObjectOptions{})
+}
+
+func (b *S3Backend) ReadDir(p string) ([]fs.FileInfo, error) {
+	info, err := b.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: p, Err: errors.New("not a directory")}
+	}
+
+	prefix := b.dirPrefix(b.key(p))
+	objects := b.client.ListObjects(context.Background(), b.bucket, minio.ListObjectsOptions{
+		Prefix: prefix,
+	})
+
+	result := []fs.FileInfo{}
+	for obj := range objects {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+
+		// skip the marker object for the directory itself
+		if obj.Key == prefix {
+			continue
+		}
+
+		if strings.HasSuffix(obj.Key, "/") {
+			result = append(result, &objectInfo{name: path.Base(obj.Key), dir: true})
+		} else {
+			result = append(result, newObjectInfo(obj.Key, obj.Size, obj.LastModified))
+		}
+	}
+	return result, nil
+}
+
+func (b *S3Backend) WalkDir(root string, fn fs.WalkDirFunc) error {
+	info, err := b.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = b.walk(root, fs.FileInfoToDirEntry(info), fn)
+	}
+	if errors.Is(err, fs.SkipDir) || errors.Is(err, fs.SkipAll) {
+		return nil
+	}
+	return err
+}
+
+func (b *S3Backend) walk(p string, d fs.DirEntry, fn fs.WalkDirFunc) error {
+	if err := fn(p, d, nil); err != nil || !d.IsDir() {
+		if errors.Is(err, fs.SkipDir) && d.IsDir() {
+			err = nil
+		}
+		return err
+	}
+
+	entries, err := b.ReadDir(p)
+	if err != nil {
+		err = fn(p, d, err)
+		if err != nil {
+			if errors.Is(err, fs.SkipDir) && d.IsDir() {
+				err = nil
+			}
+			return err
+		}
+	}
+
+	for _, entry := range entries {
+		err := b.walk(filepath.Join(p, entry.Name()), fs.FileInfoToDirEntry(entry), fn)
+		if err != nil {
+			if errors.Is(err, fs.SkipDir) {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Create streams the object to the store, S3 only makes it visible once the
+// upload completes.
+func (b *S3Backend) Create(p string) (FileWriter, error) {
+	key := b.key(p)
+	if key == b.prefix {
+		return nil, &fs.PathError{Op: "create", Path: p, Err: fs.ErrInvalid}
+	}
+
+	pr, pw := io.Pipe()
+	w := &objectWriter{pw: pw, done: make(chan error, 1)}
+
+	go func() {
+		_, err := b.client.PutObject(context.Background(), b.bucket, key, pr, -1, minio.PutObjectOptions{
+			ContentType: mime.TypeByExtension(path.Ext(key)),
+			// without a part size the client sizes its buffer for a 5TiB object
+			PartSize: 16 << 20,
+		})
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+
+	return w, nil
+}
+
+// Append isn't possible on S3, objects can only be replaced as a whole.
+func (b *S3Backend) Append(p string) (io.WriteCloser, error) {
+	return nil, errors.ErrUnsupported
+}
+
+// Rename copies objects to their new key and removes the old ones, unlike on
+// a local disk this isn't atomic. Directories are moved object by object.
+func (b *S3Backend) Rename(from, to string) error {
+	fromKey, toKey := b.key(from), b.key(to)
+	if fromKey == b.prefix || toKey == b.prefix {
+		return &fs.PathError{Op: "rename", Path: from, Err: fs.ErrInvalid}
+	}
+
+	info, err := b.Stat(from)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return b.renameObject(fromKey, toKey)
+	}
+
+	fromPrefix, toPrefix := b.dirPrefix(fromKey), b.dirPrefix(toKey)
+	objects := b.client.ListObjects(context.Background(), b.bucket, minio.ListObjectsOptions{
+		Prefix:    fromPrefix,
+		Recursive: true,
+	})
+	for obj := range objects {
+		if obj.Err != nil {
+			return obj.Err
+		}
+
+		err = b.renameObject(obj.Key, toPrefix+strings.TrimPrefix(obj.Key, fromPrefix))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *S3Backend) renameObject(fromKey, toKey string) error {
+	_, err := b.client.CopyObject(context.Background(),
+		minio.CopyDestOptions{Bucket: b.bucket, Object: toKey},
+		minio.CopySrcOptions{Bucket: b.bucket, Object: fromKey},
+	)
+	if err != nil {
+		if isNoSuchKey(err) {
+			return &fs.PathError{Op: "rename", Path: fromKey, Err: fs.ErrNotExist}
+		}
+		return err
+	}
+
+	return b.client.RemoveObject(context.Background(), b.bucket, fromKey, minio.RemoveObjectOptions{})
+}
+
+func (b *S3Backend) Remove(p string) error {
+	key := b.key(p)
+	if key == b.prefix {
+		return &fs.PathError{Op: "remove", Path: p, Err: fs.ErrInvalid}
+	}
+	return b.client.RemoveObject(context.Background(), b.bucket, key, minio.RemoveObjectOptions{})
+}
+
+func (b *S3Backend) RemoveAll(p string) error {
+	ctx := context.Background()
+	key := b.key(p)
+	if key == b.prefix {
+		return &fs.PathError{Op: "removeall", Path: p, Err: fs.ErrInvalid}
+	}
+
+	err := b.client.RemoveObject(ctx, b.bucket, key, minio.RemoveObjectOptions{})
+	if err != nil && !isNoSuchKey(err) {
+		return err
+	}
+
+	objects := b.client.ListObjects(ctx, b.bucket, minio.ListObjectsOptions{
+		Prefix:    b.dirPrefix(key),
+		Recursive: true,
+	})
+	for result := range b.client.RemoveObjects(ctx, b.bucket, objects, minio.RemoveObjectsOptions{}) {
+		if result.Err != nil {
+			return result.Err
+		}
+	}
+	return nil
+}
+
+func (b *S3Backend) MkdirAll(p string) error {
+	key := b.key(p)
+	if key == b.prefix {
+		return nil
+	}
+
+	_, err := b.client.PutObject(context.Background(), b.bucket, b.dirPrefix(key), strings.NewReader(""), 0, minio.PutObjectOptions{})
+	return err
+}
+
+// objectWriter streams writes into a PutObject running in the background, the
+// upload is only complete once Close returns.
+type objectWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (w *objectWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *objectWriter) Close() error {
+	w.pw.Close()
+	return <-w.done
+}
+
+// Abort fails the running PutObject, which never completes the object.
+func (w *objectWriter) Abort() error {
+	w.pw.CloseWithError(errors.New("write aborted"))
+	<-w.done
+	return nil
+}
+
+type objectInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func newObjectInfo(key string, size int64, modTime time.Time) *objectInfo {
+	return &objectInfo{name: path.Base(key), size: size, modTime: modTime}
+}
+
+func (o *objectInfo) Name() string       { return o.name }
+func (o *objectInfo) Size() int64        { return o.size }
+func (o *objectInfo) ModTime() time.Time { return o.modTime }
+func (o *objectInfo) IsDir() bool        { return o.dir }
+func (o *objectInfo) Sys() any           { return nil }
+
+func (o *objectInfo) Mode() fs.FileMode {
+	if o.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
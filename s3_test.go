@@ -0,0 +1,733 @@
+package files
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is just enough of an S3 server in memory for the calls the backend
+// makes, in a single bucket. It ignores signatures.
+type fakeS3 struct {
+	bucket string
+
+	sync.Mutex
+	objects    map[string][]byte
+	uploads    map[string]map[int][]byte
+	nextUpload int
+}
+
+type fakeS3Contents struct {
+	Key          string
+	Size         int64
+	LastModified string
+	ETag         string
+}
+
+type fakeS3Prefix struct {
+	Prefix string
+}
+
+type fakeS3ListResult struct {
+	XMLName        xml.Name `xml:"ListBucketResult"`
+	Name           string
+	Prefix         string
+	Delimiter      string `xml:",omitempty"`
+	KeyCount       int
+	MaxKeys        int
+	IsTruncated    bool
+	Contents       []fakeS3Contents
+	CommonPrefixes []fakeS3Prefix
+}
+
+var fakeS3ModTime = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func fakeETag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func fakeS3Error(w http.ResponseWriter, r *http.Request, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+	}
+}
+
+func fakeS3XML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
+
+// readFakeS3Body reads a request body, undoing the aws-chunked encoding that
+// signed streaming uploads use.
+func readFakeS3Body(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+
+	var data []byte
+	reader := bufio.NewReader(r.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			// anything after the last chunk is trailers
+			return data, nil
+		}
+
+		chunk := make([]byte, size+2)
+		_, err = io.ReadFull(reader, chunk)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, chunk[:size]...)
+	}
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != s.bucket {
+		fakeS3Error(w, r, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	query := r.URL.Query()
+
+	s.Lock()
+	defer s.Unlock()
+
+	switch {
+	case key == "" && r.Method == http.MethodGet && query.Has("location"):
+		fakeS3XML(w, struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+		}{})
+	case key == "" && r.Method == http.MethodGet:
+		s.list(w, query)
+	case key == "" && r.Method == http.MethodPost && query.Has("delete"):
+		s.deleteObjects(w, r)
+	case key == "":
+		fakeS3Error(w, r, http.StatusNotImplemented, "NotImplemented")
+
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		s.get(w, r, key)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		s.copy(w, r, key)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		parts, ok := s.uploads[query.Get("uploadId")]
+		if !ok {
+			fakeS3Error(w, r, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		data, err := readFakeS3Body(r)
+		if err != nil {
+			fakeS3Error(w, r, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		parts[number] = data
+		w.Header().Set("ETag", fakeETag(data))
+	case r.Method == http.MethodPut:
+		data, err := readFakeS3Body(r)
+		if err != nil {
+			fakeS3Error(w, r, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		s.objects[key] = data
+		w.Header().Set("ETag", fakeETag(data))
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.nextUpload++
+		uploadId := strconv.Itoa(s.nextUpload)
+		s.uploads[uploadId] = map[int][]byte{}
+		fakeS3XML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: uploadId})
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		s.completeUpload(w, r, key, query.Get("uploadId"))
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fakeS3Error(w, r, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (s *fakeS3) get(w http.ResponseWriter, r *http.Request, key string) {
+	data, ok := s.objects[key]
+	if !ok {
+		fakeS3Error(w, r, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+
+	w.Header().Set("ETag", fakeETag(data))
+	w.Header().Set("Last-Modified", fakeS3ModTime.Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	status := http.StatusOK
+	body := data
+	if spec, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes="); ok {
+		rawStart, rawEnd, _ := strings.Cut(spec, "-")
+		start, _ := strconv.Atoi(rawStart)
+		end := len(data) - 1
+		if rawEnd != "" {
+			end, _ = strconv.Atoi(rawEnd)
+			end = min(end, len(data)-1)
+		}
+		if start > end {
+			fakeS3Error(w, r, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+			return
+		}
+		body = data[start : end+1]
+		status = http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		w.Write(body)
+	}
+}
+
+func (s *fakeS3) copy(w http.ResponseWriter, r *http.Request, key string) {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		fakeS3Error(w, r, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	_, sourceKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+
+	data, ok := s.objects[sourceKey]
+	if !ok {
+		fakeS3Error(w, r, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	s.objects[key] = slices.Clone(data)
+
+	fakeS3XML(w, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		ETag         string
+		LastModified string
+	}{ETag: fakeETag(data), LastModified: fakeS3ModTime.Format(time.RFC3339)})
+}
+
+func (s *fakeS3) completeUpload(w http.ResponseWriter, r *http.Request, key, uploadId string) {
+	parts, ok := s.uploads[uploadId]
+	if !ok {
+		fakeS3Error(w, r, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	delete(s.uploads, uploadId)
+
+	numbers := slices.Sorted(maps.Keys(parts))
+	var data []byte
+	for _, number := range numbers {
+		data = append(data, parts[number]...)
+	}
+	s.objects[key] = data
+
+	fakeS3XML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}{Bucket: s.bucket, Key: key, ETag: fakeETag(data)})
+}
+
+func (s *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	result := fakeS3ListResult{Name: s.bucket, Prefix: prefix, Delimiter: delimiter, MaxKeys: 1000}
+
+	seen := map[string]bool{}
+	for _, key := range slices.Sorted(maps.Keys(s.objects)) {
+		rest, ok := strings.CutPrefix(key, prefix)
+		if !ok {
+			continue
+		}
+
+		if delimiter != "" {
+			if i := strings.Index(rest, delimiter); i >= 0 {
+				common := prefix + rest[:i+len(delimiter)]
+				if !seen[common] {
+					seen[common] = true
+					result.CommonPrefixes = append(result.CommonPrefixes, fakeS3Prefix{Prefix: common})
+				}
+				continue
+			}
+		}
+
+		data := s.objects[key]
+		result.Contents = append(result.Contents, fakeS3Contents{
+			Key:          key,
+			Size:         int64(len(data)),
+			LastModified: fakeS3ModTime.Format(time.RFC3339),
+			ETag:         fakeETag(data),
+		})
+	}
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+
+	fakeS3XML(w, result)
+}
+
+func (s *fakeS3) deleteObjects(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Object []struct {
+			Key string
+		}
+	}
+	err := xml.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		fakeS3Error(w, r, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+
+	result := struct {
+		XMLName xml.Name `xml:"DeleteResult"`
+		Deleted []fakeS3Prefix
+	}{}
+	for _, object := range request.Object {
+		delete(s.objects, object.Key)
+		result.Deleted = append(result.Deleted, fakeS3Prefix{Prefix: object.Key})
+	}
+	fakeS3XML(w, result)
+}
+
+// keys returns every key in the bucket, sorted.
+func (s *fakeS3) keys() []string {
+	s.Lock()
+	defer s.Unlock()
+	return slices.Sorted(maps.Keys(s.objects))
+}
+
+// newTestS3Backend returns a backend for prefix in a bucket of a fake S3
+// server, along with the server to look at the bucket directly.
+func newTestS3Backend(t *testing.T, prefix string) (*S3Backend, *fakeS3) {
+	t.Helper()
+
+	fake := &fakeS3{bucket: "files", objects: map[string][]byte{}, uploads: map[string]map[int][]byte{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	endpoint, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend, err := NewS3Backend(&S3Config{
+		Endpoint:  endpoint.Host,
+		Bucket:    "files",
+		Region:    "us-east-1",
+		AccessKey: "access",
+		SecretKey: "secret",
+		Insecure:  true,
+	}, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend, fake
+}
+
+func writeTestFile(t *testing.T, backend Backend, p, content string) {
+	t.Helper()
+
+	w, err := backend.Create(p)
+	if err != nil {
+		t.Fatalf("create %s: %v", p, err)
+	}
+	_, err = io.WriteString(w, content)
+	if err != nil {
+		t.Fatalf("write %s: %v", p, err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("close %s: %v", p, err)
+	}
+}
+
+func readTestFile(t *testing.T, backend Backend, p string) string {
+	t.Helper()
+
+	r, err := backend.Open(p)
+	if err != nil {
+		t.Fatalf("open %s: %v", p, err)
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read %s: %v", p, err)
+	}
+	return string(data)
+}
+
+func TestS3BackendKey(t *testing.T) {
+	backend := &S3Backend{prefix: "volume"}
+
+	cases := []struct {
+		path string
+		key  string
+	}{
+		{"", "volume"},
+		{"/", "volume"},
+		{"a.txt", "volume/a.txt"},
+		{"/dir/a.txt", "volume/dir/a.txt"},
+		{"dir/./a.txt", "volume/dir/a.txt"},
+		{"../a.txt", "volume/a.txt"},
+		{"dir/../../../a.txt", "volume/a.txt"},
+		{"/../volume-other/a.txt", "volume/volume-other/a.txt"},
+	}
+	for _, c := range cases {
+		if key := backend.key(c.path); key != c.key {
+			t.Errorf("key(%q) = %q, want %q", c.path, key, c.key)
+		}
+	}
+
+	unprefixed := &S3Backend{}
+	if key := unprefixed.key("../dir/a.txt"); key != "dir/a.txt" {
+		t.Errorf("key without prefix = %q, want %q", key, "dir/a.txt")
+	}
+}
+
+func TestS3BackendCreateOpenStat(t *testing.T) {
+	backend, client := newTestS3Backend(t, "volume")
+
+	writeTestFile(t, backend, "dir/a.txt", "hello")
+
+	if content := readTestFile(t, backend, "dir/a.txt"); content != "hello" {
+		t.Errorf("content = %q, want %q", content, "hello")
+	}
+	if keys := client.keys(); !slices.Equal(keys, []string{"volume/dir/a.txt"}) {
+		t.Errorf("keys = %v", keys)
+	}
+
+	info, err := backend.Stat("dir/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.IsDir() || info.Size() != 5 || info.Name() != "a.txt" {
+		t.Errorf("stat file = %v %v %v", info.Name(), info.IsDir(), info.Size())
+	}
+
+	// directories only exist as prefixes
+	info, err = backend.Stat("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir() || info.Name() != "dir" {
+		t.Errorf("stat dir = %v %v", info.Name(), info.IsDir())
+	}
+
+	info, err = backend.Stat("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir() {
+		t.Error("root isn't a directory")
+	}
+
+	// a prefix that only shares the start of a name isn't a directory
+	_, err = backend.Stat("di")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("stat partial prefix = %v, want not exist", err)
+	}
+	_, err = backend.Open("missing.txt")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("open missing = %v, want not exist", err)
+	}
+
+	_, err = backend.Create("/")
+	if !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("create root = %v, want invalid", err)
+	}
+}
+
+func TestS3BackendOpenSeek(t *testing.T) {
+	backend, _ := newTestS3Backend(t, "")
+
+	writeTestFile(t, backend, "a.txt", "0123456789")
+
+	r, err := backend.Open("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	_, err = r.Seek(4, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 3)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "456" {
+		t.Errorf("read after seek = %q, want %q", data, "456")
+	}
+}
+
+func TestS3BackendAbort(t *testing.T) {
+	backend, client := newTestS3Backend(t, "volume")
+
+	w, err := backend.Create("partial.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.WriteString(w, "half of it")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Abort()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := client.keys(); len(keys) != 0 {
+		t.Errorf("aborted write left %v", keys)
+	}
+	_, err = backend.Stat("partial.txt")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("stat aborted = %v, want not exist", err)
+	}
+}
+
+func TestS3BackendAppend(t *testing.T) {
+	backend, _ := newTestS3Backend(t, "")
+
+	_, err := backend.Append("a.txt")
+	if !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("append = %v, want unsupported", err)
+	}
+}
+
+func TestS3BackendReadDir(t *testing.T) {
+	backend, _ := newTestS3Backend(t, "volume")
+
+	writeTestFile(t, backend, "a.txt", "a")
+	writeTestFile(t, backend, "dir/b.txt", "bb")
+	writeTestFile(t, backend, "dir/sub/c.txt", "ccc")
+	err := backend.MkdirAll("empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := backend.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	if want := []string{"a.txt", "dir/", "empty/"}; !slices.Equal(names, want) {
+		t.Errorf("root entries = %v, want %v", names, want)
+	}
+
+	// the marker of an empty directory doesn't show up as an entry
+	entries, err = backend.ReadDir("empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("empty dir has %d entries", len(entries))
+	}
+
+	_, err = backend.ReadDir("a.txt")
+	if err == nil {
+		t.Error("readdir of a file succeeded")
+	}
+	_, err = backend.ReadDir("missing")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("readdir missing = %v, want not exist", err)
+	}
+}
+
+func TestS3BackendWalkDir(t *testing.T) {
+	backend, _ := newTestS3Backend(t, "volume")
+
+	writeTestFile(t, backend, "a.txt", "a")
+	writeTestFile(t, backend, "dir/b.txt", "b")
+	writeTestFile(t, backend, "dir/sub/c.txt", "c")
+	writeTestFile(t, backend, "skip/d.txt", "d")
+
+	var walked []string
+	err := backend.WalkDir("/", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == "skip" {
+			return fs.SkipDir
+		}
+		walked = append(walked, p)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(walked)
+	want := []string{"/", "/a.txt", "/dir", "/dir/b.txt", "/dir/sub", "/dir/sub/c.txt"}
+	if !slices.Equal(walked, want) {
+		t.Errorf("walked %v, want %v", walked, want)
+	}
+
+	var missingErr error
+	err = backend.WalkDir("missing", func(p string, d fs.DirEntry, err error) error {
+		missingErr = err
+		return err
+	})
+	if !errors.Is(err, fs.ErrNotExist) || !errors.Is(missingErr, fs.ErrNotExist) {
+		t.Errorf("walk missing = %v, callback got %v", err, missingErr)
+	}
+}
+
+func TestS3BackendRename(t *testing.T) {
+	backend, client := newTestS3Backend(t, "volume")
+
+	writeTestFile(t, backend, "a.txt", "a")
+	writeTestFile(t, backend, "dir/b.txt", "b")
+	writeTestFile(t, backend, "dir/sub/c.txt", "c")
+
+	err := backend.Rename("a.txt", "renamed.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content := readTestFile(t, backend, "renamed.txt"); content != "a" {
+		t.Errorf("renamed content = %q", content)
+	}
+
+	err = backend.Rename("dir", "moved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"volume/moved/b.txt", "volume/moved/sub/c.txt", "volume/renamed.txt"}
+	if keys := client.keys(); !slices.Equal(keys, want) {
+		t.Errorf("keys after rename = %v, want %v", keys, want)
+	}
+
+	err = backend.Rename("missing.txt", "other.txt")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("rename missing = %v, want not exist", err)
+	}
+	err = backend.Rename("/", "other")
+	if !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("rename root = %v, want invalid", err)
+	}
+}
+
+func TestS3BackendRemove(t *testing.T) {
+	backend, client := newTestS3Backend(t, "volume")
+
+	writeTestFile(t, backend, "a.txt", "a")
+	writeTestFile(t, backend, "dir/b.txt", "b")
+	writeTestFile(t, backend, "dir/sub/c.txt", "c")
+	writeTestFile(t, backend, "dir-other/d.txt", "d")
+
+	err := backend.Remove("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only what is below dir goes, not its siblings sharing the prefix
+	err = backend.RemoveAll("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := client.keys(); !slices.Equal(keys, []string{"volume/dir-other/d.txt"}) {
+		t.Errorf("keys after remove = %v", keys)
+	}
+
+	err = backend.RemoveAll("missing")
+	if err != nil {
+		t.Errorf("removeall missing = %v", err)
+	}
+	for _, p := range []string{"/", "..", "dir/../.."} {
+		if err := backend.RemoveAll(p); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("removeall %q = %v, want invalid", p, err)
+		}
+		if err := backend.Remove(p); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("remove %q = %v, want invalid", p, err)
+		}
+	}
+}
+
+func TestS3BackendMkdirAll(t *testing.T) {
+	backend, client := newTestS3Backend(t, "volume")
+
+	err := backend.MkdirAll("a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backend.MkdirAll("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := client.keys(); !slices.Equal(keys, []string{"volume/a/b/"}) {
+		t.Errorf("keys = %v", keys)
+	}
+	for _, p := range []string{"a", "a/b"} {
+		info, err := backend.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.IsDir() {
+			t.Errorf("%s isn't a directory", p)
+		}
+	}
+}
+
+func TestS3BackendPrefixIsolation(t *testing.T) {
+	backend, fake := newTestS3Backend(t, "volume")
+
+	fake.objects["secret.txt"] = []byte("secret")
+	fake.objects["volume-other/x.txt"] = []byte("x")
+	writeTestFile(t, backend, "a.txt", "a")
+
+	for _, p := range []string{"../secret.txt", "/../../secret.txt", "../volume-other/x.txt"} {
+		_, err := backend.Open(p)
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("open %q = %v, want not exist", p, err)
+		}
+	}
+
+	entries, err := backend.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "a.txt" {
+		t.Errorf("root entries = %v", entries)
+	}
+}
@@ -4,9 +4,11 @@ import (
 	"errors"
 	"fmt"
 	"io/fs"
+	"log"
 	"net/http"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/alioygur/gores"
 	"github.com/charlievieth/fastwalk"
@@ -15,15 +17,22 @@ import (
 
 var ErrMaxResults = errors.New("max results hit")
 
-func (v *Volume) Search(rootPath string, query string, fuzz bool, maxResults int) ([]*VolumeEntry, error) {
-	root, err := v.path(rootPath)
-	if err != nil {
-		return nil, err
-	}
-
+// Search finds files under rootPath with names matching query, leaving out
+// the ones auth can't see. Directories that can't be read are left out rather
+// than failing the whole search.
+func (v *Volume) Search(rootPath string, query string, fuzz bool, maxResults int, auth Authorization) ([]*VolumeEntry, error) {
+	var lock sync.Mutex
 	results := []*VolumeEntry{}
-	err = fastwalk.Walk(&fastwalk.Config{Follow: false}, root, func(path string, d fs.DirEntry, err error) error {
-		if d.IsDir() {
+	err := v.searchWalk(rootPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if cleanVolumePath(path) == cleanVolumePath(rootPath) {
+				return err
+			}
+			log.Printf("search of %s skipped %s: %v", v.Name, path, err)
+			return nil
+		}
+
+		if d.IsDir() || isInternalPath(path) || !v.Visible(auth, path, false) {
 			return nil
 		}
 
@@ -40,12 +49,18 @@ func (v *Volume) Search(rootPath string, query string, fuzz bool, maxResults int
 			return nil
 		}
 
-		p := filepath.Join(rootPath, strings.TrimPrefix(path, root))
-		entry, err := v.Entry(p)
+		info, err := d.Info()
 		if err != nil {
-			return err
+			// removed while searching
+			return nil
 		}
-		results = append(results, entry)
+
+		lock.Lock()
+		defer lock.Unlock()
+		if len(results) >= maxResults {
+			return ErrMaxResults
+		}
+		results = append(results, NewVolumeEntryFromStat(path, info))
 		if len(results) >= maxResults {
 			return ErrMaxResults
 		}
@@ -62,8 +77,33 @@ func (v *Volume) Search(rootPath string, query string, fuzz bool, maxResults int
 	return results, nil
 }
 
+// searchWalk walks p like WalkDir. Local volumes are walked by several
+// goroutines at once with fastwalk, so fn has to be safe to call
+// concurrently.
+func (v *Volume) searchWalk(p string, fn fs.WalkDirFunc) error {
+	local, ok := v.Backend.(*LocalBackend)
+	if !ok {
+		return v.WalkDir(p, fn)
+	}
+
+	root, err := local.path(p)
+	if err != nil {
+		return err
+	}
+
+	return fastwalk.Walk(&fastwalk.Config{Follow: false}, root, func(path string, d fs.DirEntry, err error) error {
+		rel := strings.TrimPrefix(strings.TrimPrefix(path, root), string(filepath.Separator))
+		path = filepath.Join(p, rel)
+		if err == nil && d.IsDir() && isInternalPath(path) {
+			return fs.SkipDir
+		}
+		return fn(path, d, err)
+	})
+}
+
 func (h *HTTPService) routePostSearch(w http.ResponseWriter, r *http.Request) {
-	volume, _ := h.authStore.GetVolume(w, r, true)
+	path := r.URL.Query().Get("path")
+	volume, auth := h.authStore.GetVolumeAt(w, r, path, PermissionSearch)
 	if volume == nil {
 		return
 	}
@@ -73,7 +113,6 @@ func (h *HTTPService) routePostSearch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	path := r.URL.Query().Get("path")
 	err := r.ParseForm()
 	if err != nil {
 		gores.Error(w, http.StatusBadRequest, "invalid form data")
@@ -81,20 +120,24 @@ func (h *HTTPService) routePostSearch(w http.ResponseWriter, r *http.Request) {
 	}
 
 	query := strings.ToLower(r.Form.Get("search"))
-	results, err := volume.Search(path, query, r.URL.Query().Has("fuzzy"), 100)
+	results, err := volume.Search(path, query, r.URL.Query().Has("fuzzy"), 100, auth)
 	if err != nil {
+		RecordAudit(r, auth, AuditEvent{Action: "search", Volume: volume.Name, Path: path, Result: AuditFailure, Detail: query})
 		gores.HTML(w, http.StatusOK, fmt.Sprintf("<div>Failed to search: %s</div>", err))
 		return
 	}
 
-	h.templateFragment(w, "search-results", map[string]interface{}{
+	RecordAudit(r, auth, AuditEvent{Action: "search", Volume: volume.Name, Path: path, Detail: query})
+
+	h.templateFragment(w, r, "search-results", map[string]interface{}{
 		"Results": results,
 		"Volume":  volume,
 	})
 }
 
 func (h *HTTPService) routeGetSearch(w http.ResponseWriter, r *http.Request) {
-	volume, _ := h.authStore.GetVolume(w, r, true)
+	path := r.URL.Query().Get("path")
+	volume, _ := h.authStore.GetVolumeAt(w, r, path, PermissionSearch)
 	if volume == nil {
 		return
 	}
@@ -104,9 +147,7 @@ func (h *HTTPService) routeGetSearch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	path := r.URL.Query().Get("path")
-
-	h.template(w, "static/search.html", map[string]interface{}{
+	h.template(w, r, "static/search.html", map[string]interface{}{
 		"Volume": volume,
 		"Path":   path,
 	})
@@ -0,0 +1,120 @@
+package files
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// brokenDirBackend fails to read one directory, like one without permission.
+type brokenDirBackend struct {
+	Backend
+	broken string
+}
+
+func (b *brokenDirBackend) WalkDir(p string, fn fs.WalkDirFunc) error {
+	return b.Backend.WalkDir(p, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && b.broken != "" && path == b.broken {
+			// the directory can't be read, so there is nothing to go into
+			err = fn(path, d, errors.New("permission denied"))
+			if err == nil {
+				err = fs.SkipDir
+			}
+			return err
+		}
+		return fn(path, d, err)
+	})
+}
+
+func newTestSearchVolume(t *testing.T) (*Volume, string) {
+	t.Helper()
+
+	root := t.TempDir()
+	for _, p := range []string{
+		"notes.txt",
+		"docs/notes-2024.txt",
+		"docs/deep/more-notes.md",
+		"docs/other.txt",
+		"broken/notes-hidden.txt",
+		trashDir + "/1/notes.txt",
+		stagingDir + "/tus/notes",
+		"docs/" + tempFilePrefix + "notes",
+	} {
+		err := os.MkdirAll(filepath.Join(root, filepath.Dir(p)), 0755)
+		if err == nil {
+			err = os.WriteFile(filepath.Join(root, p), []byte(p), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &Volume{Name: "v", Backend: NewLocalBackend(root)}, root
+}
+
+func searchPaths(t *testing.T, volume *Volume, root string, query string, max int) []string {
+	t.Helper()
+
+	results, err := volume.Search(root, query, false, max, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := []string{}
+	for _, result := range results {
+		paths = append(paths, filepath.ToSlash(result.Path))
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+func TestVolumeSearch(t *testing.T) {
+	volume, root := newTestSearchVolume(t)
+	backends := map[string]Backend{
+		"local": volume.Backend,
+		"walk":  &brokenDirBackend{Backend: NewLocalBackend(root)},
+	}
+
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			volume := &Volume{Name: "v", Backend: backend}
+
+			got := searchPaths(t, volume, "", "notes", 100)
+			want := []string{"broken/notes-hidden.txt", "docs/deep/more-notes.md", "docs/notes-2024.txt", "notes.txt"}
+			if !slices.Equal(got, want) {
+				t.Errorf("search = %v, want %v", got, want)
+			}
+
+			got = searchPaths(t, volume, "docs", "notes", 100)
+			want = []string{"docs/deep/more-notes.md", "docs/notes-2024.txt"}
+			if !slices.Equal(got, want) {
+				t.Errorf("search in docs = %v, want %v", got, want)
+			}
+
+			if got := searchPaths(t, volume, "", "notes", 2); len(got) != 2 {
+				t.Errorf("search limited to 2 results returned %v", got)
+			}
+		})
+	}
+}
+
+func TestVolumeSearchSkipsUnreadable(t *testing.T) {
+	_, root := newTestSearchVolume(t)
+	volume := &Volume{Name: "v", Backend: &brokenDirBackend{Backend: NewLocalBackend(root), broken: "broken"}}
+
+	got := searchPaths(t, volume, "", "notes", 100)
+	want := []string{"docs/deep/more-notes.md", "docs/notes-2024.txt", "notes.txt"}
+	if !slices.Equal(got, want) {
+		t.Errorf("search = %v, want %v", got, want)
+	}
+
+	if _, err := volume.Search("missing", "notes", false, 100, nil); err == nil {
+		t.Error("search of a missing directory succeeded")
+	}
+	local := &Volume{Name: "v", Backend: NewLocalBackend(root)}
+	if _, err := local.Search("missing", "notes", false, 100, nil); err == nil {
+		t.Error("local search of a missing directory succeeded")
+	}
+}
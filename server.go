@@ -2,10 +2,15 @@ package files
 
 import (
 	"context"
+	"time"
 
 	"github.com/thejerf/suture/v4"
 )
 
+// DatabasePath is where the server keeps its database, relative to where it
+// is started.
+const DatabasePath = "files.db"
+
 type Server struct {
 	config *Config
 }
@@ -19,14 +24,32 @@ func NewServer(config *Config) *Server {
 func (s *Server) Run() error {
 	supervisor := suture.NewSimple("server")
 
-	err := OpenDatabase("files.db")
+	err := OpenDatabase(DatabasePath)
+	if err != nil {
+		panic(err)
+	}
+
+	err = MigrateLegacyShareCodes(s.config.HTTP)
 	if err != nil {
 		panic(err)
 	}
 
-	fileStore := NewFileStore(s.config)
+	fileStore, err := NewFileStore(s.config)
+	if err != nil {
+		panic(err)
+	}
+
+	supervisor.Add(NewShareCodePurger(time.Hour))
+	supervisor.Add(NewUserTokenPurger(time.Hour))
+	supervisor.Add(NewTusUploadPurger(fileStore, time.Hour))
+	supervisor.Add(NewTrashPurger(fileStore, time.Hour))
 
 	if s.config.HTTP != nil {
+		retention, _ := s.config.HTTP.AuditRetentionPeriod()
+		if retention > 0 {
+			supervisor.Add(NewAuditPurger(retention, time.Hour))
+		}
+
 		httpService := NewHTTPService(s.config, fileStore)
 		supervisor.Add(httpService)
 	}
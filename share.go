@@ -0,0 +1,953 @@
+package files
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alioygur/gores"
+	"github.com/dustin/go-humanize"
+	"github.com/go-chi/chi/v5"
+	"github.com/sqids/sqids-go"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const (
+	// ShareKindFile shares exactly one file.
+	ShareKindFile = "file"
+	// ShareKindTree shares a directory and everything below it.
+	ShareKindTree = "tree"
+	// ShareKindUpload is a file request, it lets anyone with the code upload
+	// files into a directory without being able to see what is in it.
+	ShareKindUpload = "upload"
+)
+
+var (
+	ErrShareCodeExpired   = errors.New("share code has expired")
+	ErrShareCodeLocked    = errors.New("share code requires a password")
+	ErrShareCodeExhausted = errors.New("share code has been used up")
+)
+
+type ShareCode struct {
+	Id        uint       `json:"id" gorm:"primaryKey"`
+	Code      string     `json:"code" gorm:"uniqueIndex"`
+	Owner     string     `json:"owner" gorm:"index"`
+	Kind      string     `json:"kind"`
+	Volume    string     `json:"volume"`
+	Path      string     `json:"path"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+
+	PasswordHash string `json:"-"`
+
+	// MaxDownloads limits how often the share can be downloaded, zero is
+	// unlimited. Hits counts every access, Downloads only those that served
+	// file contents.
+	MaxDownloads uint `json:"max_downloads"`
+	Downloads    uint `json:"downloads"`
+	Hits         uint `json:"hits"`
+
+	// File requests can limit the size of each upload and how many files can
+	// be uploaded in total, zero is unlimited.
+	MaxFileSize int64 `json:"max_file_size"`
+	MaxFiles    uint  `json:"max_files"`
+	Files       uint  `json:"files"`
+
+	// LegacyUntil is set on share codes created before codes were random, their
+	// old sqids code keeps resolving until then.
+	LegacyUntil *time.Time `json:"-"`
+}
+
+const (
+	defaultShareCodeLength   = 16
+	defaultShareCodeAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	legacyShareCodeWindow    = 30 * 24 * time.Hour
+)
+
+func generateShareCode(httpConfig *HTTPConfig) (string, error) {
+	length := defaultShareCodeLength
+	alphabet := []rune(defaultShareCodeAlphabet)
+	if httpConfig != nil && httpConfig.ShareCodeLength > 0 {
+		length = httpConfig.ShareCodeLength
+	}
+	if httpConfig != nil && httpConfig.ShareCodeAlphabet != "" {
+		alphabet = []rune(httpConfig.ShareCodeAlphabet)
+	}
+
+	if len(alphabet) < 2 {
+		return "", errors.New("share code alphabet needs at least two characters")
+	}
+
+	max := big.NewInt(int64(len(alphabet)))
+	code := make([]rune, length)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = alphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+var sqid *sqids.Sqids
+
+func init() {
+	it, err := sqids.New()
+	if err != nil {
+		panic(err)
+	}
+	sqid = it
+}
+
+// MigrateLegacyShareCodes gives every share code created before codes were
+// random a new code, keeping the old sequential one working for a while so
+// links already handed out don't break straight away.
+func MigrateLegacyShareCodes(httpConfig *HTTPConfig) error {
+	var legacy []ShareCode
+	err := db.Where("code IS NULL OR code = ''").Find(&legacy).Error
+	if err != nil {
+		return err
+	}
+
+	legacyUntil := time.Now().UTC().Add(legacyShareCodeWindow)
+	for _, shareCode := range legacy {
+		code, err := generateShareCode(httpConfig)
+		if err != nil {
+			return err
+		}
+
+		err = db.Model(&shareCode).Updates(ShareCode{Code: code, LegacyUntil: &legacyUntil}).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(legacy) > 0 {
+		log.Printf("migrated %d legacy share codes", len(legacy))
+	}
+	return nil
+}
+
+func (s *ShareCode) URL(httpConfig *HTTPConfig) string {
+	url := httpConfig.BaseShareURL()
+	if s.Kind == ShareKindUpload {
+		url = fmt.Sprintf("%s/r/%s", httpConfig.BaseURL(), s.Code)
+	} else if url != "" {
+		url = fmt.Sprintf(url, s.Code)
+	} else if s.Kind == ShareKindFile {
+		url = fmt.Sprintf("%s/s/%s?raw", httpConfig.BaseURL(), s.Code)
+	} else {
+		url = fmt.Sprintf("%s/s/%s", httpConfig.BaseURL(), s.Code)
+	}
+	return url
+}
+
+// Covers reports whether path is part of what the share code shares. File
+// shares only cover their own path, tree shares cover their directory and
+// everything inside of it. Share codes from before kinds were recorded are
+// treated as trees, which is what they were matched as before.
+func (s *ShareCode) Covers(path string) bool {
+	root := cleanSharePath(s.Path)
+	path = cleanSharePath(path)
+
+	if s.Kind == ShareKindFile {
+		return path == root
+	}
+
+	return root == "/" || path == root || strings.HasPrefix(path, root+"/")
+}
+
+// cleanSharePath lexically normalizes a volume path so paths can be compared
+// segment by segment.
+func cleanSharePath(path string) string {
+	return filepath.ToSlash(filepath.Clean("/" + path))
+}
+
+func (s *ShareCode) Expired() bool {
+	return s.ExpiresAt != nil && time.Now().After(*s.ExpiresAt)
+}
+
+// CanManage reports whether the share code can be changed or revoked by auth,
+// only its owner and admins can.
+func (s *ShareCode) CanManage(auth Authorization) bool {
+	if auth.IsAdmin() {
+		return true
+	}
+	return s.Owner != "" && s.Owner == auth.Identity()
+}
+
+// SetLifetime moves the expiry of the share code to ttl from now, a zero ttl
+// makes it never expire.
+func (s *ShareCode) SetLifetime(ttl time.Duration) error {
+	var expiresAt *time.Time
+	if ttl > 0 {
+		it := time.Now().UTC().Add(ttl)
+		expiresAt = &it
+	}
+
+	err := db.Model(s).Update("expires_at", expiresAt).Error
+	if err != nil {
+		return err
+	}
+	s.ExpiresAt = expiresAt
+	return nil
+}
+
+func (s *ShareCode) Exhausted() bool {
+	if s.Kind == ShareKindUpload {
+		return s.MaxFiles > 0 && s.Files >= s.MaxFiles
+	}
+	return s.MaxDownloads > 0 && s.Downloads >= s.MaxDownloads
+}
+
+// LimitsDownloads reports whether the share can only be downloaded so many
+// times, so nothing else may read the shared files without counting.
+func (s *ShareCode) LimitsDownloads() bool {
+	return s.Kind != ShareKindUpload && s.MaxDownloads > 0
+}
+
+func (s *ShareCode) HasPassword() bool {
+	return s.PasswordHash != ""
+}
+
+func (s *ShareCode) SetPassword(password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	s.PasswordHash = string(hash)
+	return nil
+}
+
+func (s *ShareCode) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(s.PasswordHash), []byte(password)) == nil
+}
+
+type ShareCodeOptions struct {
+	// Owner is the identity of whoever created the share code.
+	Owner string
+	// Kind is one of the ShareKind constants.
+	Kind string
+	// TTL is how long the share code lives for, zero never expires.
+	TTL time.Duration
+	// Password optionally has to be entered before the share can be used.
+	Password string
+	// MaxDownloads limits how often the share can be downloaded, zero is
+	// unlimited.
+	MaxDownloads uint
+	// MaxFileSize and MaxFiles limit what can be uploaded to a file request,
+	// zero is unlimited.
+	MaxFileSize int64
+	MaxFiles    uint
+}
+
+// ShareCodeAccess records a single request made with a share code.
+type ShareCodeAccess struct {
+	Id          uint      `json:"id" gorm:"primaryKey"`
+	ShareCodeId uint      `json:"share_code_id" gorm:"index"`
+	Path        string    `json:"path"`
+	Download    bool      `json:"download"`
+	Upload      bool      `json:"upload"`
+	IP          string    `json:"ip"`
+	UserAgent   string    `json:"user_agent"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// MakeShareCode creates a new share code for the given path.
+func MakeShareCode(httpConfig *HTTPConfig, volume, path string, opts ShareCodeOptions) (*ShareCode, error) {
+	shareCode := &ShareCode{
+		Owner:        opts.Owner,
+		Kind:         opts.Kind,
+		Volume:       volume,
+		Path:         path,
+		MaxDownloads: opts.MaxDownloads,
+		MaxFileSize:  opts.MaxFileSize,
+		MaxFiles:     opts.MaxFiles,
+	}
+
+	if opts.TTL > 0 {
+		expiresAt := time.Now().UTC().Add(opts.TTL)
+		shareCode.ExpiresAt = &expiresAt
+	}
+
+	if opts.Password != "" {
+		if err := shareCode.SetPassword(opts.Password); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	// codes are random, retry the rare collision against the unique index
+	for attempt := 0; attempt < 3; attempt++ {
+		shareCode.Code, err = generateShareCode(httpConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		err = db.Create(shareCode).Error
+		if err == nil {
+			return shareCode, nil
+		}
+	}
+
+	return nil, err
+}
+
+func GetShareCode(code string) (*ShareCode, error) {
+	if code == "" {
+		return nil, errors.New("invalid share code")
+	}
+
+	var shareCode ShareCode
+	err := db.Take(&shareCode, "code = ?", code).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = getLegacyShareCode(code, &shareCode)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if shareCode.Expired() {
+		return nil, ErrShareCodeExpired
+	}
+
+	if shareCode.Exhausted() {
+		return nil, ErrShareCodeExhausted
+	}
+
+	return &shareCode, nil
+}
+
+// getLegacyShareCode resolves the sequential sqids codes handed out before
+// share codes were random, for as long as their migration window is open.
+func getLegacyShareCode(code string, shareCode *ShareCode) error {
+	id := sqid.Decode(code)
+	if len(id) != 1 {
+		return gorm.ErrRecordNotFound
+	}
+
+	// sqids decodes plenty of strings it would never have produced
+	canonical, err := sqid.Encode(id)
+	if err != nil || canonical != code {
+		return gorm.ErrRecordNotFound
+	}
+
+	return db.Take(shareCode, "id = ? AND legacy_until > ?", id[0], time.Now().UTC()).Error
+}
+
+// shareResumeWindow is how long after a counted download the same client can
+// keep requesting ranges of the file without claiming another download.
+const shareResumeWindow = 6 * time.Hour
+
+// RecordShareCodeAccess logs a request made with a share code, claiming one of
+// its downloads when the request serves file contents. A range request only
+// continues a download, without claiming another, when the same client had a
+// download of the same path counted recently. Whatever the Range header says
+// otherwise, it is a new download.
+func RecordShareCodeAccess(shareCode *ShareCode, r *http.Request, path string, download bool) error {
+	if download && isRangeContinuation(r) {
+		resumed, err := resumesShareDownload(shareCode, r, path)
+		if err != nil {
+			return err
+		}
+		download = !resumed
+	}
+
+	access := &ShareCodeAccess{Path: path, Download: download}
+	if download {
+		return recordShareCodeAccess(shareCode, r, access, "downloads", "max_downloads")
+	}
+	return recordShareCodeAccess(shareCode, r, access, "", "")
+}
+
+// resumesShareDownload reports whether the client making r had a download of
+// path counted against the share code within the resume window.
+func resumesShareDownload(shareCode *ShareCode, r *http.Request, path string) (bool, error) {
+	var count int64
+	err := db.Model(&ShareCodeAccess{}).
+		Where("share_code_id = ? AND path = ? AND download = ?", shareCode.Id, path, true).
+		Where("ip = ? AND user_agent = ?", requestIP(r), r.UserAgent()).
+		Where("created_at > ?", time.Now().UTC().Add(-shareResumeWindow)).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// ClaimShareCodeUpload logs an upload to a file request before it is written,
+// claiming one of the files it accepts. The claim is given back with
+// ReleaseShareCodeUpload when the upload fails.
+func ClaimShareCodeUpload(shareCode *ShareCode, r *http.Request, path string) (*ShareCodeAccess, error) {
+	access := &ShareCodeAccess{Path: path, Upload: true}
+	err := recordShareCodeAccess(shareCode, r, access, "files", "max_files")
+	if err != nil {
+		return nil, err
+	}
+	return access, nil
+}
+
+// ReleaseShareCodeUpload gives back the file claimed for an upload that never
+// made it, the access stays logged without the upload.
+func ReleaseShareCodeUpload(shareCode *ShareCode, access *ShareCodeAccess) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&ShareCode{}).Where("id = ? AND files > 0", shareCode.Id).
+			Update("files", gorm.Expr("files - 1")).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(access).Update("upload", false).Error
+	})
+}
+
+// CompleteShareCodeUpload records where a claimed upload ended up, which the
+// conflict policy may have changed.
+func CompleteShareCodeUpload(access *ShareCodeAccess, path string) error {
+	if access.Path == path {
+		return nil
+	}
+	return db.Model(access).Update("path", path).Error
+}
+
+// recordShareCodeAccess bumps the hit count and optionally a usage counter of
+// a share code, failing with ErrShareCodeExhausted once the counter is at its
+// limit.
+func recordShareCodeAccess(shareCode *ShareCode, r *http.Request, access *ShareCodeAccess, counter, limit string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		updates := map[string]interface{}{"hits": gorm.Expr("hits + 1")}
+		query := tx.Model(&ShareCode{}).Where("id = ?", shareCode.Id)
+		if counter != "" {
+			updates[counter] = gorm.Expr(counter + " + 1")
+			query = query.Where(fmt.Sprintf("%s = 0 OR %s < %s", limit, counter, limit))
+		}
+
+		result := query.Updates(updates)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrShareCodeExhausted
+		}
+
+		access.ShareCodeId = shareCode.Id
+		access.IP = requestIP(r)
+		access.UserAgent = r.UserAgent()
+		return tx.Create(access).Error
+	})
+}
+
+// ListShareCodes returns the share codes owned by owner, or every share code
+// when owner is empty. An optional volume narrows the list down further.
+func ListShareCodes(owner, volume string) ([]ShareCode, error) {
+	query := db.Order("id DESC")
+	if owner != "" {
+		query = query.Where("owner = ?", owner)
+	}
+	if volume != "" {
+		query = query.Where("volume = ?", volume)
+	}
+
+	var shareCodes []ShareCode
+	err := query.Find(&shareCodes).Error
+	if err != nil {
+		return nil, err
+	}
+	return shareCodes, nil
+}
+
+// GetManagedShareCode looks up a share code by its id for someone that wants
+// to change it, share codes auth can't manage are reported as missing.
+func GetManagedShareCode(auth Authorization, id string) (*ShareCode, error) {
+	parsed, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, NewStatusError(http.StatusBadRequest, "invalid share id")
+	}
+
+	var shareCode ShareCode
+	err = db.Take(&shareCode, "id = ?", parsed).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if !shareCode.CanManage(auth) {
+		return nil, NewStatusError(http.StatusNotFound, "not found")
+	}
+	return &shareCode, nil
+}
+
+func RevokeShareCode(shareCode *ShareCode) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Delete(&ShareCodeAccess{}, "share_code_id = ?", shareCode.Id).Error
+		if err != nil {
+			return err
+		}
+		return tx.Delete(shareCode).Error
+	})
+}
+
+func GetShareCodeAccesses(shareCodeId uint, limit int) ([]ShareCodeAccess, error) {
+	var accesses []ShareCodeAccess
+	err := db.Where("share_code_id = ?", shareCodeId).Order("id DESC").Limit(limit).Find(&accesses).Error
+	if err != nil {
+		return nil, err
+	}
+	return accesses, nil
+}
+
+func PurgeExpiredShareCodes() (int64, error) {
+	result := db.Where("expires_at IS NOT NULL AND expires_at < ?", time.Now().UTC()).Delete(&ShareCode{})
+	if result.Error != nil {
+		return 0, result.Error
+	}
+
+	err := db.Where("share_code_id NOT IN (?)", db.Model(&ShareCode{}).Select("id")).Delete(&ShareCodeAccess{}).Error
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected, nil
+}
+
+// ShareCodePurger periodically removes expired share codes from the database.
+type ShareCodePurger struct {
+	interval time.Duration
+}
+
+func NewShareCodePurger(interval time.Duration) *ShareCodePurger {
+	return &ShareCodePurger{interval: interval}
+}
+
+func (p *ShareCodePurger) Serve(ctx context.Context) error {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		count, err := PurgeExpiredShareCodes()
+		if err != nil {
+			log.Printf("failed to purge expired share codes: %v", err)
+		} else if count > 0 {
+			log.Printf("purged %d expired share codes", count)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func shareCodeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrShareCodeExpired) {
+		gores.Error(w, http.StatusGone, "share code has expired")
+		return
+	} else if errors.Is(err, ErrShareCodeExhausted) {
+		gores.Error(w, http.StatusGone, "share code has been used up")
+		return
+	}
+
+	gores.Error(w, http.StatusNotFound, "not found")
+}
+
+// shareCodeRequest is the body accepted when creating a share code, either as
+// form values or as JSON.
+type shareCodeRequest struct {
+	Kind         string `json:"kind"`
+	TTL          string `json:"ttl"`
+	Password     string `json:"password"`
+	MaxDownloads uint   `json:"max_downloads"`
+	MaxFileSize  string `json:"max_file_size"`
+	MaxFiles     uint   `json:"max_files"`
+}
+
+func parseShareCodeRequest(r *http.Request) (*shareCodeRequest, error) {
+	var req shareCodeRequest
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			return nil, err
+		}
+		return &req, nil
+	}
+
+	req.Kind = r.FormValue("kind")
+	req.TTL = r.FormValue("ttl")
+	req.Password = r.FormValue("password")
+	req.MaxFileSize = r.FormValue("max_file_size")
+
+	if maxDownloads := r.FormValue("max_downloads"); maxDownloads != "" {
+		n, err := strconv.ParseUint(maxDownloads, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		req.MaxDownloads = uint(n)
+	}
+
+	if maxFiles := r.FormValue("max_files"); maxFiles != "" {
+		n, err := strconv.ParseUint(maxFiles, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		req.MaxFiles = uint(n)
+	}
+	return &req, nil
+}
+
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func (h *HTTPService) routeGetShareCode(w http.ResponseWriter, r *http.Request) {
+	shareCode, err := h.authStore.GetShareCode(r, chi.URLParam(r, "shareCode"))
+	if err != nil {
+		shareCodeError(w, err)
+		return
+	}
+
+	if shareCode.Kind == ShareKindUpload {
+		http.Redirect(w, r, "/r/"+chi.URLParam(r, "shareCode"), http.StatusTemporaryRedirect)
+		return
+	}
+
+	if shareCode.HasPassword() && !h.authStore.ShareCodeUnlocked(r, shareCode) {
+		h.template(w, r, "static/share-unlock.html", map[string]interface{}{
+			"Action": shareUnlockAction(r),
+			"Failed": false,
+		})
+		return
+	}
+
+	if next := shareNextURL(shareCode, r.URL.Query().Get("next")); next != "" {
+		http.Redirect(w, r, next, http.StatusTemporaryRedirect)
+		return
+	}
+
+	v := r.URL.Query()
+	v.Del("next")
+	v.Set("sc", shareCode.Code)
+
+	http.Redirect(w, r, fmt.Sprintf("/volume/%s/browse/%s?%s", shareCode.Volume, shareCode.Path, v.Encode()), http.StatusTemporaryRedirect)
+}
+
+// shareUnlockAction is where the unlock form of a share code posts to, keeping
+// the query so the unlocked share still leads where it was going to.
+func shareUnlockAction(r *http.Request) string {
+	action := "/s/" + url.PathEscape(chi.URLParam(r, "shareCode"))
+	if r.URL.RawQuery != "" {
+		action += "?" + r.URL.RawQuery
+	}
+	return action
+}
+
+// shareNextURL returns next with the share code added when it is a page of
+// the volume of the share at a path the share covers, so the unlock page can
+// only send visitors back to where the share leads. Anything else gives "".
+func shareNextURL(shareCode *ShareCode, next string) string {
+	if next == "" {
+		return ""
+	}
+
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Opaque != "" || u.User != nil {
+		return ""
+	}
+
+	rest, ok := strings.CutPrefix(u.Path, "/volume/"+shareCode.Volume+"/")
+	if !ok {
+		return ""
+	}
+	_, path, _ := strings.Cut(rest, "/")
+	if !shareCode.Covers(path) {
+		return ""
+	}
+
+	query := u.Query()
+	query.Set("sc", shareCode.Code)
+	return (&url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: query.Encode()}).String()
+}
+
+func (h *HTTPService) routePostShareCode(w http.ResponseWriter, r *http.Request) {
+	shareCode, err := h.authStore.GetShareCode(r, chi.URLParam(r, "shareCode"))
+	if err != nil {
+		shareCodeError(w, err)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		gores.Error(w, http.StatusBadRequest, "invalid form data")
+		return
+	}
+
+	if shareCode.HasPassword() && !shareCode.CheckPassword(r.PostForm.Get("password")) {
+		h.authStore.Failed(r)
+		w.WriteHeader(http.StatusUnauthorized)
+		h.template(w, r, "static/share-unlock.html", map[string]interface{}{
+			"Action": shareUnlockAction(r),
+			"Failed": true,
+		})
+		return
+	}
+
+	h.authStore.UnlockShareCode(w, shareCode)
+	http.Redirect(w, r, fmt.Sprintf("/s/%s?%s", chi.URLParam(r, "shareCode"), r.URL.RawQuery), http.StatusSeeOther)
+}
+
+func (h *HTTPService) routePostShareVolume(w http.ResponseWriter, r *http.Request) {
+	volume, auth := h.authStore.GetVolume(w, r, PermissionShare)
+	if volume == nil {
+		return
+	}
+
+	path, err := url.PathUnescape(chi.URLParam(r, "*"))
+	if err != nil {
+		panic(err)
+	}
+
+	req, err := parseShareCodeRequest(r)
+	if err != nil {
+		gores.Error(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	shareCode, err := h.createShareCode(volume, auth, path, req)
+	if err != nil {
+		RecordAudit(r, auth, AuditEvent{Action: "share", Volume: volume.Name, Path: path, Result: AuditFailure, Detail: err.Error()})
+		statusErrorResponse(w, err)
+		return
+	}
+	RecordAudit(r, auth, AuditEvent{Action: "share", Volume: volume.Name, Path: path, Detail: shareCode.Code})
+
+	url := shareCode.URL(h.config.HTTP)
+	if wantsJSON(r) {
+		gores.JSON(w, http.StatusOK, map[string]interface{}{
+			"code":          shareCode.Code,
+			"link":          url,
+			"kind":          shareCode.Kind,
+			"expires_at":    shareCode.ExpiresAt,
+			"max_downloads": shareCode.MaxDownloads,
+			"max_file_size": shareCode.MaxFileSize,
+			"max_files":     shareCode.MaxFiles,
+		})
+		return
+	}
+
+	h.templateFragment(w, r, "share-code", url)
+	return
+}
+
+// createShareCode makes a share code for path on volume as requested, any
+// problem with the request is returned as a StatusError.
+func (h *HTTPService) createShareCode(volume *Volume, auth Authorization, path string, req *shareCodeRequest) (*ShareCode, error) {
+	// make sure the path exists
+	info, err := volume.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, NewStatusError(http.StatusNotFound, "not found")
+		}
+		return nil, NewStatusError(http.StatusInternalServerError, "failed to stat path")
+	}
+
+	ttl, err := volume.ShareLifetime(req.TTL)
+	if err != nil {
+		return nil, NewStatusError(http.StatusBadRequest, err.Error())
+	}
+
+	kind := ShareKindFile
+	if info.IsDir() {
+		kind = ShareKindTree
+	}
+
+	var maxFileSize uint64
+	if req.Kind == ShareKindUpload {
+		if !volume.HasFeature("upload") {
+			return nil, NewStatusError(http.StatusBadRequest, "upload is not available for this volume")
+		}
+
+		if !info.IsDir() {
+			return nil, NewStatusError(http.StatusBadRequest, "files can only be requested into a directory")
+		}
+
+		// whoever gets the link writes as if they were the creator
+		if !auth.CanAccess(volume, path, PermissionWrite) {
+			return nil, NewStatusError(http.StatusNotFound, "not found")
+		}
+
+		if req.MaxFileSize != "" {
+			maxFileSize, err = humanize.ParseBytes(req.MaxFileSize)
+			if err != nil {
+				return nil, NewStatusError(http.StatusBadRequest, "invalid max file size")
+			}
+		}
+
+		kind = ShareKindUpload
+	}
+
+	shareCode, err := MakeShareCode(h.config.HTTP, volume.Name, path, ShareCodeOptions{
+		Owner:        auth.Identity(),
+		Kind:         kind,
+		TTL:          ttl,
+		Password:     req.Password,
+		MaxDownloads: req.MaxDownloads,
+		MaxFileSize:  int64(maxFileSize),
+		MaxFiles:     req.MaxFiles,
+	})
+	if err != nil {
+		return nil, NewStatusError(http.StatusInternalServerError, "failed to generate share code")
+	}
+	return shareCode, nil
+}
+
+// shareCodeView is a share code as listed on the shares page and API.
+type shareCodeView struct {
+	*ShareCode
+	URL      string            `json:"url"`
+	Accesses []ShareCodeAccess `json:"recent_accesses"`
+}
+
+func (h *HTTPService) newShareCodeView(shareCode *ShareCode) (*shareCodeView, error) {
+	accesses, err := GetShareCodeAccesses(shareCode.Id, 10)
+	if err != nil {
+		return nil, err
+	}
+
+	return &shareCodeView{
+		ShareCode: shareCode,
+		URL:       shareCode.URL(h.config.HTTP),
+		Accesses:  accesses,
+	}, nil
+}
+
+// getManagedShareCode loads the share code named in the route, making sure
+// the caller is allowed to manage it.
+func (h *HTTPService) getManagedShareCode(w http.ResponseWriter, r *http.Request) (*ShareCode, Authorization) {
+	auth := h.authStore.Check(r)
+	if auth == nil || auth.Identity() == "" {
+		gores.Error(w, http.StatusUnauthorized, "unauthorized")
+		return nil, nil
+	}
+
+	shareCode, err := GetManagedShareCode(auth, chi.URLParam(r, "shareId"))
+	if err != nil {
+		statusErrorResponse(w, err)
+		return nil, nil
+	}
+
+	return shareCode, auth
+}
+
+func (h *HTTPService) routeGetShares(w http.ResponseWriter, r *http.Request) {
+	auth := h.authStore.Check(r)
+	if auth == nil || auth.Identity() == "" {
+		gores.Error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	owner := auth.Identity()
+	if auth.IsAdmin() && !r.URL.Query().Has("mine") {
+		owner = ""
+	}
+
+	shareCodes, err := ListShareCodes(owner, r.URL.Query().Get("volume"))
+	if err != nil {
+		ErrorResponse(w, err)
+		return
+	}
+
+	views := []*shareCodeView{}
+	for i := range shareCodes {
+		view, err := h.newShareCodeView(&shareCodes[i])
+		if err != nil {
+			ErrorResponse(w, err)
+			return
+		}
+		views = append(views, view)
+	}
+
+	if wantsJSON(r) {
+		gores.JSON(w, http.StatusOK, map[string]interface{}{
+			"share_codes": views,
+		})
+		return
+	}
+
+	h.template(w, r, "static/shares.html", map[string]interface{}{
+		"ShareCodes": views,
+		"IsAdmin":    auth.IsAdmin(),
+	})
+}
+
+func (h *HTTPService) routeDeleteShare(w http.ResponseWriter, r *http.Request) {
+	shareCode, _ := h.getManagedShareCode(w, r)
+	if shareCode == nil {
+		return
+	}
+
+	err := RevokeShareCode(shareCode)
+	if err != nil {
+		ErrorResponse(w, err)
+		return
+	}
+
+	if wantsJSON(r) {
+		gores.NoContent(w)
+		return
+	}
+
+	// htmx swaps the row out for this empty response
+	gores.HTML(w, http.StatusOK, "")
+}
+
+func (h *HTTPService) routePostShareExpiry(w http.ResponseWriter, r *http.Request) {
+	shareCode, _ := h.getManagedShareCode(w, r)
+	if shareCode == nil {
+		return
+	}
+
+	volume := h.fileStore.GetVolume(shareCode.Volume)
+	if volume == nil {
+		gores.Error(w, http.StatusNotFound, "volume no longer exists")
+		return
+	}
+
+	req, err := parseShareCodeRequest(r)
+	if err != nil {
+		gores.Error(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	ttl, err := volume.ShareLifetime(req.TTL)
+	if err != nil {
+		gores.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err = shareCode.SetLifetime(ttl)
+	if err != nil {
+		ErrorResponse(w, err)
+		return
+	}
+
+	view, err := h.newShareCodeView(shareCode)
+	if err != nil {
+		ErrorResponse(w, err)
+		return
+	}
+
+	if wantsJSON(r) {
+		gores.JSON(w, http.StatusOK, view)
+		return
+	}
+
+	h.templateFragment(w, r, "share-row", view)
+}
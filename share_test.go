@@ -0,0 +1,110 @@
+package files
+
+import "testing"
+
+func TestShareCodeCovers(t *testing.T) {
+	cases := []struct {
+		name  string
+		kind  string
+		root  string
+		path  string
+		allow bool
+	}{
+		{"tree root", ShareKindTree, "photos/2024", "photos/2024", true},
+		{"tree child", ShareKindTree, "photos/2024", "photos/2024/a.jpg", true},
+		{"tree nested child", ShareKindTree, "photos/2024", "photos/2024/trip/a.jpg", true},
+		{"tree leading slash", ShareKindTree, "photos/2024", "/photos/2024/a.jpg", true},
+		{"tree parent", ShareKindTree, "photos/2024", "photos", false},
+		{"tree sibling prefix", ShareKindTree, "photos/2024", "photos/2024-private", false},
+		{"tree sibling prefix child", ShareKindTree, "photos/2024", "photos/2024-private/a.jpg", false},
+		{"tree sibling file", ShareKindTree, "photos/2024", "photos/2024.zip", false},
+		{"tree dotdot out", ShareKindTree, "photos/2024", "photos/2024/../2023/a.jpg", false},
+		{"tree dotdot above root", ShareKindTree, "photos/2024", "photos/2024/../../secret", false},
+		{"tree dotdot staying inside", ShareKindTree, "photos/2024", "photos/2024/trip/../a.jpg", true},
+		{"tree dot segments", ShareKindTree, "photos/2024", "./photos/./2024/a.jpg", true},
+		{"tree trailing slash on path", ShareKindTree, "photos/2024", "photos/2024/", true},
+		{"tree trailing slash on root", ShareKindTree, "photos/2024/", "photos/2024/a.jpg", true},
+		{"tree trailing slash on root sibling", ShareKindTree, "photos/2024/", "photos/2024-private", false},
+		{"tree dirty root", ShareKindTree, "/photos/./2024/", "photos/2024/a.jpg", true},
+		{"volume root", ShareKindTree, "", "anything/at/all.txt", true},
+		{"volume root slash", ShareKindTree, "/", "a.txt", true},
+		{"volume root itself", ShareKindTree, "/", "", true},
+		{"volume root dotdot", ShareKindTree, "/", "../../etc/passwd", true},
+
+		{"file itself", ShareKindFile, "photos/2024.zip", "photos/2024.zip", true},
+		{"file leading slash", ShareKindFile, "photos/2024.zip", "/photos/2024.zip", true},
+		{"file dot segments", ShareKindFile, "photos/2024.zip", "photos/./2024.zip", true},
+		{"file trailing slash", ShareKindFile, "photos/2024.zip", "photos/2024.zip/", true},
+		{"file below", ShareKindFile, "photos/2024.zip", "photos/2024.zip/a.jpg", false},
+		{"file parent", ShareKindFile, "photos/2024.zip", "photos", false},
+		{"file sibling", ShareKindFile, "photos/2024.zip", "photos/2024.zip.bak", false},
+		{"file dotdot out", ShareKindFile, "photos/2024.zip", "photos/2024.zip/../2023.zip", false},
+		{"file at volume root", ShareKindFile, "a.txt", "/", false},
+
+		{"legacy root", "", "photos/2024", "photos/2024", true},
+		{"legacy child", "", "photos/2024", "photos/2024/a.jpg", true},
+		{"legacy sibling prefix", "", "photos/2024", "photos/2024-private", false},
+		{"legacy sibling file", "", "photos/2024", "photos/2024.zip", false},
+		{"legacy dotdot out", "", "photos/2024", "photos/2024/../2023", false},
+		{"legacy volume root", "", "", "a/b.txt", true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			shareCode := &ShareCode{Kind: c.kind, Volume: "v", Path: c.root}
+			if got := shareCode.Covers(c.path); got != c.allow {
+				t.Errorf("%s share of %q covers %q = %v, want %v", c.kind, c.root, c.path, got, c.allow)
+			}
+		})
+	}
+}
+
+func TestShareCodeAuthorizationCanAccess(t *testing.T) {
+	volume := &Volume{Name: "v"}
+	other := &Volume{Name: "v-other"}
+
+	cases := []struct {
+		name       string
+		kind       string
+		root       string
+		volume     *Volume
+		path       string
+		permission Permission
+		allow      bool
+	}{
+		{"tree read", ShareKindTree, "photos/2024", volume, "photos/2024/a.jpg", PermissionRead, true},
+		{"tree list", ShareKindTree, "photos/2024", volume, "photos/2024", PermissionList, true},
+		{"tree sibling prefix", ShareKindTree, "photos/2024", volume, "photos/2024-private/a.jpg", PermissionRead, false},
+		{"tree sibling file", ShareKindTree, "photos/2024", volume, "photos/2024.zip", PermissionRead, false},
+		{"tree dotdot", ShareKindTree, "photos/2024", volume, "photos/2024/../2023", PermissionList, false},
+		{"tree other volume", ShareKindTree, "photos/2024", other, "photos/2024/a.jpg", PermissionRead, false},
+		{"tree write", ShareKindTree, "photos/2024", volume, "photos/2024/a.jpg", PermissionWrite, false},
+		{"tree search", ShareKindTree, "photos/2024", volume, "photos/2024", PermissionSearch, false},
+		{"tree share", ShareKindTree, "photos/2024", volume, "photos/2024/a.jpg", PermissionShare, false},
+		{"volume root read", ShareKindTree, "/", volume, "a/b.txt", PermissionRead, true},
+		{"volume root other volume", ShareKindTree, "/", other, "a/b.txt", PermissionRead, false},
+		{"volume root write", ShareKindTree, "/", volume, "a/b.txt", PermissionWrite, false},
+
+		{"file read", ShareKindFile, "photos/2024.zip", volume, "photos/2024.zip", PermissionRead, true},
+		{"file list parent", ShareKindFile, "photos/2024.zip", volume, "photos", PermissionList, false},
+		{"file sibling", ShareKindFile, "photos/2024.zip", volume, "photos/2023.zip", PermissionRead, false},
+		{"file write", ShareKindFile, "photos/2024.zip", volume, "photos/2024.zip", PermissionWrite, false},
+
+		{"legacy read", "", "photos/2024", volume, "photos/2024/a.jpg", PermissionRead, true},
+		{"legacy sibling prefix", "", "photos/2024", volume, "photos/2024-private", PermissionRead, false},
+		{"legacy write", "", "photos/2024", volume, "photos/2024/a.jpg", PermissionWrite, false},
+
+		{"upload read", ShareKindUpload, "inbox", volume, "inbox/a.txt", PermissionRead, false},
+		{"upload list", ShareKindUpload, "inbox", volume, "inbox", PermissionList, false},
+		{"upload write", ShareKindUpload, "inbox", volume, "inbox/a.txt", PermissionWrite, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			auth := NewShareCodeAuthorization(&ShareCode{Kind: c.kind, Volume: "v", Path: c.root})
+			if got := auth.CanAccess(c.volume, c.path, c.permission); got != c.allow {
+				t.Errorf("%s share of %q can %s %s:%q = %v, want %v", c.kind, c.root, c.permission, c.volume.Name, c.path, got, c.allow)
+			}
+		})
+	}
+}
@@ -1,16 +1,36 @@
 package files
 
 import (
-	"io"
+	"errors"
 	"net/http"
-	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/alioygur/gores"
 )
 
+// sharexDirectory is the directory uploads of a user go into. Discord users
+// keep the directories named by their bare id from before other providers.
+func sharexDirectory(userId string) string {
+	provider, id, _ := strings.Cut(userId, ":")
+	if id == "" {
+		return ""
+	} else if provider == ProviderDiscord {
+		return id
+	}
+	return provider + "-" + strings.NewReplacer("/", "_", "\\", "_").Replace(id)
+}
+
 func (h *HTTPService) routePostSharex(w http.ResponseWriter, r *http.Request) {
-	volume, auth := h.authStore.GetVolume(w, r, true)
+	// uploads go into the directory of the user, which is what they need to
+	// be able to write to
+	userDirectory := ""
+	if auth := h.authStore.Check(r); auth != nil {
+		userDirectory = sharexDirectory(auth.UserId())
+	}
+
+	volume, auth := h.authStore.GetVolumeAt(w, r, userDirectory, PermissionWrite)
 	if volume == nil {
 		return
 	}
@@ -22,38 +42,77 @@ func (h *HTTPService) routePostSharex(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	discordUserId := auth.DiscordUserId()
-	if discordUserId == "" {
+	if userDirectory == "" {
 		gores.Error(w, http.StatusBadRequest, "must be authorized with a user account to use sharex")
 		return
 	}
 
-	err = volume.MkdirAll(discordUserId, os.ModePerm)
+	target := filepath.Join(userDirectory, fileHeader.Filename)
+	if !auth.CanAccess(volume, target, PermissionWrite) {
+		RecordAudit(r, auth, AuditEvent{Action: "sharex", Volume: volume.Name, Path: target, Result: AuditDenied})
+		gores.Error(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	ttl, err := volume.ShareLifetime(r.FormValue("ttl"))
 	if err != nil {
-		gores.Error(w, http.StatusInternalServerError, "failed to create user directory")
+		gores.Error(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	path := filepath.Join(discordUserId, fileHeader.Filename)
-	dst, err := volume.Create(path)
+	var maxDownloads uint64
+	if raw := r.FormValue("max_downloads"); raw != "" {
+		maxDownloads, err = strconv.ParseUint(raw, 10, 32)
+		if err != nil {
+			gores.Error(w, http.StatusBadRequest, "invalid max_downloads")
+			return
+		}
+	}
+
+	err = volume.MkdirAll(userDirectory)
 	if err != nil {
-		gores.Error(w, http.StatusInternalServerError, "failed to create file")
+		gores.Error(w, http.StatusInternalServerError, "failed to create user directory")
 		return
 	}
-	defer dst.Close()
 
-	_, err = io.Copy(dst, file)
+	path, _, err := volume.WriteFile(target, file, volume.ConflictPolicy)
 	if err != nil {
+		RecordAudit(r, auth, AuditEvent{
+			Action: "sharex",
+			Volume: volume.Name,
+			Path:   target,
+			Result: AuditFailure,
+			Detail: err.Error(),
+		})
+		if errors.Is(err, ErrFileExists) {
+			gores.Error(w, http.StatusConflict, err.Error())
+			return
+		}
 		gores.Error(w, http.StatusInternalServerError, "failed to create file")
 		return
 	}
 
-	shareCode, err := MakeShareCode(volume.Name, path)
+	// the upload stays, it just can't be shared by whoever made it
+	if !auth.CanAccess(volume, path, PermissionShare) {
+		RecordAudit(r, auth, AuditEvent{Action: "sharex", Volume: volume.Name, Path: path, Result: AuditDenied})
+		gores.Error(w, http.StatusForbidden, "not allowed to share uploads")
+		return
+	}
+
+	shareCode, err := MakeShareCode(h.config.HTTP, volume.Name, path, ShareCodeOptions{
+		Owner:        auth.Identity(),
+		Kind:         ShareKindFile,
+		TTL:          ttl,
+		Password:     r.FormValue("password"),
+		MaxDownloads: uint(maxDownloads),
+	})
 	if err != nil {
 		gores.Error(w, http.StatusInternalServerError, "failed to generate share code")
 		return
 	}
 
+	RecordAudit(r, auth, AuditEvent{Action: "sharex", Volume: volume.Name, Path: path, Detail: shareCode.Code})
+
 	url := shareCode.URL(h.config.HTTP)
 	gores.JSON(w, http.StatusOK, map[string]string{
 		"link": url,
@@ -0,0 +1,297 @@
+package files
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alioygur/gores"
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+// UserToken is a token issued to a user for clients that can't log in. Only
+// its id is stored, which the token carries, so it can be listed and revoked.
+type UserToken struct {
+	Id         string     `json:"id" gorm:"primaryKey"`
+	UserId     string     `json:"user_id" gorm:"index"`
+	Label      string     `json:"label"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+// userTokenClaims is what a token is made of before it is signed.
+type userTokenClaims struct {
+	Id       string `json:"id"`
+	UserId   string `json:"uid"`
+	IssuedAt int64  `json:"iat"`
+}
+
+// IssueUserToken makes a new token for userId, returning it along with the
+// only copy of the token itself.
+func (a *AuthStore) IssueUserToken(userId, label string) (*UserToken, string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, "", err
+	}
+
+	userToken := &UserToken{
+		Id:        hex.EncodeToString(id),
+		UserId:    userId,
+		Label:     label,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	lifetime, _ := a.config.HTTP.TokenLifetime()
+	if lifetime > 0 {
+		expiresAt := userToken.CreatedAt.Add(lifetime)
+		userToken.ExpiresAt = &expiresAt
+	}
+
+	data, err := json.Marshal(userTokenClaims{
+		Id:       userToken.Id,
+		UserId:   userId,
+		IssuedAt: userToken.CreatedAt.Unix(),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = db.Create(userToken).Error
+	if err != nil {
+		return nil, "", err
+	}
+	return userToken, base64.RawURLEncoding.EncodeToString(a.signer.Sign(data)), nil
+}
+
+// ValidateUserToken returns the user a token was issued to, or an empty string
+// when it isn't valid. Tokens stop working once they are older than the
+// configured maximum age, even if it was lowered after they were issued.
+func (a *AuthStore) ValidateUserToken(token string) string {
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return ""
+	}
+	raw, err := a.signer.Unsign(decoded)
+	if err != nil {
+		return ""
+	}
+	var claims userTokenClaims
+	err = json.Unmarshal(raw, &claims)
+	if err != nil || claims.Id == "" {
+		return ""
+	}
+
+	// tokens from before other providers carry a bare discord id
+	if !strings.Contains(claims.UserId, ":") {
+		claims.UserId = ProviderDiscord + ":" + claims.UserId
+	}
+
+	lifetime, _ := a.config.HTTP.TokenLifetime()
+	if lifetime > 0 && time.Since(time.Unix(claims.IssuedAt, 0)) > lifetime {
+		return ""
+	}
+
+	var userToken UserToken
+	err = db.Take(&userToken, "id = ? AND user_id = ?", claims.Id, claims.UserId).Error
+	if err != nil || userToken.RevokedAt != nil {
+		return ""
+	}
+
+	now := time.Now().UTC()
+	if userToken.LastUsedAt == nil || now.Sub(*userToken.LastUsedAt) > lastUsedInterval {
+		db.Model(&userToken).UpdateColumn("last_used_at", now)
+	}
+	return claims.UserId
+}
+
+// migrateUserTokenIds qualifies the user ids of tokens issued before other
+// login providers with the discord provider.
+func migrateUserTokenIds() error {
+	return db.Model(&UserToken{}).Where("user_id NOT LIKE ?", "%:%").
+		UpdateColumn("user_id", gorm.Expr("? || user_id", ProviderDiscord+":")).Error
+}
+
+// ListUserTokens returns the tokens of a user that still work, newest first.
+func ListUserTokens(userId string) ([]UserToken, error) {
+	var tokens []UserToken
+	err := db.Where("user_id = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", userId, time.Now().UTC()).
+		Order("created_at DESC").Find(&tokens).Error
+	return tokens, err
+}
+
+func GetUserToken(userId, id string) (*UserToken, error) {
+	var userToken UserToken
+	if err := db.Take(&userToken, "user_id = ? AND id = ?", userId, id).Error; err != nil {
+		return nil, err
+	}
+	return &userToken, nil
+}
+
+// RevokeUserToken stops a token from working. The row is kept until the token
+// would have expired anyway, since it is what rejects the token.
+func RevokeUserToken(userToken *UserToken) error {
+	now := time.Now().UTC()
+	userToken.RevokedAt = &now
+	return db.Model(userToken).Update("revoked_at", now).Error
+}
+
+// PurgeExpiredUserTokens deletes tokens past their expiry, they are rejected
+// by their age alone.
+func PurgeExpiredUserTokens() (int64, error) {
+	result := db.Where("expires_at IS NOT NULL AND expires_at < ?", time.Now().UTC()).Delete(&UserToken{})
+	return result.RowsAffected, result.Error
+}
+
+// UserTokenPurger periodically deletes expired user tokens.
+type UserTokenPurger struct {
+	interval time.Duration
+}
+
+func NewUserTokenPurger(interval time.Duration) *UserTokenPurger {
+	return &UserTokenPurger{interval: interval}
+}
+
+func (p *UserTokenPurger) Serve(ctx context.Context) error {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		count, err := PurgeExpiredUserTokens()
+		if err != nil {
+			log.Printf("failed to purge expired user tokens: %v", err)
+		} else if count > 0 {
+			log.Printf("purged %d expired user tokens", count)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// tokenUser authorizes a request to manage the tokens of whoever makes it,
+// writing an error and returning an empty user id when it can't continue.
+// Issuing and revoking tokens needs the session, so a token or api key can't
+// be used to mint more tokens or revoke the ones of its user.
+func (h *HTTPService) tokenUser(w http.ResponseWriter, r *http.Request, sessionOnly bool) string {
+	var auth Authorization
+	if sessionOnly {
+		if r.Header.Get("Authorization") != "" || r.URL.Query().Has("sc") {
+			gores.Error(w, http.StatusForbidden, "tokens can only be managed from a logged in session")
+			return ""
+		}
+		auth = h.authStore.CheckSession(r)
+	} else {
+		auth = h.authStore.Check(r)
+	}
+	if auth == nil {
+		gores.Error(w, http.StatusUnauthorized, "unauthorized")
+		return ""
+	}
+
+	userId := auth.UserId()
+	if userId == "" {
+		gores.Error(w, http.StatusBadRequest, "can only generate tokens for user authentication")
+		return ""
+	}
+	return userId
+}
+
+// tokensPage renders the tokens of a user, along with a token that was just
+// issued since it can't be looked up again.
+func (h *HTTPService) tokensPage(w http.ResponseWriter, r *http.Request, userId string, newToken string) {
+	tokens, err := ListUserTokens(userId)
+	if err != nil {
+		ErrorResponse(w, err)
+		return
+	}
+
+	h.template(w, r, "static/token.html", map[string]interface{}{
+		"Tokens":   tokens,
+		"NewToken": newToken,
+	})
+}
+
+func (h *HTTPService) routeGetToken(w http.ResponseWriter, r *http.Request) {
+	userId := h.tokenUser(w, r, false)
+	if userId == "" {
+		return
+	}
+
+	if wantsJSON(r) {
+		tokens, err := ListUserTokens(userId)
+		if err != nil {
+			ErrorResponse(w, err)
+			return
+		}
+
+		gores.JSON(w, http.StatusOK, map[string]interface{}{
+			"tokens": tokens,
+		})
+		return
+	}
+
+	h.tokensPage(w, r, userId, "")
+}
+
+func (h *HTTPService) routePostToken(w http.ResponseWriter, r *http.Request) {
+	userId := h.tokenUser(w, r, true)
+	if userId == "" {
+		return
+	}
+
+	userToken, token, err := h.authStore.IssueUserToken(userId, r.FormValue("label"))
+	if err != nil {
+		gores.Error(w, http.StatusInternalServerError, "failed to issue token")
+		return
+	}
+
+	if wantsJSON(r) {
+		gores.JSON(w, http.StatusCreated, map[string]interface{}{
+			"token":      token,
+			"user_token": userToken,
+		})
+		return
+	}
+
+	h.tokensPage(w, r, userId, token)
+}
+
+func (h *HTTPService) routeDeleteToken(w http.ResponseWriter, r *http.Request) {
+	userId := h.tokenUser(w, r, true)
+	if userId == "" {
+		return
+	}
+
+	userToken, err := GetUserToken(userId, chi.URLParam(r, "tokenId"))
+	if err != nil {
+		ErrorResponse(w, err)
+		return
+	}
+
+	err = RevokeUserToken(userToken)
+	if err != nil {
+		ErrorResponse(w, err)
+		return
+	}
+
+	if wantsJSON(r) {
+		gores.NoContent(w)
+		return
+	}
+
+	// htmx swaps the row out for this empty response
+	gores.HTML(w, http.StatusOK, "")
+}
@@ -0,0 +1,324 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/alioygur/gores"
+	"github.com/dustin/go-humanize"
+	"github.com/go-chi/chi/v5"
+)
+
+const defaultTrashRetention = 30 * 24 * time.Hour
+
+// TrashItem is an entry that was deleted on a volume with the trash feature.
+// It is kept inside the trash area of the volume under its id until it is
+// restored to its original path or purged.
+type TrashItem struct {
+	Id           uint      `json:"id" gorm:"primaryKey"`
+	Volume       string    `json:"volume" gorm:"index"`
+	OriginalPath string    `json:"original_path"`
+	IsDir        bool      `json:"is_dir"`
+	Size         int64     `json:"size"`
+	DeletedBy    string    `json:"deleted_by"`
+	DeletedAt    time.Time `json:"deleted_at"`
+}
+
+func (t *TrashItem) TrashPath() string {
+	return filepath.Join(trashDir, strconv.FormatUint(uint64(t.Id), 10))
+}
+
+func (t *TrashItem) HumanSize() string {
+	return humanize.Bytes(uint64(t.Size))
+}
+
+// Trash moves p into the trash of the volume, recording who deleted it.
+func (v *Volume) Trash(p string, deletedBy string) (*TrashItem, error) {
+	if isVolumeRoot(p) || isInternalPath(p) {
+		return nil, &fs.PathError{Op: "trash", Path: p, Err: fs.ErrInvalid}
+	}
+
+	info, err := v.Backend.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+
+	item := &TrashItem{
+		Volume:       v.Name,
+		OriginalPath: cleanVolumePath(p),
+		IsDir:        info.IsDir(),
+		Size:         info.Size(),
+		DeletedBy:    deletedBy,
+		DeletedAt:    time.Now().UTC(),
+	}
+	if item.IsDir {
+		item.Size = 0
+	}
+
+	// the id names the entry inside the trash, so the row has to exist first
+	err = db.Create(item).Error
+	if err != nil {
+		return nil, err
+	}
+
+	err = v.Backend.MkdirAll(trashDir)
+	if err == nil {
+		err = v.Backend.Rename(p, item.TrashPath())
+	}
+	if err != nil {
+		db.Delete(item)
+		return nil, err
+	}
+
+	return item, nil
+}
+
+// Restore moves a trashed entry back to where it was deleted from, or next to
+// it when the conflict policy renames. The path it was restored to is
+// returned.
+func (v *Volume) Restore(item *TrashItem) (string, error) {
+	target, err := v.manageTarget(item.OriginalPath)
+	if err != nil {
+		return "", err
+	}
+
+	err = v.Backend.MkdirAll(filepath.Dir(target))
+	if err != nil {
+		return "", err
+	}
+
+	err = v.Backend.Rename(item.TrashPath(), target)
+	if err != nil {
+		return "", err
+	}
+
+	return target, db.Delete(item).Error
+}
+
+// Purge permanently deletes a trashed entry.
+func (v *Volume) Purge(item *TrashItem) error {
+	err := v.Backend.RemoveAll(item.TrashPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return db.Delete(item).Error
+}
+
+// cleanVolumePath normalizes a path within a volume the way links to it are
+// written, relative to the root of the volume.
+func cleanVolumePath(p string) string {
+	return cleanSharePath(p)[1:]
+}
+
+func ListTrashItems(volume string) ([]TrashItem, error) {
+	var items []TrashItem
+	err := db.Where("volume = ?", volume).Order("deleted_at DESC").Find(&items).Error
+	return items, err
+}
+
+func GetTrashItem(volume string, id string) (*TrashItem, error) {
+	var item TrashItem
+	if err := db.Take(&item, "volume = ? AND id = ?", volume, id).Error; err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+func PurgeExpiredTrash(fileStore *FileStore) (int, error) {
+	count := 0
+	for _, volume := range fileStore.Volumes {
+		if volume.TrashRetention == 0 {
+			continue
+		}
+
+		var items []TrashItem
+		err := db.Where("volume = ? AND deleted_at < ?", volume.Name, time.Now().UTC().Add(-volume.TrashRetention)).Find(&items).Error
+		if err != nil {
+			return count, err
+		}
+
+		for i := range items {
+			err = volume.Purge(&items[i])
+			if err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, nil
+}
+
+// TrashPurger periodically deletes entries that have been in the trash for
+// longer than their volume keeps them.
+type TrashPurger struct {
+	fileStore *FileStore
+	interval  time.Duration
+}
+
+func NewTrashPurger(fileStore *FileStore, interval time.Duration) *TrashPurger {
+	return &TrashPurger{fileStore: fileStore, interval: interval}
+}
+
+func (p *TrashPurger) Serve(ctx context.Context) error {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		count, err := PurgeExpiredTrash(p.fileStore)
+		if err != nil {
+			log.Printf("failed to purge trash: %v", err)
+		} else if count > 0 {
+			log.Printf("purged %d entries from the trash", count)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// trashVolume authorizes a trash request, writing an error and returning nil
+// when the request can't continue.
+func (h *HTTPService) trashVolume(w http.ResponseWriter, r *http.Request) (*Volume, Authorization) {
+	volume, auth := h.authStore.GetVolume(w, r, PermissionWrite)
+	if volume == nil {
+		return nil, nil
+	}
+
+	if !volume.HasFeature("manage") || !volume.HasFeature("trash") {
+		gores.Error(w, http.StatusNotFound, "trash is not available for this volume")
+		return nil, nil
+	}
+
+	return volume, auth
+}
+
+// trashItem looks up the trash item of a request, items auth couldn't write
+// to at their original path are treated as if they didn't exist. Denials are
+// audited as action.
+func trashItem(w http.ResponseWriter, r *http.Request, volume *Volume, auth Authorization, action string) *TrashItem {
+	item, err := GetTrashItem(volume.Name, chi.URLParam(r, "itemId"))
+	if err != nil {
+		ErrorResponse(w, err)
+		return nil
+	}
+
+	if !auth.CanAccess(volume, item.OriginalPath, PermissionWrite) {
+		RecordAudit(r, auth, AuditEvent{Action: action, Volume: volume.Name, Path: item.OriginalPath, Result: AuditDenied})
+		gores.Error(w, http.StatusNotFound, "not found")
+		return nil
+	}
+	return item
+}
+
+func (h *HTTPService) routeGetTrash(w http.ResponseWriter, r *http.Request) {
+	volume, auth := h.trashVolume(w, r)
+	if volume == nil {
+		return
+	}
+
+	all, err := ListTrashItems(volume.Name)
+	if err != nil {
+		ErrorResponse(w, err)
+		return
+	}
+
+	// only list what could be restored or purged
+	items := []TrashItem{}
+	for _, item := range all {
+		if auth.CanAccess(volume, item.OriginalPath, PermissionWrite) {
+			items = append(items, item)
+		}
+	}
+
+	if wantsJSON(r) {
+		gores.JSON(w, http.StatusOK, map[string]interface{}{
+			"items": items,
+		})
+		return
+	}
+
+	var purgeAfter string
+	if volume.TrashRetention > 0 {
+		purgeAfter = humanize.RelTime(time.Now(), time.Now().Add(volume.TrashRetention), "", "")
+	}
+
+	h.template(w, r, "static/trash.html", map[string]interface{}{
+		"Volume":     volume,
+		"Items":      items,
+		"PurgeAfter": purgeAfter,
+	})
+}
+
+func (h *HTTPService) routePostTrashRestore(w http.ResponseWriter, r *http.Request) {
+	volume, auth := h.trashVolume(w, r)
+	if volume == nil {
+		return
+	}
+
+	item := trashItem(w, r, volume, auth, "restore")
+	if item == nil {
+		return
+	}
+
+	path, err := volume.Restore(item)
+	if err != nil {
+		RecordAudit(r, auth, AuditEvent{Action: "restore", Volume: volume.Name, Path: item.OriginalPath, Result: AuditFailure, Detail: err.Error()})
+		if errors.Is(err, ErrFileExists) {
+			gores.Error(w, http.StatusConflict, fmt.Sprintf("%s already exists", item.OriginalPath))
+			return
+		}
+		gores.Error(w, http.StatusInternalServerError, "failed to restore")
+		return
+	}
+
+	RecordAudit(r, auth, AuditEvent{Action: "restore", Volume: volume.Name, Path: path})
+
+	if wantsJSON(r) {
+		gores.JSON(w, http.StatusOK, map[string]interface{}{
+			"path": path,
+		})
+		return
+	}
+
+	// htmx swaps the row out for this empty response
+	gores.HTML(w, http.StatusOK, "")
+}
+
+func (h *HTTPService) routeDeleteTrashItem(w http.ResponseWriter, r *http.Request) {
+	volume, auth := h.trashVolume(w, r)
+	if volume == nil {
+		return
+	}
+
+	item := trashItem(w, r, volume, auth, "purge")
+	if item == nil {
+		return
+	}
+
+	err := volume.Purge(item)
+	if err != nil {
+		RecordAudit(r, auth, AuditEvent{Action: "purge", Volume: volume.Name, Path: item.OriginalPath, Result: AuditFailure, Detail: err.Error()})
+		gores.Error(w, http.StatusInternalServerError, "failed to delete")
+		return
+	}
+
+	RecordAudit(r, auth, AuditEvent{Action: "purge", Volume: volume.Name, Path: item.OriginalPath})
+
+	if wantsJSON(r) {
+		gores.NoContent(w)
+		return
+	}
+
+	gores.HTML(w, http.StatusOK, "")
+}
@@ -0,0 +1,478 @@
+package files
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alioygur/gores"
+	"github.com/go-chi/chi/v5"
+)
+
+// Resumable uploads implement the core tus 1.0 protocol along with the
+// creation, termination and expiration extensions, see https://tus.io.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,expiration"
+
+	// tusUploadLifetime is how long an upload may sit without receiving data
+	// before it is thrown away.
+	tusUploadLifetime = 24 * time.Hour
+)
+
+// TusUpload is a resumable upload that is in progress. Its data is appended
+// to a staging file inside the volume, how much of it has arrived is always
+// read back from the size of that file so nothing is lost when the server
+// restarts halfway through a request.
+type TusUpload struct {
+	Id        string    `json:"id" gorm:"primaryKey"`
+	Owner     string    `json:"owner" gorm:"index"`
+	Volume    string    `json:"volume"`
+	Path      string    `json:"path"`
+	Filename  string    `json:"filename"`
+	Length    int64     `json:"length"`
+	Metadata  string    `json:"metadata"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (u *TusUpload) StagingPath() string {
+	return filepath.Join(stagingDir, "tus", u.Id)
+}
+
+func (u *TusUpload) TargetPath() string {
+	return filepath.Join(u.Path, u.Filename)
+}
+
+func (u *TusUpload) ExpiresAt() time.Time {
+	return u.UpdatedAt.Add(tusUploadLifetime)
+}
+
+func GetTusUpload(id string) (*TusUpload, error) {
+	var upload TusUpload
+	if err := db.Take(&upload, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+// parseTusMetadata decodes an Upload-Metadata header, a comma separated list
+// of keys each followed by an optional base64 encoded value.
+func parseTusMetadata(header string) (map[string]string, error) {
+	result := map[string]string{}
+	if header == "" {
+		return result, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("invalid upload metadata")
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upload metadata for '%s'", key)
+		}
+		result[key] = string(decoded)
+	}
+	return result, nil
+}
+
+func PurgeExpiredTusUploads(fileStore *FileStore) (int, error) {
+	var uploads []TusUpload
+	err := db.Where("updated_at < ?", time.Now().Add(-tusUploadLifetime)).Find(&uploads).Error
+	if err != nil {
+		return 0, err
+	}
+
+	for _, upload := range uploads {
+		if volume, ok := fileStore.Volumes[upload.Volume]; ok {
+			err = volume.Remove(upload.StagingPath())
+			if err != nil && !os.IsNotExist(err) {
+				return 0, err
+			}
+		}
+
+		err = db.Delete(&upload).Error
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(uploads), nil
+}
+
+// TusUploadPurger periodically throws away resumable uploads that were
+// abandoned.
+type TusUploadPurger struct {
+	fileStore *FileStore
+	interval  time.Duration
+}
+
+func NewTusUploadPurger(fileStore *FileStore, interval time.Duration) *TusUploadPurger {
+	return &TusUploadPurger{fileStore: fileStore, interval: interval}
+}
+
+func (p *TusUploadPurger) Serve(ctx context.Context) error {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		count, err := PurgeExpiredTusUploads(p.fileStore)
+		if err != nil {
+			log.Printf("failed to purge expired uploads: %v", err)
+		} else if count > 0 {
+			log.Printf("purged %d expired uploads", count)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// tusLocks makes sure only one request at a time writes to an upload.
+var tusLocks sync.Map
+
+func lockTusUpload(id string) (func(), bool) {
+	it, _ := tusLocks.LoadOrStore(id, &sync.Mutex{})
+	mu := it.(*sync.Mutex)
+	if !mu.TryLock() {
+		return nil, false
+	}
+	return mu.Unlock, true
+}
+
+// tusVolume authorizes a tus request for uploading into the directory at path
+// and checks the protocol version, writing an error and returning nil when the
+// request can't continue.
+func (h *HTTPService) tusVolume(w http.ResponseWriter, r *http.Request, path string) (*Volume, Authorization) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		gores.Error(w, http.StatusPreconditionFailed, "unsupported tus version")
+		return nil, nil
+	}
+
+	volume, auth := h.authStore.GetVolumeAt(w, r, path, PermissionWrite)
+	if volume == nil {
+		return nil, nil
+	}
+
+	if !volume.HasFeature("upload") {
+		gores.Error(w, http.StatusNotFound, "upload is not available for this volume")
+		return nil, nil
+	}
+
+	return volume, auth
+}
+
+// tusUpload authorizes a request for an existing upload and looks it up, only
+// whoever created it and admins can see or continue it.
+func (h *HTTPService) tusUpload(w http.ResponseWriter, r *http.Request) (*Volume, Authorization, *TusUpload) {
+	upload, err := GetTusUpload(chi.URLParam(r, "uploadId"))
+
+	path := ""
+	if err == nil {
+		path = upload.Path
+	}
+
+	volume, auth := h.tusVolume(w, r, path)
+	if volume == nil {
+		return nil, nil, nil
+	}
+
+	if err != nil {
+		ErrorResponse(w, err)
+		return nil, nil, nil
+	}
+
+	if upload.Volume != volume.Name || (!auth.IsAdmin() && upload.Owner != auth.Identity()) {
+		gores.Error(w, http.StatusNotFound, "not found")
+		return nil, nil, nil
+	}
+
+	return volume, auth, upload
+}
+
+func (h *HTTPService) routeOptionsTus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	gores.NoContent(w)
+}
+
+func (h *HTTPService) routePostTus(w http.ResponseWriter, r *http.Request) {
+	// the upload is authorized for the directory it goes into, broken
+	// metadata is only reported to someone who may upload
+	metadata, metadataErr := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	volume, auth := h.tusVolume(w, r, metadata["path"])
+	if volume == nil {
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		gores.Error(w, http.StatusBadRequest, "invalid upload length")
+		return
+	}
+
+	if metadataErr != nil {
+		gores.Error(w, http.StatusBadRequest, metadataErr.Error())
+		return
+	}
+
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = metadata["name"]
+	}
+	filename = filepath.Base(filename)
+	if filename == "." || filename == ".." || filename == string(filepath.Separator) {
+		gores.Error(w, http.StatusBadRequest, "invalid file name")
+		return
+	}
+
+	path := metadata["path"]
+	if isInternalPath(filepath.Join(path, filename)) {
+		gores.Error(w, http.StatusBadRequest, "invalid path")
+		return
+	}
+
+	info, err := volume.Stat(path)
+	if err != nil || !info.IsDir() {
+		gores.Error(w, http.StatusBadRequest, "path is not a directory")
+		return
+	}
+
+	// fail early rather than after the whole file was sent
+	_, err = volume.ResolveConflict(filepath.Join(path, filename), volume.ConflictPolicy)
+	if errors.Is(err, ErrFileExists) {
+		gores.Error(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		gores.Error(w, http.StatusInternalServerError, "failed to generate upload id")
+		return
+	}
+
+	upload := &TusUpload{
+		Id:       hex.EncodeToString(id),
+		Owner:    auth.Identity(),
+		Volume:   volume.Name,
+		Path:     path,
+		Filename: filename,
+		Length:   length,
+		Metadata: r.Header.Get("Upload-Metadata"),
+	}
+
+	err = volume.MkdirAll(filepath.Dir(upload.StagingPath()))
+	if err != nil {
+		gores.Error(w, http.StatusInternalServerError, "failed to create staging area")
+		return
+	}
+
+	f, err := volume.Append(upload.StagingPath())
+	if err != nil {
+		if errors.Is(err, errors.ErrUnsupported) {
+			gores.Error(w, http.StatusNotImplemented, "resumable uploads are not supported by this volume")
+			return
+		}
+		gores.Error(w, http.StatusInternalServerError, "failed to create upload")
+		return
+	}
+	f.Close()
+
+	err = db.Create(upload).Error
+	if err != nil {
+		volume.Remove(upload.StagingPath())
+		gores.Error(w, http.StatusInternalServerError, "failed to create upload")
+		return
+	}
+
+	// an empty file is already complete
+	if length == 0 {
+		err = h.finishTusUpload(r, volume, auth, upload)
+		if errors.Is(err, ErrFileExists) {
+			gores.Error(w, http.StatusConflict, err.Error())
+			return
+		} else if err != nil {
+			gores.Error(w, http.StatusInternalServerError, "failed to finish upload")
+			return
+		}
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("%s/volume/%s/tus/%s", h.config.HTTP.BaseURL(), volume.Name, upload.Id))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt().UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *HTTPService) routeHeadTus(w http.ResponseWriter, r *http.Request) {
+	volume, _, upload := h.tusUpload(w, r)
+	if volume == nil {
+		return
+	}
+
+	info, err := volume.Stat(upload.StagingPath())
+	if err != nil {
+		gores.Error(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(info.Size(), 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt().UTC().Format(http.TimeFormat))
+	if upload.Metadata != "" {
+		w.Header().Set("Upload-Metadata", upload.Metadata)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *HTTPService) routePatchTus(w http.ResponseWriter, r *http.Request) {
+	volume, auth, upload := h.tusUpload(w, r)
+	if volume == nil {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		gores.Error(w, http.StatusUnsupportedMediaType, "content type must be application/offset+octet-stream")
+		return
+	}
+
+	unlock, ok := lockTusUpload(upload.Id)
+	if !ok {
+		gores.Error(w, http.StatusLocked, "upload is already being written to")
+		return
+	}
+	defer unlock()
+
+	info, err := volume.Stat(upload.StagingPath())
+	if err != nil {
+		gores.Error(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != info.Size() {
+		gores.Error(w, http.StatusConflict, "upload offset does not match")
+		return
+	}
+
+	f, err := volume.Append(upload.StagingPath())
+	if err != nil {
+		gores.Error(w, http.StatusInternalServerError, "failed to open upload")
+		return
+	}
+
+	// whatever arrived before the connection dropped stays in the staging
+	// file, the client picks up from there after asking for the offset
+	written, copyErr := io.Copy(f, io.LimitReader(r.Body, upload.Length-offset))
+	if syncer, ok := f.(interface{ Sync() error }); ok && copyErr == nil {
+		copyErr = syncer.Sync()
+	}
+	err = f.Close()
+	if copyErr != nil || err != nil {
+		gores.Error(w, http.StatusInternalServerError, "failed to write upload")
+		return
+	}
+
+	offset += written
+	if offset == upload.Length {
+		err = h.finishTusUpload(r, volume, auth, upload)
+		if err != nil {
+			if errors.Is(err, ErrFileExists) {
+				gores.Error(w, http.StatusConflict, err.Error())
+				return
+			}
+			gores.Error(w, http.StatusInternalServerError, "failed to finish upload")
+			return
+		}
+	} else {
+		upload.UpdatedAt = time.Now()
+		err = db.Model(upload).Update("updated_at", upload.UpdatedAt).Error
+		if err != nil {
+			gores.Error(w, http.StatusInternalServerError, "failed to update upload")
+			return
+		}
+		w.Header().Set("Upload-Expires", upload.ExpiresAt().UTC().Format(http.TimeFormat))
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	gores.NoContent(w)
+}
+
+func (h *HTTPService) routeDeleteTus(w http.ResponseWriter, r *http.Request) {
+	volume, _, upload := h.tusUpload(w, r)
+	if volume == nil {
+		return
+	}
+
+	unlock, ok := lockTusUpload(upload.Id)
+	if !ok {
+		gores.Error(w, http.StatusLocked, "upload is already being written to")
+		return
+	}
+	defer unlock()
+
+	err := volume.Remove(upload.StagingPath())
+	if err != nil && !os.IsNotExist(err) {
+		gores.Error(w, http.StatusInternalServerError, "failed to remove upload")
+		return
+	}
+
+	err = db.Delete(upload).Error
+	if err != nil {
+		ErrorResponse(w, err)
+		return
+	}
+
+	gores.NoContent(w)
+}
+
+// finishTusUpload moves a complete upload out of the staging area into its
+// place in the volume and audits it for r. When the conflict policy rejects
+// the upload it is thrown away.
+func (h *HTTPService) finishTusUpload(r *http.Request, volume *Volume, auth Authorization, upload *TusUpload) error {
+	target, err := volume.PlaceFile(upload.StagingPath(), upload.TargetPath(), volume.ConflictPolicy)
+	if err != nil {
+		RecordAudit(r, auth, AuditEvent{
+			Action: "upload",
+			Volume: volume.Name,
+			Path:   upload.TargetPath(),
+			Result: AuditFailure,
+			Detail: err.Error(),
+		})
+	}
+	if errors.Is(err, ErrFileExists) {
+		volume.Remove(upload.StagingPath())
+		tusLocks.Delete(upload.Id)
+		db.Delete(upload)
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	RecordAudit(r, auth, AuditEvent{Action: "upload", Volume: volume.Name, Path: target})
+
+	tusLocks.Delete(upload.Id)
+	return db.Delete(upload).Error
+}
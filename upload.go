@@ -1,17 +1,21 @@
 package files
 
 import (
+	"errors"
 	"fmt"
-	"io"
+	"io/fs"
+	"log"
 	"net/http"
-	"os"
 	"path/filepath"
 
 	"github.com/alioygur/gores"
+	"github.com/dustin/go-humanize"
+	"github.com/go-chi/chi/v5"
 )
 
 func (h *HTTPService) routeGetUpload(w http.ResponseWriter, r *http.Request) {
-	volume, _ := h.authStore.GetVolume(w, r, true)
+	path := r.URL.Query().Get("path")
+	volume, _ := h.authStore.GetVolumeAt(w, r, path, PermissionWrite)
 	if volume == nil {
 		return
 	}
@@ -21,16 +25,24 @@ func (h *HTTPService) routeGetUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	path := r.URL.Query().Get("path")
-
-	h.template(w, "static/upload.html", map[string]interface{}{
+	h.template(w, r, "static/upload.html", map[string]interface{}{
 		"Volume": volume,
 		"Path":   path,
 	})
 }
 
 func (h *HTTPService) routePostUpload(w http.ResponseWriter, r *http.Request) {
-	volume, _ := h.authStore.GetVolume(w, r, true)
+	// file requests never grant access to the volume itself, so they can't go
+	// through GetVolume
+	if r.URL.Query().Get("sc") != "" {
+		h.routePostFileRequest(w, r)
+		return
+	}
+
+	// the directory is in the query as well as the form so the request can be
+	// authorized before the body is read
+	path := r.URL.Query().Get("path")
+	volume, auth := h.authStore.GetVolumeAt(w, r, path, PermissionWrite)
 	if volume == nil {
 		return
 	}
@@ -46,7 +58,13 @@ func (h *HTTPService) routePostUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	path := r.FormValue("path")
+	if values, ok := r.PostForm["path"]; ok && values[0] != path {
+		if !auth.CanAccess(volume, values[0], PermissionWrite) {
+			gores.Error(w, http.StatusNotFound, "not found")
+			return
+		}
+		path = values[0]
+	}
 
 	file, handler, err := r.FormFile("file")
 	if err != nil {
@@ -55,20 +73,185 @@ func (h *HTTPService) routePostUpload(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	f, err := volume.OpenFile(filepath.Join(path, handler.Filename), os.O_WRONLY|os.O_CREATE, 0666)
+	target, _, err := volume.WriteFile(filepath.Join(path, handler.Filename), file, volume.ConflictPolicy)
 	if err != nil {
+		RecordAudit(r, auth, AuditEvent{
+			Action: "upload",
+			Volume: volume.Name,
+			Path:   filepath.Join(path, handler.Filename),
+			Result: AuditFailure,
+			Detail: err.Error(),
+		})
+		if errors.Is(err, ErrFileExists) {
+			gores.Error(w, http.StatusConflict, err.Error())
+			return
+		} else if errors.Is(err, fs.ErrInvalid) {
+			gores.Error(w, http.StatusBadRequest, "invalid file name")
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer f.Close()
 
-	_, err = io.Copy(f, file)
+	RecordAudit(r, auth, AuditEvent{Action: "upload", Volume: volume.Name, Path: target})
+
+	url := fmt.Sprintf("%s/volume/%s/browse/%s", h.config.HTTP.BaseURL(), volume.Name, target)
+	w.Header().Add("HX-Redirect", url)
+	gores.NoContent(w)
+}
+
+// getFileRequest resolves the file request share code of a request, writing
+// an error and returning nil when it can't be used.
+func (h *HTTPService) getFileRequest(w http.ResponseWriter, r *http.Request, code string) *ShareCode {
+	shareCode, err := h.authStore.GetShareCode(r, code)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		shareCodeError(w, err)
+		return nil
+	}
+
+	if shareCode.Kind != ShareKindUpload {
+		gores.Error(w, http.StatusNotFound, "not found")
+		return nil
+	}
+
+	if shareCode.HasPassword() && !h.authStore.ShareCodeUnlocked(r, shareCode) {
+		gores.Error(w, http.StatusUnauthorized, "unauthorized")
+		return nil
+	}
+
+	return shareCode
+}
+
+func (h *HTTPService) routeGetFileRequest(w http.ResponseWriter, r *http.Request) {
+	shareCode, err := h.authStore.GetShareCode(r, chi.URLParam(r, "shareCode"))
+	if err != nil {
+		shareCodeError(w, err)
 		return
 	}
 
-	url := fmt.Sprintf("%s/volume/%s/browse/%s", h.config.HTTP.BaseURL(), volume.Name, filepath.Join(path, handler.Filename))
-	w.Header().Add("HX-Redirect", url)
-	gores.NoContent(w)
+	if shareCode.Kind != ShareKindUpload {
+		gores.Error(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	if shareCode.HasPassword() && !h.authStore.ShareCodeUnlocked(r, shareCode) {
+		h.template(w, r, "static/share-unlock.html", map[string]interface{}{
+			"Action": shareUnlockAction(r),
+			"Failed": false,
+		})
+		return
+	}
+
+	var remaining uint
+	if shareCode.MaxFiles > 0 {
+		remaining = shareCode.MaxFiles - shareCode.Files
+	}
+
+	h.template(w, r, "static/file-request.html", map[string]interface{}{
+		"ShareCode":   shareCode,
+		"MaxFileSize": humanize.Bytes(uint64(shareCode.MaxFileSize)),
+		"Remaining":   remaining,
+	})
+}
+
+func (h *HTTPService) routePostFileRequest(w http.ResponseWriter, r *http.Request) {
+	shareCode := h.getFileRequest(w, r, r.URL.Query().Get("sc"))
+	if shareCode == nil {
+		return
+	}
+
+	volume, ok := h.fileStore.Volumes[chi.URLParam(r, "volumeName")]
+	if !ok || volume.Name != shareCode.Volume || !volume.HasFeature("upload") {
+		gores.Error(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	if shareCode.MaxFileSize > 0 {
+		// leave some room for the rest of the multipart body
+		r.Body = http.MaxBytesReader(w, r.Body, shareCode.MaxFileSize+1<<20)
+	}
+
+	err := r.ParseMultipartForm(256 << 20)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			gores.Error(w, http.StatusRequestEntityTooLarge, "file is too large")
+			return
+		}
+		gores.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	file, handler, err := r.FormFile("file")
+	if err != nil {
+		gores.Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer file.Close()
+
+	if shareCode.MaxFileSize > 0 && handler.Size > shareCode.MaxFileSize {
+		gores.Error(w, http.StatusRequestEntityTooLarge, "file is too large")
+		return
+	}
+
+	name := filepath.Base(handler.Filename)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		gores.Error(w, http.StatusBadRequest, "invalid file name")
+		return
+	}
+
+	// uploaders can't see what is already there, so never let them replace it
+	policy := volume.ConflictPolicy
+	if policy == ConflictOverwrite {
+		policy = ConflictReject
+	}
+
+	// the file is claimed before writing so uploads can't go past the limit,
+	// and given back if the write fails
+	auth := NewShareCodeAuthorization(shareCode)
+	access, err := ClaimShareCodeUpload(shareCode, r, filepath.Join(shareCode.Path, name))
+	if err != nil {
+		if errors.Is(err, ErrShareCodeExhausted) {
+			RecordAudit(r, auth, AuditEvent{Action: "upload", Volume: volume.Name, Path: filepath.Join(shareCode.Path, name), Result: AuditDenied, Detail: err.Error()})
+			shareCodeError(w, err)
+			return
+		}
+		gores.Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	path, size, err := volume.WriteFile(filepath.Join(shareCode.Path, name), file, policy)
+	if err != nil {
+		releaseErr := ReleaseShareCodeUpload(shareCode, access)
+		if releaseErr != nil {
+			log.Printf("failed to release upload of share code %d: %v", shareCode.Id, releaseErr)
+		}
+
+		if errors.Is(err, ErrFileExists) {
+			gores.Error(w, http.StatusConflict, "a file with that name was already uploaded")
+			return
+		}
+		gores.Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	err = CompleteShareCodeUpload(access, path)
+	if err != nil {
+		log.Printf("failed to record upload of share code %d: %v", shareCode.Id, err)
+	}
+	name = filepath.Base(path)
+	RecordAudit(r, auth, AuditEvent{Action: "upload", Volume: volume.Name, Path: path})
+
+	if wantsJSON(r) {
+		gores.JSON(w, http.StatusOK, map[string]interface{}{
+			"name": name,
+			"size": size,
+		})
+		return
+	}
+
+	h.templateFragment(w, r, "file-request-uploaded", map[string]interface{}{
+		"Name": name,
+		"Size": humanize.Bytes(uint64(size)),
+	})
 }